@@ -7,11 +7,20 @@ import (
 )
 
 type Config struct {
-	Port         string
-	MongoURI     string
-	DatabaseName string
-	JWTSecret    string
-	JWTExpiry    string
+	Port            string
+	MongoURI        string
+	DatabaseName    string
+	JWTSecret       string
+	JWTExpiry       string
+	SweepInterval   string
+	DunningSchedule string
+	TaxRates        string
+	// PaymentProvider picks the payment gateway; only "fake" exists so far
+	PaymentProvider      string
+	PaymentWebhookSecret string
+	FakeSettleDelay      string
+	// FakeWebhookURL defaults to the server's own webhook endpoint
+	FakeWebhookURL string
 }
 
 func LoadConfig() *Config {
@@ -19,11 +28,19 @@ func LoadConfig() *Config {
 	_ = godotenv.Load()
 
 	return &Config{
-		Port:         getEnv("PORT"),
-		MongoURI:     getEnv("MONGO_URI"),
-		DatabaseName: getEnv("DATABASE_NAME"),
-		JWTSecret:    getEnv("JWT_SECRET"),
-		JWTExpiry:    getEnv("JWT_EXPIRY"),
+		Port:            getEnv("PORT"),
+		MongoURI:        getEnv("MONGO_URI"),
+		DatabaseName:    getEnv("DATABASE_NAME"),
+		JWTSecret:       getEnv("JWT_SECRET"),
+		JWTExpiry:       getEnv("JWT_EXPIRY"),
+		SweepInterval:   getEnvOrDefault("SWEEP_INTERVAL", "1m"),
+		DunningSchedule: getEnvOrDefault("DUNNING_SCHEDULE", "1,3,5"),
+		TaxRates:        os.Getenv("TAX_RATES"),
+
+		PaymentProvider:      getEnvOrDefault("PAYMENT_PROVIDER", "fake"),
+		PaymentWebhookSecret: getEnv("PAYMENT_WEBHOOK_SECRET"),
+		FakeSettleDelay:      getEnvOrDefault("FAKE_SETTLE_DELAY", "30s"),
+		FakeWebhookURL:       os.Getenv("FAKE_WEBHOOK_URL"),
 	}
 }
 
@@ -34,3 +51,10 @@ func getEnv(key string) string {
 		panic("Error: Loading Env File")
 	}
 }
+
+func getEnvOrDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,138 @@
+package controllers
+
+import (
+	"net/http"
+	"subservice/core/models"
+	"subservice/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type CouponController struct {
+	couponManager *models.CouponManager
+	validator     *validator.Validate
+}
+
+func NewCouponController(couponManager *models.CouponManager) *CouponController {
+	return &CouponController{
+		couponManager: couponManager,
+		validator:     validator.New(),
+	}
+}
+
+func (c *CouponController) CreateCoupon(ctx *gin.Context) {
+	var coupon models.Coupon
+	if err := ctx.ShouldBindJSON(&coupon); err != nil {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
+
+	if err := c.validator.Struct(&coupon); err != nil {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
+	if err := coupon.Check(); err != nil {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
+
+	if err := c.couponManager.Create(ctx.Request.Context(), &coupon); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			utils.ErrorResponse(ctx, http.StatusConflict, "Promo code already exists", err)
+			return
+		}
+		utils.InternalErrorResponse(ctx, err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusCreated, "Coupon created successfully", coupon)
+}
+
+func (c *CouponController) GetAllCoupons(ctx *gin.Context) {
+	coupons, err := c.couponManager.GetAll(ctx.Request.Context())
+	if err != nil {
+		utils.InternalErrorResponse(ctx, err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Coupons retrieved successfully", coupons)
+}
+
+func (c *CouponController) GetCoupon(ctx *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(ctx.Param("id"))
+	if err != nil {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Invalid coupon ID", err)
+		return
+	}
+
+	coupon, err := c.couponManager.GetByID(ctx.Request.Context(), id)
+	if err != nil {
+		utils.NotFoundResponse(ctx, "Coupon not found")
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Coupon retrieved successfully", coupon)
+}
+
+// UpdateCoupon leaves the terms subscriptions already redeemed unchanged.
+func (c *CouponController) UpdateCoupon(ctx *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(ctx.Param("id"))
+	if err != nil {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Invalid coupon ID", err)
+		return
+	}
+
+	var coupon models.Coupon
+	if err := ctx.ShouldBindJSON(&coupon); err != nil {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
+
+	if err := c.validator.Struct(&coupon); err != nil {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
+	if err := coupon.Check(); err != nil {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
+
+	updated, err := c.couponManager.Update(ctx.Request.Context(), id, &coupon)
+	if err == mongo.ErrNoDocuments {
+		utils.NotFoundResponse(ctx, "Coupon not found")
+		return
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		utils.ErrorResponse(ctx, http.StatusConflict, "Promo code already exists", err)
+		return
+	}
+	if err != nil {
+		utils.InternalErrorResponse(ctx, err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Coupon updated successfully", updated)
+}
+
+// DeleteCoupon stops redemptions. Existing discounts stay.
+func (c *CouponController) DeleteCoupon(ctx *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(ctx.Param("id"))
+	if err != nil {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Invalid coupon ID", err)
+		return
+	}
+
+	if err := c.couponManager.Delete(ctx.Request.Context(), id); err != nil {
+		if err == mongo.ErrNoDocuments {
+			utils.NotFoundResponse(ctx, "Coupon not found")
+			return
+		}
+		utils.InternalErrorResponse(ctx, err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Coupon deleted successfully", nil)
+}
@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"net/http"
+	"subservice/core/middleware"
+	"subservice/core/models"
+	"subservice/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type CreditController struct {
+	creditManager *models.CreditManager
+	validator     *validator.Validate
+}
+
+func NewCreditController(creditManager *models.CreditManager) *CreditController {
+	return &CreditController{
+		creditManager: creditManager,
+		validator:     validator.New(),
+	}
+}
+
+func (c *CreditController) GetCredits(ctx *gin.Context) {
+	balance, err := c.creditManager.Get(ctx.Request.Context(), ctx.GetString("subject_user_id"))
+	if err == mongo.ErrNoDocuments {
+		utils.NotFoundResponse(ctx, "User not found")
+		return
+	}
+	if err != nil {
+		utils.InternalErrorResponse(ctx, err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Credit balance retrieved successfully", balance)
+}
+
+// IssueCredit adds credit by hand, such as for goodwill.
+func (c *CreditController) IssueCredit(ctx *gin.Context) {
+	var req models.IssueCreditRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
+	if err := c.validator.Struct(&req); err != nil {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
+
+	transaction, err := c.creditManager.Issue(ctx.Request.Context(), ctx.GetString("subject_user_id"), &req, middleware.CurrentActor(ctx))
+	if err == mongo.ErrNoDocuments {
+		utils.NotFoundResponse(ctx, "User not found")
+		return
+	}
+	if err != nil {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Failed to issue credit", err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusCreated, "Credit issued successfully", transaction)
+}
@@ -0,0 +1,70 @@
+package controllers
+
+import (
+	"net/http"
+	"subservice/core/middleware"
+	"subservice/core/models"
+	"subservice/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+type EntitlementController struct {
+	subscriptionManager *models.SubscriptionManager
+	validator           *validator.Validate
+}
+
+func NewEntitlementController(subscriptionManager *models.SubscriptionManager) *EntitlementController {
+	return &EntitlementController{
+		subscriptionManager: subscriptionManager,
+		validator:           validator.New(),
+	}
+}
+
+func (c *EntitlementController) GetEntitlements(ctx *gin.Context) {
+	userID := ctx.GetString("subject_user_id")
+	if userID == "" {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "User ID is required", nil)
+		return
+	}
+
+	grants, err := c.subscriptionManager.Entitlements(ctx.Request.Context(), userID)
+	if err != nil {
+		utils.InternalErrorResponse(ctx, err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Entitlements retrieved successfully", grants)
+}
+
+// CheckEntitlements needs subscriptions:read_any for other users than the caller.
+func (c *EntitlementController) CheckEntitlements(ctx *gin.Context) {
+	var req models.CheckEntitlementsRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
+
+	if err := c.validator.Struct(&req); err != nil {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
+
+	for i := range req.Checks {
+		userID, _, err := middleware.ResolveSubject(ctx, req.Checks[i].UserID, models.PermSubscriptionsReadAny)
+		if err != nil {
+			utils.ForbiddenResponse(ctx, err.Error())
+			return
+		}
+		req.Checks[i].UserID = userID
+	}
+
+	decisions, err := c.subscriptionManager.CheckEntitlements(ctx.Request.Context(), req.Checks)
+	if err != nil {
+		utils.InternalErrorResponse(ctx, err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Entitlements checked successfully", decisions)
+}
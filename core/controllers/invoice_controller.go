@@ -0,0 +1,186 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"subservice/core/middleware"
+	"subservice/core/models"
+	"subservice/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// allUsers lists every user's invoices in place of a user ID.
+const allUsers = "all"
+
+type InvoiceController struct {
+	invoiceManager *models.InvoiceManager
+	paymentManager *models.PaymentManager
+	validator      *validator.Validate
+}
+
+func NewInvoiceController(invoiceManager *models.InvoiceManager, paymentManager *models.PaymentManager) *InvoiceController {
+	return &InvoiceController{
+		invoiceManager: invoiceManager,
+		paymentManager: paymentManager,
+		validator:      validator.New(),
+	}
+}
+
+// ListInvoices lists every user's invoices for user_id=all.
+func (c *InvoiceController) ListInvoices(ctx *gin.Context) {
+	filter := models.InvoiceFilter{Status: models.InvoiceStatus(ctx.Query("status"))}
+	if err := filter.Check(); err != nil {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
+
+	if subscriptionID := ctx.Query("subscription_id"); subscriptionID != "" {
+		id, err := primitive.ObjectIDFromHex(subscriptionID)
+		if err != nil {
+			utils.ErrorResponse(ctx, http.StatusBadRequest, "Invalid subscription ID", err)
+			return
+		}
+		filter.SubscriptionID = &id
+	}
+
+	requested := ctx.Query("user_id")
+	if requested == allUsers {
+		if !middleware.HasPermission(ctx, models.PermSubscriptionsReadAny) {
+			utils.ForbiddenResponse(ctx, middleware.ErrForeignSubject.Error())
+			return
+		}
+	} else {
+		userID, _, err := middleware.ResolveSubject(ctx, requested, models.PermSubscriptionsReadAny)
+		if err != nil {
+			utils.ForbiddenResponse(ctx, err.Error())
+			return
+		}
+		filter.UserID = userID
+	}
+
+	invoices, err := c.invoiceManager.List(ctx.Request.Context(), filter)
+	if err != nil {
+		utils.InternalErrorResponse(ctx, err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Invoices retrieved successfully", invoices)
+}
+
+func (c *InvoiceController) GetInvoice(ctx *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(ctx.Param("id"))
+	if err != nil {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Invalid invoice ID", err)
+		return
+	}
+
+	invoice, err := c.invoiceManager.GetByID(ctx.Request.Context(), id)
+	if err == mongo.ErrNoDocuments {
+		utils.NotFoundResponse(ctx, "Invoice not found")
+		return
+	}
+	if err != nil {
+		utils.InternalErrorResponse(ctx, err)
+		return
+	}
+
+	if _, _, err := middleware.ResolveSubject(ctx, invoice.UserID, models.PermSubscriptionsReadAny); err != nil {
+		utils.ForbiddenResponse(ctx, err.Error())
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Invoice retrieved successfully", invoice)
+}
+
+// FinalizeInvoice numbers a draft invoice and opens it for payment.
+func (c *InvoiceController) FinalizeInvoice(ctx *gin.Context) {
+	c.setStatus(ctx, c.invoiceManager.Finalize, "Invoice finalized successfully")
+}
+
+// PayInvoice records a payment taken outside the service.
+func (c *InvoiceController) PayInvoice(ctx *gin.Context) {
+	c.setStatus(ctx, c.invoiceManager.MarkPaid, "Invoice marked as paid")
+}
+
+// VoidInvoice cancels a draft or open invoice.
+func (c *InvoiceController) VoidInvoice(ctx *gin.Context) {
+	c.setStatus(ctx, c.invoiceManager.Void, "Invoice voided successfully")
+}
+
+func (c *InvoiceController) RefundInvoice(ctx *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(ctx.Param("id"))
+	if err != nil {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Invalid invoice ID", err)
+		return
+	}
+
+	var req models.RefundInvoiceRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
+	if err := c.validator.Struct(&req); err != nil {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
+
+	invoice, err := c.invoiceManager.GetByID(ctx.Request.Context(), id)
+	if err == mongo.ErrNoDocuments {
+		utils.NotFoundResponse(ctx, "Invoice not found")
+		return
+	}
+	if err != nil {
+		utils.InternalErrorResponse(ctx, err)
+		return
+	}
+	_, actor, err := middleware.ResolveSubject(ctx, invoice.UserID, models.PermInvoicesWrite)
+	if err != nil {
+		utils.ForbiddenResponse(ctx, err.Error())
+		return
+	}
+
+	invoice, err = c.paymentManager.RefundInvoice(ctx.Request.Context(), id, &req, actor)
+	if errors.Is(err, models.ErrInvalidRefund) {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
+	if errors.Is(err, models.ErrInvoiceStatus) || err == models.ErrInvoiceChanged || err == models.ErrNotPaidByPayment {
+		utils.ErrorResponse(ctx, http.StatusConflict, "Failed to refund invoice", err)
+		return
+	}
+	if err != nil {
+		utils.InternalErrorResponse(ctx, err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Invoice refunded successfully", invoice)
+}
+
+func (c *InvoiceController) setStatus(ctx *gin.Context, apply func(context.Context, primitive.ObjectID) (*models.Invoice, error), message string) {
+	id, err := primitive.ObjectIDFromHex(ctx.Param("id"))
+	if err != nil {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Invalid invoice ID", err)
+		return
+	}
+
+	invoice, err := apply(ctx.Request.Context(), id)
+	if err == mongo.ErrNoDocuments {
+		utils.NotFoundResponse(ctx, "Invoice not found")
+		return
+	}
+	if errors.Is(err, models.ErrInvoiceStatus) || err == models.ErrInvoiceChanged {
+		utils.ErrorResponse(ctx, http.StatusConflict, "Failed to update invoice", err)
+		return
+	}
+	if err != nil {
+		utils.InternalErrorResponse(ctx, err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, message, invoice)
+}
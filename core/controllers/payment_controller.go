@@ -0,0 +1,106 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"subservice/core/middleware"
+	"subservice/core/models"
+	"subservice/core/payments"
+	"subservice/utils"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+type fakeRefundRequest struct {
+	Amount int64 `json:"amount" validate:"min=1"`
+}
+
+// FakePaymentController stands in for pages a real gateway would host.
+type FakePaymentController struct {
+	provider       *payments.FakeProvider
+	paymentManager *models.PaymentManager
+	validator      *validator.Validate
+}
+
+func NewFakePaymentController(provider *payments.FakeProvider, paymentManager *models.PaymentManager) *FakePaymentController {
+	return &FakePaymentController{
+		provider:       provider,
+		paymentManager: paymentManager,
+		validator:      validator.New(),
+	}
+}
+
+// ConfirmCharge acts like a customer passing a 3-D Secure check.
+func (c *FakePaymentController) ConfirmCharge(ctx *gin.Context) {
+	chargeID := ctx.Param("chargeId")
+	owner, err := c.paymentManager.OwnerOfCharge(ctx.Request.Context(), chargeID)
+	if err != nil {
+		utils.NotFoundResponse(ctx, "Charge not found")
+		return
+	}
+	if _, _, err := middleware.ResolveSubject(ctx, owner, models.PermSubscriptionsWriteAny); err != nil {
+		utils.ForbiddenResponse(ctx, err.Error())
+		return
+	}
+
+	err = c.provider.Confirm(ctx.Request.Context(), chargeID)
+	if err == payments.ErrChargeNotFound {
+		utils.NotFoundResponse(ctx, "Charge not found")
+		return
+	}
+	if err != nil {
+		utils.ErrorResponse(ctx, http.StatusConflict, "Failed to confirm charge", err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Charge confirmed successfully", gin.H{"charge_id": chargeID})
+}
+
+// RefundCharge refunds like an operator using the gateway's dashboard.
+func (c *FakePaymentController) RefundCharge(ctx *gin.Context) {
+	var req fakeRefundRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
+	if err := c.validator.Struct(&req); err != nil {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
+
+	chargeID := ctx.Param("chargeId")
+	refund, err := c.provider.Refund(ctx.Request.Context(), payments.RefundRequest{
+		ChargeID:       chargeID,
+		Amount:         req.Amount,
+		Reason:         "requested_by_customer",
+		IdempotencyKey: fmt.Sprintf("dashboard:%s:%d", chargeID, time.Now().UnixNano()),
+	})
+	if err == payments.ErrChargeNotFound {
+		utils.NotFoundResponse(ctx, "Charge not found")
+		return
+	}
+	if err != nil {
+		utils.ErrorResponse(ctx, http.StatusConflict, "Failed to refund charge", err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Charge refunded successfully", refund)
+}
+
+// DisputeCharge disputes a charge like a customer's bank would.
+func (c *FakePaymentController) DisputeCharge(ctx *gin.Context) {
+	chargeID := ctx.Param("chargeId")
+	err := c.provider.Dispute(ctx.Request.Context(), chargeID)
+	if err == payments.ErrChargeNotFound {
+		utils.NotFoundResponse(ctx, "Charge not found")
+		return
+	}
+	if err != nil {
+		utils.ErrorResponse(ctx, http.StatusConflict, "Failed to dispute charge", err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Charge disputed successfully", gin.H{"charge_id": chargeID})
+}
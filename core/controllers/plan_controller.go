@@ -1,24 +1,30 @@
 package controllers
 
 import (
+	"context"
 	"net/http"
+	"strconv"
+	"subservice/core/middleware"
 	"subservice/core/models"
 	"subservice/utils"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type PlanController struct {
-	planManager *models.PlanManager
-	validator   *validator.Validate
+	planManager         *models.PlanManager
+	subscriptionManager *models.SubscriptionManager
+	validator           *validator.Validate
 }
 
-func NewPlanController(planManager *models.PlanManager) *PlanController {
+func NewPlanController(planManager *models.PlanManager, subscriptionManager *models.SubscriptionManager) *PlanController {
 	return &PlanController{
-		planManager: planManager,
-		validator:   validator.New(),
+		planManager:         planManager,
+		subscriptionManager: subscriptionManager,
+		validator:           validator.New(),
 	}
 }
 
@@ -33,6 +39,10 @@ func (c *PlanController) CreatePlan(ctx *gin.Context) {
 		utils.ValidationErrorResponse(ctx, err)
 		return
 	}
+	if err := plan.CheckPricing(); err != nil {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
 
 	if err := c.planManager.Create(ctx.Request.Context(), &plan); err != nil {
 		utils.InternalErrorResponse(ctx, err)
@@ -42,8 +52,14 @@ func (c *PlanController) CreatePlan(ctx *gin.Context) {
 	utils.SuccessResponse(ctx, http.StatusCreated, "Plan created successfully", plan)
 }
 
+// GetAllPlans lists archived plans too for callers who can manage plans.
 func (c *PlanController) GetAllPlans(ctx *gin.Context) {
-	plans, err := c.planManager.GetAll(ctx.Request.Context())
+	includeArchived := ctx.Query("include_archived") == "true"
+	if includeArchived && !middleware.HasPermission(ctx, models.PermPlansWrite) {
+		utils.ForbiddenResponse(ctx, "Missing permission: "+models.PermPlansWrite)
+		return
+	}
+	plans, err := c.planManager.GetAll(ctx.Request.Context(), includeArchived)
 	if err != nil {
 		utils.InternalErrorResponse(ctx, err)
 		return
@@ -52,6 +68,42 @@ func (c *PlanController) GetAllPlans(ctx *gin.Context) {
 	utils.SuccessResponse(ctx, http.StatusOK, "Plans retrieved successfully", plans)
 }
 
+// QuotePlan defaults to 1 seat in the plan's base currency.
+func (c *PlanController) QuotePlan(ctx *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(ctx.Param("id"))
+	if err != nil {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Invalid plan ID", err)
+		return
+	}
+
+	quantity, err := strconv.Atoi(ctx.DefaultQuery("quantity", "1"))
+	if err != nil {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Invalid quantity", err)
+		return
+	}
+
+	plan, err := c.planManager.GetByID(ctx.Request.Context(), id)
+	if err != nil {
+		utils.NotFoundResponse(ctx, "Plan not found")
+		return
+	}
+
+	currency := models.Currency(ctx.Query("currency"))
+	if currency == "" {
+		currency = plan.BaseCurrency()
+	}
+
+	quote, err := models.CalculateCharge(plan, currency, quantity)
+	if err != nil {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Failed to quote plan", err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Quote calculated successfully", quote)
+}
+
+// UpdatePlan publishes the next version. Subscribers keep theirs unless
+// migrate_subscribers is set.
 func (c *PlanController) UpdatePlan(ctx *gin.Context) {
 	id, err := primitive.ObjectIDFromHex(ctx.Param("id"))
 	if err != nil {
@@ -59,25 +111,86 @@ func (c *PlanController) UpdatePlan(ctx *gin.Context) {
 		return
 	}
 
-	var plan models.Plan
-	if err := ctx.ShouldBindJSON(&plan); err != nil {
+	var req models.PublishPlanRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
 		utils.ValidationErrorResponse(ctx, err)
 		return
 	}
 
-	if err := c.validator.Struct(&plan); err != nil {
+	if err := c.validator.Struct(&req); err != nil {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
+	if err := req.CheckPricing(); err != nil {
 		utils.ValidationErrorResponse(ctx, err)
 		return
 	}
 
-	if err := c.planManager.Update(ctx.Request.Context(), id, &plan); err != nil {
+	plan, err := c.planManager.Publish(ctx.Request.Context(), id, &req)
+	if err == mongo.ErrNoDocuments {
+		utils.NotFoundResponse(ctx, "Plan not found")
+		return
+	}
+	if err == models.ErrPlanChanged {
+		utils.ErrorResponse(ctx, http.StatusConflict, "Failed to publish plan", err)
+		return
+	}
+	if err != nil {
 		utils.InternalErrorResponse(ctx, err)
 		return
 	}
 
-	utils.SuccessResponse(ctx, http.StatusOK, "Plan updated successfully", plan)
+	utils.SuccessResponse(ctx, http.StatusOK, "Plan version published successfully", plan)
 }
 
+// ListPlanVersions returns every published version of a plan, oldest first.
+func (c *PlanController) ListPlanVersions(ctx *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(ctx.Param("id"))
+	if err != nil {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Invalid plan ID", err)
+		return
+	}
+
+	versions, err := c.planManager.ListVersions(ctx.Request.Context(), id)
+	if err != nil {
+		utils.InternalErrorResponse(ctx, err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Plan versions retrieved successfully", versions)
+}
+
+// ArchivePlan withdraws a plan from sale without affecting its subscribers.
+func (c *PlanController) ArchivePlan(ctx *gin.Context) {
+	c.setArchived(ctx, c.planManager.Archive, "Plan archived successfully")
+}
+
+// UnarchivePlan puts an archived plan back on sale.
+func (c *PlanController) UnarchivePlan(ctx *gin.Context) {
+	c.setArchived(ctx, c.planManager.Unarchive, "Plan unarchived successfully")
+}
+
+func (c *PlanController) setArchived(ctx *gin.Context, apply func(context.Context, primitive.ObjectID) (*models.Plan, error), message string) {
+	id, err := primitive.ObjectIDFromHex(ctx.Param("id"))
+	if err != nil {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Invalid plan ID", err)
+		return
+	}
+
+	plan, err := apply(ctx.Request.Context(), id)
+	if err == mongo.ErrNoDocuments {
+		utils.NotFoundResponse(ctx, "Plan not found")
+		return
+	}
+	if err != nil {
+		utils.InternalErrorResponse(ctx, err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, message, plan)
+}
+
+// DeletePlan refuses while running subscriptions depend on the plan, listing them.
 func (c *PlanController) DeletePlan(ctx *gin.Context) {
 	id, err := primitive.ObjectIDFromHex(ctx.Param("id"))
 	if err != nil {
@@ -85,10 +198,23 @@ func (c *PlanController) DeletePlan(ctx *gin.Context) {
 		return
 	}
 
-	if err := c.planManager.Delete(ctx.Request.Context(), id); err != nil {
+	subscribers, err := c.subscriptionManager.DeletePlan(ctx.Request.Context(), id)
+	if err == mongo.ErrNoDocuments {
+		utils.NotFoundResponse(ctx, "Plan not found")
+		return
+	}
+	if err == models.ErrPlanChanged {
+		utils.ErrorResponse(ctx, http.StatusConflict, "Failed to delete plan", err)
+		return
+	}
+	if err != nil {
 		utils.InternalErrorResponse(ctx, err)
 		return
 	}
+	if len(subscribers) > 0 {
+		utils.ConflictResponse(ctx, "Plan has running subscriptions, archive it instead", subscribers)
+		return
+	}
 
 	utils.SuccessResponse(ctx, http.StatusOK, "Plan deleted successfully", nil)
 }
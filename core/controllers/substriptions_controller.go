@@ -1,7 +1,10 @@
 package controllers
 
 import (
+	"errors"
+	"io"
 	"net/http"
+	"subservice/core/middleware"
 	"subservice/core/models"
 	"subservice/utils"
 
@@ -33,23 +36,63 @@ func (c *SubscriptionController) UpsertSubscription(ctx *gin.Context) {
 		return
 	}
 
-	subscription, err := c.subscriptionManager.UpsertSubscription(ctx.Request.Context(), &req)
+	userID, actor, err := middleware.ResolveSubject(ctx, req.UserID, models.PermSubscriptionsWriteAny)
 	if err != nil {
-		utils.ErrorResponse(ctx, http.StatusBadRequest, "Failed to process subscription", err)
+		utils.ForbiddenResponse(ctx, err.Error())
+		return
+	}
+	req.UserID = userID
+
+	subscription, err := c.subscriptionManager.UpsertSubscription(ctx.Request.Context(), &req, actor)
+	var paymentErr *models.PaymentError
+	if errors.As(err, &paymentErr) {
+		utils.PaymentRequiredResponse(ctx, err.Error(), paymentErr.Payment)
+		return
+	}
+	if err != nil {
+		utils.ErrorResponse(ctx, subscriptionErrorStatus(err), "Failed to process subscription", err)
 		return
 	}
 
 	utils.SuccessResponse(ctx, http.StatusOK, "Subscription processed successfully", subscription)
 }
 
+func (c *SubscriptionController) PreviewSubscription(ctx *gin.Context) {
+	var req models.CreateSubscriptionRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
+
+	if err := c.validator.Struct(&req); err != nil {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
+
+	userID, _, err := middleware.ResolveSubject(ctx, req.UserID, models.PermSubscriptionsReadAny)
+	if err != nil {
+		utils.ForbiddenResponse(ctx, err.Error())
+		return
+	}
+	req.UserID = userID
+
+	proration, err := c.subscriptionManager.PreviewChange(ctx.Request.Context(), &req)
+	if err != nil {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Failed to preview subscription", err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Subscription preview calculated successfully", proration)
+}
+
 func (c *SubscriptionController) GetSubscription(ctx *gin.Context) {
-	userID := ctx.Param("userId")
-	if userID == "" {
-		utils.ErrorResponse(ctx, http.StatusBadRequest, "User ID is required", nil)
+	subscriptionID := ctx.GetString("subscription_id")
+	if subscriptionID == "" {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Subscription ID is required", nil)
 		return
 	}
 
-	subscription, err := c.subscriptionManager.GetSubscription(ctx.Request.Context(), userID)
+	subscription, err := c.subscriptionManager.GetSubscription(ctx.Request.Context(), subscriptionID)
 	if err != nil {
 		utils.NotFoundResponse(ctx, "Subscription not found")
 		return
@@ -58,17 +101,204 @@ func (c *SubscriptionController) GetSubscription(ctx *gin.Context) {
 	utils.SuccessResponse(ctx, http.StatusOK, "Subscription retrieved successfully", subscription)
 }
 
+func (c *SubscriptionController) ListSubscriptions(ctx *gin.Context) {
+	userID := ctx.GetString("subject_user_id")
+	if userID == "" {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "User ID is required", nil)
+		return
+	}
+
+	subscriptions, err := c.subscriptionManager.ListSubscriptions(ctx.Request.Context(), userID)
+	if err != nil {
+		utils.InternalErrorResponse(ctx, err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Subscriptions retrieved successfully", subscriptions)
+}
+
 func (c *SubscriptionController) CancelSubscription(ctx *gin.Context) {
-	userID := ctx.Param("userId")
+	subscriptionID := ctx.GetString("subscription_id")
+	if subscriptionID == "" {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Subscription ID is required", nil)
+		return
+	}
+
+	mode := models.CancelMode(ctx.DefaultQuery("mode", string(models.CancelAtPeriodEnd)))
+	subscription, err := c.subscriptionManager.CancelSubscription(ctx.Request.Context(), subscriptionID, mode, middleware.CurrentActor(ctx))
+	if err != nil {
+		utils.ErrorResponse(ctx, subscriptionErrorStatus(err), "Failed to cancel subscription", err)
+		return
+	}
+
+	message := "Subscription cancelled successfully"
+	if mode == models.CancelAtPeriodEnd {
+		message = "Subscription will be cancelled at the end of the current period"
+	}
+	utils.SuccessResponse(ctx, http.StatusOK, message, subscription)
+}
+
+func (c *SubscriptionController) UndoCancellation(ctx *gin.Context) {
+	subscriptionID := ctx.GetString("subscription_id")
+	if subscriptionID == "" {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Subscription ID is required", nil)
+		return
+	}
+
+	subscription, err := c.subscriptionManager.UndoCancellation(ctx.Request.Context(), subscriptionID, middleware.CurrentActor(ctx))
+	if err != nil {
+		utils.ErrorResponse(ctx, subscriptionErrorStatus(err), "Failed to undo cancellation", err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Cancellation undone successfully", subscription)
+}
+
+func (c *SubscriptionController) PauseSubscription(ctx *gin.Context) {
+	subscriptionID := ctx.GetString("subscription_id")
+	if subscriptionID == "" {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Subscription ID is required", nil)
+		return
+	}
+
+	// The body is optional; without it the plan's maximum pause is used
+	var req models.PauseRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
+
+	if err := c.validator.Struct(&req); err != nil {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
+
+	subscription, err := c.subscriptionManager.PauseSubscription(ctx.Request.Context(), subscriptionID, &req, middleware.CurrentActor(ctx))
+	if err != nil {
+		utils.ErrorResponse(ctx, subscriptionErrorStatus(err), "Failed to pause subscription", err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Subscription paused successfully", subscription)
+}
+
+func (c *SubscriptionController) ResumeSubscription(ctx *gin.Context) {
+	subscriptionID := ctx.GetString("subscription_id")
+	if subscriptionID == "" {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Subscription ID is required", nil)
+		return
+	}
+
+	subscription, err := c.subscriptionManager.ResumeSubscription(ctx.Request.Context(), subscriptionID, middleware.CurrentActor(ctx))
+	if err != nil {
+		utils.ErrorResponse(ctx, subscriptionErrorStatus(err), "Failed to resume subscription", err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Subscription resumed successfully", subscription)
+}
+
+func (c *SubscriptionController) GetPendingChange(ctx *gin.Context) {
+	subscriptionID := ctx.GetString("subscription_id")
+	if subscriptionID == "" {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Subscription ID is required", nil)
+		return
+	}
+
+	change, err := c.subscriptionManager.GetPendingChange(ctx.Request.Context(), subscriptionID)
+	if err != nil {
+		utils.NotFoundResponse(ctx, "No pending plan change found")
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Pending plan change retrieved successfully", change)
+}
+
+func (c *SubscriptionController) CancelPendingChange(ctx *gin.Context) {
+	subscriptionID := ctx.GetString("subscription_id")
+	if subscriptionID == "" {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Subscription ID is required", nil)
+		return
+	}
+
+	subscription, err := c.subscriptionManager.CancelPendingChange(ctx.Request.Context(), subscriptionID, middleware.CurrentActor(ctx))
+	if errors.Is(err, models.ErrNoPendingChange) {
+		utils.NotFoundResponse(ctx, "No pending plan change found")
+		return
+	}
+	if err != nil {
+		utils.ErrorResponse(ctx, subscriptionErrorStatus(err), "Failed to cancel pending plan change", err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Pending plan change cancelled successfully", subscription)
+}
+
+func (c *SubscriptionController) GetHistory(ctx *gin.Context) {
+	subscriptionID := ctx.GetString("subscription_id")
+	if subscriptionID == "" {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Subscription ID is required", nil)
+		return
+	}
+
+	events, err := c.subscriptionManager.GetHistory(ctx.Request.Context(), subscriptionID)
+	if err != nil {
+		utils.InternalErrorResponse(ctx, err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Subscription history retrieved successfully", events)
+}
+
+func (c *SubscriptionController) GetUserHistory(ctx *gin.Context) {
+	userID := ctx.GetString("subject_user_id")
 	if userID == "" {
 		utils.ErrorResponse(ctx, http.StatusBadRequest, "User ID is required", nil)
 		return
 	}
 
-	if err := c.subscriptionManager.CancelSubscription(ctx.Request.Context(), userID); err != nil {
-		utils.ErrorResponse(ctx, http.StatusBadRequest, "Failed to cancel subscription", err)
+	events, err := c.subscriptionManager.GetUserHistory(ctx.Request.Context(), userID)
+	if err != nil {
+		utils.InternalErrorResponse(ctx, err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Subscription history retrieved successfully", events)
+}
+
+func (c *SubscriptionController) SetAutoRenew(ctx *gin.Context) {
+	subscriptionID := ctx.GetString("subscription_id")
+	if subscriptionID == "" {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Subscription ID is required", nil)
+		return
+	}
+
+	var req models.AutoRenewRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
+
+	if err := c.validator.Struct(&req); err != nil {
+		utils.ValidationErrorResponse(ctx, err)
 		return
 	}
 
-	utils.SuccessResponse(ctx, http.StatusOK, "Subscription cancelled successfully", nil)
+	subscription, err := c.subscriptionManager.SetAutoRenew(ctx.Request.Context(), subscriptionID, *req.AutoRenew, middleware.CurrentActor(ctx))
+	if err != nil {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Failed to update auto-renew", err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Auto-renew updated successfully", subscription)
+}
+
+func subscriptionErrorStatus(err error) int {
+	if errors.Is(err, models.ErrIllegalTransition) || errors.Is(err, models.ErrConcurrentUpdate) {
+		return http.StatusConflict
+	}
+	if errors.Is(err, models.ErrNoPaymentMethod) {
+		return http.StatusPaymentRequired
+	}
+	return http.StatusBadRequest
 }
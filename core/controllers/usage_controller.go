@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"net/http"
+	"subservice/core/models"
+	"subservice/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+type UsageController struct {
+	subscriptionManager *models.SubscriptionManager
+	validator           *validator.Validate
+}
+
+func NewUsageController(subscriptionManager *models.SubscriptionManager) *UsageController {
+	return &UsageController{
+		subscriptionManager: subscriptionManager,
+		validator:           validator.New(),
+	}
+}
+
+// RecordUsage returns a receipt per event. Rejected events do not stop the batch.
+func (c *UsageController) RecordUsage(ctx *gin.Context) {
+	var req models.RecordUsageRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
+
+	if err := c.validator.Struct(&req); err != nil {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
+
+	receipts, err := c.subscriptionManager.RecordUsage(ctx.Request.Context(), req.Events)
+	if err != nil {
+		utils.InternalErrorResponse(ctx, err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Usage processed", receipts)
+}
+
+// GetUsage summarises the subscription's usage in its current billing period.
+func (c *UsageController) GetUsage(ctx *gin.Context) {
+	subscriptionID := ctx.GetString("subscription_id")
+	if subscriptionID == "" {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Subscription ID is required", nil)
+		return
+	}
+
+	summary, err := c.subscriptionManager.GetUsage(ctx.Request.Context(), subscriptionID)
+	if err != nil {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Failed to summarise usage", err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Usage retrieved successfully", summary)
+}
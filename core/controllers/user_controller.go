@@ -62,3 +62,30 @@ func (c *UserController) Login(ctx *gin.Context) {
 
 	utils.SuccessResponse(ctx, http.StatusOK, "Login successful", loginResponse)
 }
+
+func (c *UserController) UpdateRole(ctx *gin.Context) {
+	userID := ctx.Param("userId")
+	if userID == "" {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "User ID is required", nil)
+		return
+	}
+
+	var req models.UpdateRoleRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
+
+	if err := c.validator.Struct(&req); err != nil {
+		utils.ValidationErrorResponse(ctx, err)
+		return
+	}
+
+	user, err := c.userManager.UpdateRole(ctx.Request.Context(), userID, &req)
+	if err != nil {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Failed to update role", err)
+		return
+	}
+
+	utils.SuccessResponse(ctx, http.StatusOK, "Role updated successfully", user)
+}
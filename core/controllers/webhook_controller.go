@@ -0,0 +1,60 @@
+package controllers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"subservice/core/models"
+	"subservice/core/payments"
+	"subservice/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxWebhookSize limits the body of a webhook delivery.
+const maxWebhookSize = 64 << 10
+
+type WebhookController struct {
+	webhookManager *models.WebhookManager
+}
+
+func NewWebhookController(webhookManager *models.WebhookManager) *WebhookController {
+	return &WebhookController{
+		webhookManager: webhookManager,
+	}
+}
+
+// HandlePaymentWebhook errors on failures so the provider delivers the event again.
+func (c *WebhookController) HandlePaymentWebhook(ctx *gin.Context) {
+	payload, err := io.ReadAll(http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxWebhookSize))
+	if err != nil {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Invalid webhook payload", err)
+		return
+	}
+
+	event, err := c.webhookManager.Receive(ctx.Request.Context(), payload, ctx.GetHeader(payments.SignatureHeader))
+	if errors.Is(err, models.ErrInvalidWebhook) {
+		utils.ErrorResponse(ctx, http.StatusBadRequest, "Invalid webhook", err)
+		return
+	}
+	if err != nil {
+		utils.InternalErrorResponse(ctx, err)
+		return
+	}
+
+	message := "Webhook processed successfully"
+	if event.Duplicate {
+		message = "Webhook already processed"
+	}
+	utils.SuccessResponse(ctx, http.StatusOK, message, event)
+}
+
+// ListFailedWebhooks lists the events that ran out of attempts.
+func (c *WebhookController) ListFailedWebhooks(ctx *gin.Context) {
+	events, err := c.webhookManager.ListFailed(ctx.Request.Context())
+	if err != nil {
+		utils.InternalErrorResponse(ctx, err)
+		return
+	}
+	utils.SuccessResponse(ctx, http.StatusOK, "Failed webhooks retrieved successfully", events)
+}
@@ -0,0 +1,272 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"subservice/core/models"
+	"subservice/core/payments"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const testWebhookSecret = "whsec_test"
+
+// webhookTest counts handled events, failing them while failing is set.
+type webhookTest struct {
+	t        *testing.T
+	provider *payments.FakeProvider
+	manager  *models.WebhookManager
+	router   *gin.Engine
+
+	mu      sync.Mutex
+	handled map[string]int
+	failing bool
+}
+
+func newWebhookTest(t *testing.T) *webhookTest {
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI is not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := client.Database("subservice_test_" + primitive.NewObjectID().Hex())
+	t.Cleanup(func() {
+		db.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+
+	wt := &webhookTest{
+		t:        t,
+		provider: payments.NewFakeProvider(testWebhookSecret, 0),
+		handled:  make(map[string]int),
+	}
+	wt.manager = models.NewWebhookManager(db, wt.provider, wt.handle)
+
+	gin.SetMode(gin.TestMode)
+	wt.router = gin.New()
+	wt.router.POST("/webhooks/payments", NewWebhookController(wt.manager).HandlePaymentWebhook)
+	return wt
+}
+
+func (wt *webhookTest) handle(ctx context.Context, event *payments.Event) error {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	if wt.failing {
+		return errors.New("handler failed")
+	}
+	wt.handled[event.ID]++
+	return nil
+}
+
+func (wt *webhookTest) setFailing(failing bool) {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	wt.failing = failing
+}
+
+func (wt *webhookTest) timesHandled(eventID string) int {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	return wt.handled[eventID]
+}
+
+type webhookResponse struct {
+	Success bool                `json:"success"`
+	Message string              `json:"message"`
+	Data    models.WebhookEvent `json:"data"`
+}
+
+func (wt *webhookTest) post(payload []byte, signature string) (int, webhookResponse) {
+	req := httptest.NewRequest(http.MethodPost, "/webhooks/payments", bytes.NewReader(payload))
+	req.Header.Set(payments.SignatureHeader, signature)
+	rec := httptest.NewRecorder()
+	wt.router.ServeHTTP(rec, req)
+
+	var body webhookResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		wt.t.Fatalf("decoding response %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, body
+}
+
+func (wt *webhookTest) sign(event *payments.Event, at time.Time) ([]byte, string) {
+	payload, signature, err := wt.provider.SignEvent(event, at)
+	if err != nil {
+		wt.t.Fatal(err)
+	}
+	return payload, signature
+}
+
+func testEvent(id string) *payments.Event {
+	return &payments.Event{
+		ID:        id,
+		Type:      payments.EventChargeSucceeded,
+		ChargeID:  "ch_" + id,
+		Amount:    1000,
+		Currency:  "INR",
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+}
+
+func TestHandlePaymentWebhookAcceptsSignedEvents(t *testing.T) {
+	wt := newWebhookTest(t)
+
+	payload, signature := wt.sign(testEvent("evt_valid"), time.Now())
+	code, body := wt.post(payload, signature)
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", code, http.StatusOK, body.Message)
+	}
+	if body.Data.EventID != "evt_valid" || body.Data.ProcessedAt == nil || body.Data.Duplicate {
+		t.Errorf("event = %+v, want evt_valid processed", body.Data)
+	}
+	if n := wt.timesHandled("evt_valid"); n != 1 {
+		t.Errorf("handled %d times, want once", n)
+	}
+}
+
+func TestHandlePaymentWebhookRejectsBadSignatures(t *testing.T) {
+	wt := newWebhookTest(t)
+	event := testEvent("evt_rejected")
+	payload, signature := wt.sign(event, time.Now())
+	_, stale := wt.sign(event, time.Now().Add(-payments.SignatureTolerance-time.Minute))
+
+	tests := []struct {
+		name      string
+		payload   []byte
+		signature string
+	}{
+		{name: "missing", payload: payload},
+		{name: "other secret", payload: payload, signature: payments.Sign("whsec_other", payload, time.Now())},
+		{name: "payload changed", payload: bytes.Replace(payload, []byte("1000"), []byte("9000"), 1), signature: signature},
+		{name: "stale", payload: payload, signature: stale},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, body := wt.post(tt.payload, tt.signature); code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d: %s", code, http.StatusBadRequest, body.Message)
+			}
+		})
+	}
+	if n := wt.timesHandled("evt_rejected"); n != 0 {
+		t.Errorf("handled %d times, want never", n)
+	}
+}
+
+func TestHandlePaymentWebhookIgnoresReplays(t *testing.T) {
+	wt := newWebhookTest(t)
+	event := testEvent("evt_replayed")
+
+	payload, signature := wt.sign(event, time.Now())
+	if code, body := wt.post(payload, signature); code != http.StatusOK {
+		t.Fatalf("first delivery: status = %d: %s", code, body.Message)
+	}
+
+	// A replay is signed afresh, as a redelivery from the provider would be
+	payload, signature = wt.sign(event, time.Now().Add(time.Second))
+	code, body := wt.post(payload, signature)
+	if code != http.StatusOK {
+		t.Fatalf("replay: status = %d: %s", code, body.Message)
+	}
+	if !body.Data.Duplicate {
+		t.Errorf("replay = %+v, want a duplicate", body.Data)
+	}
+	if n := wt.timesHandled("evt_replayed"); n != 1 {
+		t.Errorf("handled %d times, want once", n)
+	}
+}
+
+func TestRetryDueRetriesFailedWebhooks(t *testing.T) {
+	wt := newWebhookTest(t)
+	event := testEvent("evt_retried")
+
+	wt.setFailing(true)
+	payload, signature := wt.sign(event, time.Now())
+	if code, body := wt.post(payload, signature); code != http.StatusInternalServerError {
+		t.Fatalf("failed delivery: status = %d, want %d: %s", code, http.StatusInternalServerError, body.Message)
+	}
+	if n := wt.timesHandled("evt_retried"); n != 0 {
+		t.Fatalf("handled %d times, want never", n)
+	}
+
+	wt.setFailing(false)
+	ctx := context.Background()
+	if retried, err := wt.manager.RetryDue(ctx, time.Now(), 10); err != nil || retried != 0 {
+		t.Fatalf("RetryDue before the lease ran out = %d, %v, want nothing retried", retried, err)
+	}
+	retried, err := wt.manager.RetryDue(ctx, time.Now().Add(time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retried != 1 {
+		t.Errorf("RetryDue retried %d events, want 1", retried)
+	}
+	if n := wt.timesHandled("evt_retried"); n != 1 {
+		t.Errorf("handled %d times, want once", n)
+	}
+
+	if retried, err := wt.manager.RetryDue(ctx, time.Now().Add(time.Hour), 10); err != nil || retried != 0 {
+		t.Errorf("RetryDue after handling = %d, %v, want nothing retried", retried, err)
+	}
+	payload, signature = wt.sign(event, time.Now().Add(time.Second))
+	if _, body := wt.post(payload, signature); !body.Data.Duplicate {
+		t.Errorf("delivery after the retry = %+v, want a duplicate", body.Data)
+	}
+}
+
+func TestRetryDueMarksExhaustedWebhooksFailed(t *testing.T) {
+	wt := newWebhookTest(t)
+	event := testEvent("evt_exhausted")
+
+	wt.setFailing(true)
+	payload, signature := wt.sign(event, time.Now())
+	if code, body := wt.post(payload, signature); code != http.StatusInternalServerError {
+		t.Fatalf("failed delivery: status = %d, want %d: %s", code, http.StatusInternalServerError, body.Message)
+	}
+
+	ctx := context.Background()
+	later := time.Now().Add(time.Hour)
+	for i := 0; i < 5; i++ {
+		if _, err := wt.manager.RetryDue(ctx, later, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	failed, err := wt.manager.ListFailed(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].EventID != "evt_exhausted" || failed[0].FailedAt == nil {
+		t.Fatalf("failed events = %+v, want evt_exhausted", failed)
+	}
+	if failed[0].Attempts != 5 {
+		t.Errorf("attempts = %d, want 5", failed[0].Attempts)
+	}
+
+	// A redelivery from the provider still gets handled
+	wt.setFailing(false)
+	payload, signature = wt.sign(event, time.Now().Add(time.Second))
+	if code, body := wt.post(payload, signature); code != http.StatusOK || body.Data.FailedAt != nil {
+		t.Fatalf("redelivery: status = %d, event = %+v", code, body.Data)
+	}
+	if n := wt.timesHandled("evt_exhausted"); n != 1 {
+		t.Errorf("handled %d times, want once", n)
+	}
+}
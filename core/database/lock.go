@@ -0,0 +1,62 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Lock is a lease in the "locks" collection, held by one instance at a time.
+type Lock struct {
+	collection *mongo.Collection
+	name       string
+	owner      string
+	ttl        time.Duration
+}
+
+func NewLock(db *mongo.Database, name string, ttl time.Duration) *Lock {
+	return &Lock{
+		collection: db.Collection("locks"),
+		name:       name,
+		owner:      newOwnerID(),
+		ttl:        ttl,
+	}
+}
+
+// Acquire takes or extends the lease. It returns false if another instance holds it.
+func (l *Lock) Acquire(ctx context.Context) (bool, error) {
+	now := time.Now()
+	filter := bson.M{
+		"_id": l.name,
+		"$or": bson.A{
+			bson.M{"owner": l.owner},
+			bson.M{"expires_at": bson.M{"$lt": now}},
+		},
+	}
+	update := bson.M{"$set": bson.M{"owner": l.owner, "expires_at": now.Add(l.ttl)}}
+
+	_, err := l.collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (l *Lock) Release(ctx context.Context) error {
+	_, err := l.collection.DeleteOne(ctx, bson.M{"_id": l.name, "owner": l.owner})
+	return err
+}
+
+func newOwnerID() string {
+	hostname, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(suffix))
+}
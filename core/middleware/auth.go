@@ -1,13 +1,18 @@
 package middleware
 
 import (
+	"context"
 	"strings"
+	"subservice/core/models"
 	"subservice/utils"
 
 	"github.com/gin-gonic/gin"
 )
 
-func AuthMiddleware(jwtSecret string) gin.HandlerFunc {
+// UserGrants looks up a user's current role and permissions.
+type UserGrants func(ctx context.Context, userID string) (models.Role, []string, error)
+
+func AuthMiddleware(jwtSecret string, grants UserGrants) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -16,24 +21,47 @@ func AuthMiddleware(jwtSecret string) gin.HandlerFunc {
 			return
 		}
 
-		tokenParts := strings.Split(authHeader, " ")
-		if len(tokenParts) != 2 || tokenParts[0] != "Bearer" {
-			utils.UnauthorizedResponse(c, "Invalid authorization header format")
+		if message := authenticate(c, authHeader, jwtSecret, grants); message != "" {
+			utils.UnauthorizedResponse(c, message)
 			c.Abort()
 			return
 		}
+		c.Next()
+	}
+}
 
-		token := tokenParts[1]
-		claims, err := utils.ValidateJWT(token, jwtSecret)
-		if err != nil {
-			utils.UnauthorizedResponse(c, "Invalid or expired token")
-			c.Abort()
-			return
+// OptionalAuth ignores invalid tokens, so stale ones do not break public pages.
+func OptionalAuth(jwtSecret string, grants UserGrants) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if authHeader := c.GetHeader("Authorization"); authHeader != "" {
+			authenticate(c, authHeader, jwtSecret, grants)
 		}
-
-		// Set both user_id and username in context
-		c.Set("user_id", claims.UserID)
-		c.Set("username", claims.Username)
 		c.Next()
 	}
 }
+
+// authenticate returns why the token was refused, if it was. The role and
+// permissions are the user's current ones, not those the token was issued with.
+func authenticate(c *gin.Context, authHeader, jwtSecret string, grants UserGrants) string {
+	tokenParts := strings.Split(authHeader, " ")
+	if len(tokenParts) != 2 || tokenParts[0] != "Bearer" {
+		return "Invalid authorization header format"
+	}
+
+	token := tokenParts[1]
+	claims, err := utils.ValidateJWT(token, jwtSecret)
+	if err != nil {
+		return "Invalid or expired token"
+	}
+	role, permissions, err := grants(c.Request.Context(), claims.UserID)
+	if err != nil {
+		return "User not found"
+	}
+
+	// Set identity and granted permissions in context
+	c.Set("user_id", claims.UserID)
+	c.Set("username", claims.Username)
+	c.Set("role", string(role))
+	c.Set("permissions", permissions)
+	return ""
+}
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"log"
+	"subservice/core/models"
+	"subservice/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Me can be used in place of a user ID to refer to the authenticated user.
+const Me = "me"
+
+var ErrForeignSubject = errors.New("cannot act on another user's subscription")
+
+// ResolveSubject returns the user the request acts on and the actor making it.
+// An empty or "me" requested ID resolves to the caller; any other user needs
+// anyPermission, and such requests are marked as delegated.
+func ResolveSubject(c *gin.Context, requested, anyPermission string) (string, *models.Actor, error) {
+	callerID := c.GetString("user_id")
+	actor := &models.Actor{
+		UserID:   callerID,
+		Username: c.GetString("username"),
+		Role:     models.Role(c.GetString("role")),
+	}
+
+	if requested == "" || requested == Me || requested == callerID {
+		return callerID, actor, nil
+	}
+
+	if !HasPermission(c, anyPermission) {
+		return "", nil, ErrForeignSubject
+	}
+
+	actor.Delegated = true
+	log.Printf("User %s (%s) acting on behalf of user %s", actor.Username, actor.Role, requested)
+	return requested, actor, nil
+}
+
+// RequireOwnership resolves the :userId path parameter and stores the result
+// as "subject_user_id" and "actor" in the context.
+func RequireOwnership(anyPermission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		subject, actor, err := ResolveSubject(c, c.Param("userId"), anyPermission)
+		if err != nil {
+			utils.ForbiddenResponse(c, err.Error())
+			c.Abort()
+			return
+		}
+
+		c.Set("subject_user_id", subject)
+		c.Set("actor", actor)
+		c.Next()
+	}
+}
+
+// SubscriptionOwner looks up the user holding a subscription.
+type SubscriptionOwner func(ctx context.Context, subscriptionID string) (string, error)
+
+// RequireSubscriptionOwnership is RequireOwnership for the subscription in :id.
+func RequireSubscriptionOwnership(ownerOf SubscriptionOwner, anyPermission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		owner, err := ownerOf(c.Request.Context(), c.Param("id"))
+		if err != nil {
+			utils.NotFoundResponse(c, "Subscription not found")
+			c.Abort()
+			return
+		}
+
+		subject, actor, err := ResolveSubject(c, owner, anyPermission)
+		if err != nil {
+			utils.ForbiddenResponse(c, err.Error())
+			c.Abort()
+			return
+		}
+
+		c.Set("subscription_id", c.Param("id"))
+		c.Set("subject_user_id", subject)
+		c.Set("actor", actor)
+		c.Next()
+	}
+}
+
+func CurrentActor(c *gin.Context) *models.Actor {
+	if actor, exists := c.Get("actor"); exists {
+		return actor.(*models.Actor)
+	}
+	return nil
+}
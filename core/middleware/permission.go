@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"subservice/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequirePermission aborts the request unless the user holds the given
+// permission. It must run after AuthMiddleware.
+func RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, exists := c.Get("user_id"); !exists {
+			utils.UnauthorizedResponse(c, "Authentication required")
+			c.Abort()
+			return
+		}
+
+		if !HasPermission(c, permission) {
+			utils.ForbiddenResponse(c, "Missing permission: "+permission)
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// HasPermission reports whether the authenticated user was granted permission.
+func HasPermission(c *gin.Context, permission string) bool {
+	for _, p := range c.GetStringSlice("permissions") {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
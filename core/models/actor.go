@@ -0,0 +1,10 @@
+package models
+
+// Actor identifies who made a change to a subscription. Delegated is set when
+// a privileged user acted on another user's subscription.
+type Actor struct {
+	UserID    string `json:"user_id" bson:"user_id"`
+	Username  string `json:"username" bson:"username"`
+	Role      Role   `json:"role" bson:"role"`
+	Delegated bool   `json:"delegated" bson:"delegated"`
+}
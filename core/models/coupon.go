@@ -0,0 +1,322 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type CouponDuration string
+
+const (
+	// CouponOnce discounts the first paid period only
+	CouponOnce      CouponDuration = "once"
+	CouponRepeating CouponDuration = "repeating"
+	CouponForever   CouponDuration = "forever"
+)
+
+var (
+	ErrCouponNotFound  = errors.New("promo code not found")
+	ErrCouponExhausted = errors.New("promo code has expired or reached its maximum redemptions")
+)
+
+// Coupon takes PercentOff or AmountOff off the first paid period, DurationPeriods
+// of them, or all. Coupons with PlanIDs only apply to those plans.
+type Coupon struct {
+	ID              primitive.ObjectID   `json:"id" bson:"_id,omitempty"`
+	Code            string               `json:"code" bson:"code" validate:"required,max=64"`
+	Name            string               `json:"name,omitempty" bson:"name,omitempty"`
+	PercentOff      float64              `json:"percent_off,omitempty" bson:"percent_off,omitempty" validate:"omitempty,gt=0,lte=100"`
+	AmountOff       []Money              `json:"amount_off,omitempty" bson:"amount_off,omitempty"`
+	Duration        CouponDuration       `json:"duration" bson:"duration" validate:"required,oneof=once repeating forever"`
+	DurationPeriods int                  `json:"duration_periods,omitempty" bson:"duration_periods,omitempty" validate:"min=0"`
+	MaxRedemptions  int                  `json:"max_redemptions,omitempty" bson:"max_redemptions,omitempty" validate:"min=0"`
+	ExpiresAt       *time.Time           `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	PlanIDs         []primitive.ObjectID `json:"plan_ids,omitempty" bson:"plan_ids,omitempty"`
+	// Redemptions counts the subscriptions the coupon was applied to
+	Redemptions int       `json:"redemptions" bson:"redemptions"`
+	CreatedAt   time.Time `json:"created_at" bson:"created_at"`
+}
+
+func (c *Coupon) Check() error {
+	if (c.PercentOff > 0) == (len(c.AmountOff) > 0) {
+		return errors.New("a coupon takes either percent_off or amount_off")
+	}
+	seen := make(map[Currency]bool)
+	for _, amount := range c.AmountOff {
+		if err := CheckCurrency(amount.Currency); err != nil {
+			return err
+		}
+		if seen[amount.Currency] {
+			return fmt.Errorf("%s is discounted more than once", amount.Currency)
+		}
+		seen[amount.Currency] = true
+		if amount.Amount <= 0 {
+			return errors.New("amount_off must be positive")
+		}
+	}
+	if (c.Duration == CouponRepeating) != (c.DurationPeriods > 0) {
+		return errors.New("duration_periods is required for repeating coupons, and only for them")
+	}
+	return nil
+}
+
+// appliesTo reports whether the coupon may be used on plan.
+func (c *Coupon) appliesTo(plan *Plan) bool {
+	return planAllowed(c.PlanIDs, plan)
+}
+
+func planAllowed(planIDs []primitive.ObjectID, plan *Plan) bool {
+	if len(planIDs) == 0 {
+		return true
+	}
+	for _, id := range planIDs {
+		if id == plan.ID {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Coupon) discount(total Money, now time.Time) (*Discount, error) {
+	discount := &Discount{
+		CouponID:   c.ID,
+		Code:       c.Code,
+		PercentOff: c.PercentOff,
+		Duration:   c.Duration,
+		PlanIDs:    c.PlanIDs,
+		AppliedAt:  now,
+	}
+	switch c.Duration {
+	case CouponOnce:
+		discount.PeriodsLeft = 1
+	case CouponRepeating:
+		discount.PeriodsLeft = c.DurationPeriods
+	}
+	if len(c.AmountOff) > 0 {
+		amountOff, err := c.amountOffIn(total.Currency)
+		if err != nil {
+			return nil, err
+		}
+		discount.AmountOff = &amountOff
+	}
+	discount.price(total)
+	return discount, nil
+}
+
+func (c *Coupon) amountOffIn(currency Currency) (Money, error) {
+	for _, amount := range c.AmountOff {
+		if amount.Currency == currency {
+			return amount, nil
+		}
+	}
+	return Money{}, fmt.Errorf("promo code cannot be used in %s", currency)
+}
+
+// Discount keeps the coupon's terms as redeemed. PeriodsLeft includes the current
+// period, and is 0 for forever coupons.
+type Discount struct {
+	CouponID    primitive.ObjectID   `json:"coupon_id" bson:"coupon_id"`
+	Code        string               `json:"code" bson:"code"`
+	PercentOff  float64              `json:"percent_off,omitempty" bson:"percent_off,omitempty"`
+	AmountOff   *Money               `json:"amount_off,omitempty" bson:"amount_off,omitempty"`
+	Duration    CouponDuration       `json:"duration" bson:"duration"`
+	PeriodsLeft int                  `json:"periods_left,omitempty" bson:"periods_left,omitempty"`
+	PlanIDs     []primitive.ObjectID `json:"plan_ids,omitempty" bson:"plan_ids,omitempty"`
+	Amount      Money                `json:"amount" bson:"amount"`
+	AppliedAt   time.Time            `json:"applied_at" bson:"applied_at"`
+}
+
+// price never takes more than the total.
+func (d *Discount) price(total Money) {
+	if d.AmountOff != nil {
+		d.Amount = NewMoney(min(d.AmountOff.Amount, total.Amount), total.Currency)
+		return
+	}
+	d.Amount = NewMoney(min(total.Scale(d.PercentOff/100).Amount, total.Amount), total.Currency)
+}
+
+// carriedTo returns nil if the coupon does not cover plan.
+func (d *Discount) carriedTo(plan *Plan, total Money) *Discount {
+	if d == nil || !planAllowed(d.PlanIDs, plan) {
+		return nil
+	}
+	if d.AmountOff != nil && d.AmountOff.Currency != total.Currency {
+		return nil
+	}
+	carried := *d
+	carried.price(total)
+	return &carried
+}
+
+// next returns nil once the discount has run out.
+func (d *Discount) next() *Discount {
+	if d == nil || d.Duration == CouponForever {
+		return d
+	}
+	if d.PeriodsLeft <= 1 {
+		return nil
+	}
+	next := *d
+	next.PeriodsLeft--
+	return &next
+}
+
+func (d *Discount) amount() *Money {
+	if d == nil {
+		return nil
+	}
+	amount := d.Amount
+	return &amount
+}
+
+// discounted returns total less the discount, if any.
+func discounted(total Money, discount *Discount) Money {
+	if discount == nil {
+		return total
+	}
+	return NewMoney(total.Amount-discount.Amount.Amount, total.Currency)
+}
+
+type CouponManager struct {
+	collection *mongo.Collection
+}
+
+func NewCouponManager(db *mongo.Database) *CouponManager {
+	manager := &CouponManager{
+		collection: db.Collection("coupons"),
+	}
+	manager.createIndexes()
+	return manager
+}
+
+func (m *CouponManager) createIndexes() {
+	ctx := context.Background()
+	indexModel := mongo.IndexModel{
+		Keys:    bson.D{{Key: "code", Value: 1}},
+		Options: &options.IndexOptions{Unique: &[]bool{true}[0]},
+	}
+	m.collection.Indexes().CreateOne(ctx, indexModel)
+}
+
+// normalizeCode makes promo codes case-insensitive.
+func normalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func (m *CouponManager) Create(ctx context.Context, coupon *Coupon) error {
+	coupon.ID = primitive.NewObjectID()
+	coupon.Code = normalizeCode(coupon.Code)
+	coupon.Redemptions = 0
+	coupon.CreatedAt = time.Now()
+	_, err := m.collection.InsertOne(ctx, coupon)
+	return err
+}
+
+func (m *CouponManager) GetAll(ctx context.Context) ([]Coupon, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := m.collection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	coupons := []Coupon{}
+	err = cursor.All(ctx, &coupons)
+	return coupons, err
+}
+
+func (m *CouponManager) GetByID(ctx context.Context, id primitive.ObjectID) (*Coupon, error) {
+	var coupon Coupon
+	err := m.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&coupon)
+	return &coupon, err
+}
+
+// Update keeps the redemption count.
+func (m *CouponManager) Update(ctx context.Context, id primitive.ObjectID, coupon *Coupon) (*Coupon, error) {
+	update := bson.M{
+		"$set": bson.M{
+			"code":             normalizeCode(coupon.Code),
+			"name":             coupon.Name,
+			"percent_off":      coupon.PercentOff,
+			"amount_off":       coupon.AmountOff,
+			"duration":         coupon.Duration,
+			"duration_periods": coupon.DurationPeriods,
+			"max_redemptions":  coupon.MaxRedemptions,
+			"expires_at":       coupon.ExpiresAt,
+			"plan_ids":         coupon.PlanIDs,
+		},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var updated Coupon
+	err := m.collection.FindOneAndUpdate(ctx, bson.M{"_id": id}, update, opts).Decode(&updated)
+	return &updated, err
+}
+
+func (m *CouponManager) Delete(ctx context.Context, id primitive.ObjectID) error {
+	result, err := m.collection.DeleteOne(ctx, bson.M{"_id": id})
+	if err == nil && result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return err
+}
+
+// Find checks the coupon can be used on plan now, without redeeming it.
+func (m *CouponManager) Find(ctx context.Context, code string, plan *Plan) (*Coupon, error) {
+	var coupon Coupon
+	err := m.collection.FindOne(ctx, bson.M{"code": normalizeCode(code)}).Decode(&coupon)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrCouponNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if coupon.ExpiresAt != nil && !time.Now().Before(*coupon.ExpiresAt) {
+		return nil, ErrCouponExhausted
+	}
+	if coupon.MaxRedemptions > 0 && coupon.Redemptions >= coupon.MaxRedemptions {
+		return nil, ErrCouponExhausted
+	}
+	if !coupon.appliesTo(plan) {
+		return nil, errors.New("promo code does not apply to this plan")
+	}
+	return &coupon, nil
+}
+
+// Redeem is guarded so concurrent redemptions cannot go over the limits.
+func (m *CouponManager) Redeem(ctx context.Context, coupon *Coupon) error {
+	filter := bson.M{
+		"_id": coupon.ID,
+		"$and": bson.A{
+			bson.M{"$or": bson.A{
+				bson.M{"max_redemptions": bson.M{"$in": bson.A{nil, 0}}},
+				bson.M{"$expr": bson.M{"$lt": bson.A{"$redemptions", "$max_redemptions"}}},
+			}},
+			bson.M{"$or": bson.A{
+				bson.M{"expires_at": nil},
+				bson.M{"expires_at": bson.M{"$gt": time.Now()}},
+			}},
+		},
+	}
+	result, err := m.collection.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"redemptions": 1}})
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount == 0 {
+		return ErrCouponExhausted
+	}
+	return nil
+}
+
+// Release gives a redemption back, for when applying the coupon failed.
+func (m *CouponManager) Release(ctx context.Context, coupon *Coupon) error {
+	_, err := m.collection.UpdateOne(ctx, bson.M{"_id": coupon.ID}, bson.M{"$inc": bson.M{"redemptions": -1}})
+	return err
+}
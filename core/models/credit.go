@@ -0,0 +1,269 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type CreditTransactionType string
+
+const (
+	// CreditProration is unused time beyond what the new plan charged
+	CreditProration CreditTransactionType = "proration"
+	// CreditAdjustment is credit issued by hand, such as for goodwill
+	CreditAdjustment CreditTransactionType = "adjustment"
+	// CreditRefund is an invoice refunded to the credit balance
+	CreditRefund CreditTransactionType = "refund"
+	// CreditSpent is credit taken off an invoice
+	CreditSpent CreditTransactionType = "spent"
+	// CreditReturned gives back credit whose invoice was voided or never written
+	CreditReturned CreditTransactionType = "returned"
+)
+
+var ErrInsufficientCredit = errors.New("insufficient credit balance")
+
+// CreditTransaction amounts add up to the balance. Key records each one once.
+type CreditTransaction struct {
+	ID        primitive.ObjectID    `json:"id" bson:"_id"`
+	UserID    string                `json:"user_id" bson:"user_id"`
+	Type      CreditTransactionType `json:"type" bson:"type"`
+	Amount    Money                 `json:"amount" bson:"amount"`
+	Reason    string                `json:"reason,omitempty" bson:"reason,omitempty"`
+	Key       string                `json:"-" bson:"key"`
+	EventID   *primitive.ObjectID   `json:"event_id,omitempty" bson:"event_id,omitempty"`
+	InvoiceID *primitive.ObjectID   `json:"invoice_id,omitempty" bson:"invoice_id,omitempty"`
+	Actor     *Actor                `json:"actor,omitempty" bson:"actor,omitempty"`
+	CreatedAt time.Time             `json:"created_at" bson:"created_at"`
+}
+
+type IssueCreditRequest struct {
+	Amount   int64    `json:"amount" validate:"min=1"`
+	Currency Currency `json:"currency" validate:"required"`
+	Reason   string   `json:"reason" validate:"required,max=500"`
+}
+
+type CreditBalance struct {
+	UserID       string              `json:"user_id"`
+	Balance      map[Currency]int64  `json:"balance"`
+	Transactions []CreditTransaction `json:"transactions"`
+}
+
+type CreditManager struct {
+	collection  *mongo.Collection
+	userManager *UserManager
+}
+
+func NewCreditManager(db *mongo.Database, userManager *UserManager) *CreditManager {
+	manager := &CreditManager{
+		collection:  db.Collection("credit_transactions"),
+		userManager: userManager,
+	}
+	manager.createIndexes()
+	return manager
+}
+
+func (m *CreditManager) createIndexes() {
+	ctx := context.Background()
+	indexModels := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "key", Value: 1}},
+			Options: &options.IndexOptions{Unique: &[]bool{true}[0]},
+		},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	}
+	m.collection.Indexes().CreateMany(ctx, indexModels)
+}
+
+// Balance returns the user's credit in currency.
+func (m *CreditManager) Balance(ctx context.Context, userID string, currency Currency) (Money, error) {
+	if _, err := m.userManager.GetByID(ctx, userID); err != nil {
+		return Money{}, err
+	}
+	balance, err := m.sum(ctx, userID)
+	if err != nil {
+		return Money{}, err
+	}
+	return NewMoney(balance[currency], currency), nil
+}
+
+// sum adds up the user's transactions per currency.
+func (m *CreditManager) sum(ctx context.Context, userID string) (map[Currency]int64, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"user_id": userID}}},
+		{{Key: "$group", Value: bson.M{"_id": "$amount.currency", "total": bson.M{"$sum": "$amount.amount"}}}},
+	}
+	cursor, err := m.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var totals []struct {
+		Currency Currency `bson:"_id"`
+		Total    int64    `bson:"total"`
+	}
+	if err := cursor.All(ctx, &totals); err != nil {
+		return nil, err
+	}
+
+	balance := make(map[Currency]int64, len(totals))
+	for _, total := range totals {
+		if total.Total != 0 {
+			balance[total.Currency] = total.Total
+		}
+	}
+	return balance, nil
+}
+
+// Get returns the user's credit balance and its transactions.
+func (m *CreditManager) Get(ctx context.Context, userID string) (*CreditBalance, error) {
+	if _, err := m.userManager.GetByID(ctx, userID); err != nil {
+		return nil, err
+	}
+	sum, err := m.sum(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := m.collection.Find(ctx, bson.M{"user_id": userID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	balance := &CreditBalance{UserID: userID, Balance: sum, Transactions: []CreditTransaction{}}
+	err = cursor.All(ctx, &balance.Transactions)
+	return balance, err
+}
+
+// Issue adds credit to the user's balance by hand, such as for goodwill.
+func (m *CreditManager) Issue(ctx context.Context, userID string, req *IssueCreditRequest, actor *Actor) (*CreditTransaction, error) {
+	if err := CheckCurrency(req.Currency); err != nil {
+		return nil, err
+	}
+	if _, err := m.userManager.GetByID(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	transaction := &CreditTransaction{
+		ID:     primitive.NewObjectID(),
+		UserID: userID,
+		Type:   CreditAdjustment,
+		Amount: NewMoney(req.Amount, req.Currency),
+		Reason: req.Reason,
+		Actor:  actor,
+	}
+	transaction.Key = "adjustment:" + transaction.ID.Hex()
+	if _, err := m.add(ctx, transaction); err != nil {
+		return nil, err
+	}
+	return transaction, nil
+}
+
+// CreditProration logs failures, like the other hooks.
+func (m *CreditManager) CreditProration(ctx context.Context, subscription *Subscription, event *SubscriptionEvent) {
+	proration := event.Proration
+	if proration == nil || proration.Scheduled || proration.RemainingCredit.Amount <= 0 {
+		return
+	}
+
+	transaction := &CreditTransaction{
+		UserID:  event.UserID,
+		Type:    CreditProration,
+		Amount:  proration.RemainingCredit,
+		Reason:  "Unused time on the previous plan",
+		Key:     "proration:" + event.ID.Hex(),
+		EventID: &event.ID,
+	}
+	if _, err := m.add(ctx, transaction); err != nil {
+		log.Printf("Failed to credit proration of %s event for user %s: %v", event.Type, event.UserID, err)
+	}
+}
+
+// spend takes its debits back if they leave the balance negative.
+func (m *CreditManager) spend(ctx context.Context, userID string, events []*SubscriptionEvent) error {
+	var currency Currency
+	var spent []primitive.ObjectID
+	for _, event := range events {
+		if event.CreditApplied == nil {
+			continue
+		}
+		currency = event.CreditApplied.Currency
+		transaction := &CreditTransaction{
+			UserID:  userID,
+			Type:    CreditSpent,
+			Amount:  NewMoney(-event.CreditApplied.Amount, currency),
+			Key:     "spent:" + event.ID.Hex(),
+			EventID: &event.ID,
+		}
+		added, err := m.add(ctx, transaction)
+		if err != nil {
+			m.undo(ctx, userID, spent)
+			return err
+		}
+		if added {
+			spent = append(spent, transaction.ID)
+		}
+	}
+	if len(spent) == 0 {
+		return nil
+	}
+
+	balance, err := m.sum(ctx, userID)
+	if err == nil && balance[currency] < 0 {
+		err = ErrInsufficientCredit
+	}
+	if err != nil {
+		m.undo(ctx, userID, spent)
+	}
+	return err
+}
+
+// undo deletes transactions spend recorded for a change it then refused.
+func (m *CreditManager) undo(ctx context.Context, userID string, ids []primitive.ObjectID) {
+	if len(ids) == 0 {
+		return
+	}
+	if _, err := m.collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+		log.Printf("Failed to take back credit spent by user %s: %v", userID, err)
+	}
+}
+
+// giveBack with a nil invoiceID is for events that were not written.
+func (m *CreditManager) giveBack(ctx context.Context, userID string, amount Money, eventID primitive.ObjectID, invoiceID *primitive.ObjectID) error {
+	transaction := &CreditTransaction{
+		UserID:    userID,
+		Type:      CreditReturned,
+		Amount:    amount,
+		Reason:    "Change not made",
+		Key:       "returned:" + eventID.Hex(),
+		EventID:   &eventID,
+		InvoiceID: invoiceID,
+	}
+	if invoiceID != nil {
+		transaction.Reason = "Invoice voided"
+	}
+	_, err := m.add(ctx, transaction)
+	return err
+}
+
+// add returns false if the transaction's key was already recorded.
+func (m *CreditManager) add(ctx context.Context, transaction *CreditTransaction) (bool, error) {
+	if transaction.ID.IsZero() {
+		transaction.ID = primitive.NewObjectID()
+	}
+	if transaction.CreatedAt.IsZero() {
+		transaction.CreatedAt = time.Now()
+	}
+	_, err := m.collection.InsertOne(ctx, transaction)
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,157 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DunningSchedule lists the days after a missed renewal to retry or remind on.
+type DunningSchedule []int
+
+var DefaultDunningSchedule = DunningSchedule{1, 3, 5}
+
+// ParseDunningSchedule reads day offsets such as "1,3,5".
+func ParseDunningSchedule(value string) (DunningSchedule, error) {
+	var schedule DunningSchedule
+	for _, part := range strings.Split(value, ",") {
+		days, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || days < 1 {
+			return nil, errors.New("dunning schedule must list whole days of at least 1")
+		}
+		schedule = append(schedule, days)
+	}
+	return schedule, nil
+}
+
+// next returns the first step after now within the grace period, or nil.
+func (s DunningSchedule) next(expiresAt, graceEnd, now time.Time) *time.Time {
+	for _, days := range s {
+		at := expiresAt.AddDate(0, 0, days)
+		if at.After(now) && at.Before(graceEnd) {
+			return &at
+		}
+	}
+	return nil
+}
+
+// Dunning tracks the grace period and dunning steps of a past due subscription.
+type Dunning struct {
+	GraceEnd time.Time  `json:"grace_end" bson:"grace_end"`
+	Attempts int        `json:"attempts" bson:"attempts"`
+	NextAt   *time.Time `json:"next_at,omitempty" bson:"next_at,omitempty"`
+}
+
+// SetDunningSchedule replaces DefaultDunningSchedule. Call it at startup.
+func (m *SubscriptionManager) SetDunningSchedule(schedule DunningSchedule) {
+	m.dunning = schedule
+}
+
+// lapse applies a pending change, then goes PAST_DUE for the plan's grace days.
+func (m *SubscriptionManager) lapse(ctx context.Context, subscription *Subscription, now time.Time) error {
+	if subscription.PendingPlanID != nil {
+		if err := m.applyPendingChange(ctx, subscription); err != nil {
+			return err
+		}
+	}
+
+	guard := bson.M{"expires_at": subscription.ExpiresAt}
+	if subscription.Plan == nil || !subscription.Plan.GraceEnd(subscription.ExpiresAt).After(now) {
+		return m.transition(ctx, subscription, StatusExpired, EventExpired, guard, nil, nil)
+	}
+
+	graceEnd := subscription.Plan.GraceEnd(subscription.ExpiresAt)
+	subscription.Dunning = &Dunning{
+		GraceEnd: graceEnd,
+		NextAt:   m.dunning.next(subscription.ExpiresAt, graceEnd, now),
+	}
+	update := bson.M{"$set": bson.M{"dunning": subscription.Dunning}}
+	return m.transition(ctx, subscription, StatusPastDue, EventPastDue, guard, update, nil)
+}
+
+// LapseDue handles ended periods with grace days or a pending change.
+func (m *SubscriptionManager) LapseDue(ctx context.Context, now time.Time, limit int) (int, error) {
+	gracePlans, err := m.planManager.GracePlanIDs(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	due := bson.M{
+		"status":     bson.M{"$in": periodStatuses},
+		"cancel_at":  bson.M{"$exists": false},
+		"expires_at": bson.M{"$lt": now},
+		"$or": bson.A{
+			bson.M{"plan_id": bson.M{"$in": gracePlans}},
+			bson.M{"pending_plan_id": bson.M{"$exists": true}},
+		},
+	}
+	return m.eachDue(ctx, due, limit, "lapse", func(subscription *Subscription) error {
+		return m.lapse(ctx, subscription, now)
+	})
+}
+
+// DunningDue retries auto-renewing subscriptions and reminds the rest.
+func (m *SubscriptionManager) DunningDue(ctx context.Context, now time.Time, limit int) (int, error) {
+	due := bson.M{"status": StatusPastDue, "dunning.next_at": bson.M{"$lte": now}}
+	return m.eachDue(ctx, due, limit, "run dunning step for", func(subscription *Subscription) error {
+		return m.dun(ctx, subscription, now)
+	})
+}
+
+func (m *SubscriptionManager) dun(ctx context.Context, subscription *Subscription, now time.Time) error {
+	if subscription.AutoRenew {
+		renewed, err := m.renew(ctx, subscription, now)
+		if err != nil {
+			log.Printf("Renewal retry failed for user %s: %v", subscription.UserID, err)
+		} else if renewed {
+			return nil
+		} else {
+			return ErrConcurrentUpdate
+		}
+	}
+
+	previous := subscription.Dunning
+	subscription.Dunning = &Dunning{
+		GraceEnd: previous.GraceEnd,
+		Attempts: previous.Attempts + 1,
+		NextAt:   m.dunning.next(subscription.ExpiresAt, previous.GraceEnd, now),
+	}
+	guard := bson.M{"dunning.attempts": previous.Attempts}
+	update := bson.M{"$set": bson.M{"dunning": subscription.Dunning}}
+	return m.transition(ctx, subscription, StatusPastDue, EventDunningReminder, guard, update, nil)
+}
+
+// eachDue logs and skips failures, except lost races which are not reported.
+func (m *SubscriptionManager) eachDue(ctx context.Context, due bson.M, limit int, action string, fn func(*Subscription) error) (int, error) {
+	cursor, err := m.collection.Find(ctx, due, options.Find().SetLimit(int64(limit)))
+	if err != nil {
+		return 0, err
+	}
+
+	var subscriptions []Subscription
+	if err := cursor.All(ctx, &subscriptions); err != nil {
+		return 0, err
+	}
+
+	done := 0
+	for i := range subscriptions {
+		subscription := &subscriptions[i]
+		if plan, err := m.planOf(ctx, subscription); err == nil {
+			subscription.Plan = plan
+		}
+		if err := fn(subscription); err != nil {
+			if err != ErrConcurrentUpdate {
+				log.Printf("Failed to %s subscription for user %s: %v", action, subscription.UserID, err)
+			}
+			continue
+		}
+		done++
+	}
+	return done, nil
+}
@@ -0,0 +1,199 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Entitlement is an on/off feature without a Limit. Metered limits reset every
+// period, and are hard quotas unless OveragePrices charges for usage beyond them.
+type Entitlement struct {
+	Key           string  `json:"key" bson:"key" validate:"required"`
+	Name          string  `json:"name,omitempty" bson:"name,omitempty"`
+	Limit         *int64  `json:"limit,omitempty" bson:"limit,omitempty" validate:"omitempty,min=0"`
+	Unit          string  `json:"unit,omitempty" bson:"unit,omitempty"`
+	PerSeat       bool    `json:"per_seat,omitempty" bson:"per_seat,omitempty"`
+	Metered       bool    `json:"metered,omitempty" bson:"metered,omitempty"`
+	OveragePrices []Money `json:"overage_prices,omitempty" bson:"overage_prices,omitempty"`
+}
+
+// limitFor returns the limit of e on a subscription with seats seats.
+func (e *Entitlement) limitFor(seats int) *int64 {
+	if e.Limit == nil || !e.PerSeat {
+		return e.Limit
+	}
+	limit := *e.Limit * int64(max(seats, 1))
+	return &limit
+}
+
+// checkOverage reports whether e's overage prices cover currencies.
+func (e *Entitlement) checkOverage(currencies map[Currency]bool) error {
+	if len(e.OveragePrices) == 0 {
+		return nil
+	}
+	if !e.Metered || e.Limit == nil {
+		return fmt.Errorf("entitlement %q needs to be metered and limited to charge overage", e.Key)
+	}
+	for currency := range currencies {
+		if _, err := e.overagePrice(currency); err != nil {
+			return err
+		}
+	}
+	for _, price := range e.OveragePrices {
+		if price.Amount < 0 {
+			return fmt.Errorf("entitlement %q has a negative overage price", e.Key)
+		}
+	}
+	return nil
+}
+
+var nonKeyChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// Plans from before entitlements grant each feature, keyed in snake case.
+func (p *Plan) entitlements() []Entitlement {
+	if p.Entitlements != nil {
+		return p.Entitlements
+	}
+	entitlements := make([]Entitlement, 0, len(p.Features))
+	for _, feature := range p.Features {
+		key := strings.Trim(nonKeyChars.ReplaceAllString(strings.ToLower(feature), "_"), "_")
+		if key != "" {
+			entitlements = append(entitlements, Entitlement{Key: key, Name: feature})
+		}
+	}
+	return entitlements
+}
+
+// Grant has a nil Limit for on/off features and unlimited quantities alike.
+type Grant struct {
+	Key            string             `json:"key"`
+	Name           string             `json:"name,omitempty"`
+	Limit          *int64             `json:"limit,omitempty"`
+	Unit           string             `json:"unit,omitempty"`
+	Metered        bool               `json:"metered,omitempty"`
+	Used           int64              `json:"used,omitempty"`
+	Overage        bool               `json:"overage,omitempty"`
+	SubscriptionID primitive.ObjectID `json:"subscription_id"`
+	PlanID         primitive.ObjectID `json:"plan_id"`
+	PlanVersion    int                `json:"plan_version"`
+	Status         SubscriptionStatus `json:"status"`
+}
+
+// EntitlementCheck with an Amount of 0 asks whether the user has it at all.
+type EntitlementCheck struct {
+	UserID string `json:"user_id"`
+	Key    string `json:"key" validate:"required"`
+	Amount int64  `json:"amount" validate:"min=0"`
+}
+
+type CheckEntitlementsRequest struct {
+	Checks []EntitlementCheck `json:"checks" validate:"required,min=1,max=100,dive"`
+}
+
+// EntitlementDecision has Overage set when only charged overage allows it.
+type EntitlementDecision struct {
+	EntitlementCheck
+	Allowed bool   `json:"allowed"`
+	Limit   *int64 `json:"limit,omitempty"`
+	Unit    string `json:"unit,omitempty"`
+	Used    int64  `json:"used,omitempty"`
+	Overage bool   `json:"overage,omitempty"`
+}
+
+// Entitlements gives the most generous grant when several subscriptions share a key.
+func (m *SubscriptionManager) Entitlements(ctx context.Context, userID string) ([]Grant, error) {
+	subscriptions, err := m.ListSubscriptions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	grants := []Grant{}
+	index := make(map[string]int)
+	for _, subscription := range subscriptions {
+		if !subscription.Status.HasAccess() || subscription.Plan == nil {
+			continue
+		}
+		var used map[string]int64
+		for _, entitlement := range subscription.Plan.entitlements() {
+			grant := Grant{
+				Key:            entitlement.Key,
+				Name:           entitlement.Name,
+				Limit:          entitlement.limitFor(subscription.Quantity),
+				Unit:           entitlement.Unit,
+				Metered:        entitlement.Metered,
+				Overage:        len(entitlement.OveragePrices) > 0,
+				SubscriptionID: subscription.ID,
+				PlanID:         subscription.PlanID,
+				PlanVersion:    subscription.PlanVersion,
+				Status:         subscription.Status,
+			}
+			if entitlement.Metered {
+				if used == nil {
+					if used, err = m.usedBetween(ctx, subscription.ID, subscription.StartDate, subscription.ExpiresAt); err != nil {
+						return nil, err
+					}
+				}
+				grant.Used = used[entitlement.Key]
+			}
+
+			i, granted := index[grant.Key]
+			if !granted {
+				index[grant.Key] = len(grants)
+				grants = append(grants, grant)
+			} else if grant.exceeds(grants[i]) {
+				grants[i] = grant
+			}
+		}
+	}
+	return grants, nil
+}
+
+// exceeds reports whether g allows more than other.
+func (g Grant) exceeds(other Grant) bool {
+	if other.remaining() == nil {
+		return false
+	}
+	return g.remaining() == nil || *g.remaining() > *other.remaining()
+}
+
+// remaining returns nil if g is unlimited. Grants with overage never run out.
+func (g Grant) remaining() *int64 {
+	if g.Limit == nil || g.Overage {
+		return nil
+	}
+	remaining := *g.Limit - g.Used
+	return &remaining
+}
+
+func (m *SubscriptionManager) CheckEntitlements(ctx context.Context, checks []EntitlementCheck) ([]EntitlementDecision, error) {
+	users := make(map[string]map[string]Grant)
+	decisions := make([]EntitlementDecision, 0, len(checks))
+	for _, check := range checks {
+		grants, resolved := users[check.UserID]
+		if !resolved {
+			list, err := m.Entitlements(ctx, check.UserID)
+			if err != nil {
+				return nil, err
+			}
+			grants = make(map[string]Grant, len(list))
+			for _, grant := range list {
+				grants[grant.Key] = grant
+			}
+			users[check.UserID] = grants
+		}
+
+		decision := EntitlementDecision{EntitlementCheck: check}
+		if grant, granted := grants[check.Key]; granted {
+			remaining := grant.remaining()
+			decision.Allowed = remaining == nil || check.Amount <= *remaining
+			decision.Limit, decision.Unit, decision.Used = grant.Limit, grant.Unit, grant.Used
+			decision.Overage = grant.Overage && grant.Limit != nil && grant.Used+check.Amount > *grant.Limit
+		}
+		decisions = append(decisions, decision)
+	}
+	return decisions, nil
+}
@@ -0,0 +1,630 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type InvoiceStatus string
+
+const (
+	// InvoiceDraft invoices have no number yet and are finalized to open
+	InvoiceDraft InvoiceStatus = "draft"
+	InvoiceOpen  InvoiceStatus = "open"
+	InvoicePaid  InvoiceStatus = "paid"
+	InvoiceVoid  InvoiceStatus = "void"
+	// InvoiceRefunded invoices were paid and then refunded in full
+	InvoiceRefunded InvoiceStatus = "refunded"
+)
+
+// Void and refunded invoices are final.
+var invoiceTransitions = map[InvoiceStatus][]InvoiceStatus{
+	InvoiceDraft: {InvoiceOpen, InvoiceVoid},
+	InvoiceOpen:  {InvoicePaid, InvoiceVoid},
+	InvoicePaid:  {InvoiceRefunded},
+}
+
+var (
+	ErrInvoiceStatus  = errors.New("invalid invoice status change")
+	ErrInvoiceChanged = errors.New("invoice was changed by another request, please retry")
+	ErrInvalidRefund  = errors.New("invalid refund")
+)
+
+// maxNumberAttempts limits retries when concurrent finalizes take the next number.
+const maxNumberAttempts = 10
+
+func checkInvoiceTransition(from, to InvoiceStatus) error {
+	for _, allowed := range invoiceTransitions[from] {
+		if allowed == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: a %s invoice cannot become %s", ErrInvoiceStatus, from, to)
+}
+
+type InvoiceLineType string
+
+const (
+	LinePlan      InvoiceLineType = "plan"
+	LineAddOn     InvoiceLineType = "add_on"
+	LineDiscount  InvoiceLineType = "discount"
+	LineProration InvoiceLineType = "proration"
+	LineOverage   InvoiceLineType = "overage"
+	LineTax       InvoiceLineType = "tax"
+)
+
+// InvoiceLine deductions, such as discounts, have negative amounts.
+type InvoiceLine struct {
+	Type        InvoiceLineType `json:"type" bson:"type"`
+	Description string          `json:"description" bson:"description"`
+	Quantity    int             `json:"quantity,omitempty" bson:"quantity,omitempty"`
+	UnitPrice   *Money          `json:"unit_price,omitempty" bson:"unit_price,omitempty"`
+	Amount      Money           `json:"amount" bson:"amount"`
+}
+
+// RefundDestination is where a refund of an invoice goes.
+type RefundDestination string
+
+const (
+	// RefundToPayment goes back to the payment method the invoice was paid with
+	RefundToPayment RefundDestination = "payment"
+	// RefundToCredit adds it to the user's credit balance
+	RefundToCredit RefundDestination = "credit"
+)
+
+type InvoiceRefund struct {
+	ID               primitive.ObjectID `json:"id" bson:"id"`
+	Amount           Money              `json:"amount" bson:"amount"`
+	To               RefundDestination  `json:"to" bson:"to"`
+	Reason           string             `json:"reason" bson:"reason"`
+	ProviderRefundID string             `json:"provider_refund_id,omitempty" bson:"provider_refund_id,omitempty"`
+	Actor            *Actor             `json:"actor,omitempty" bson:"actor,omitempty"`
+	CreatedAt        time.Time          `json:"created_at" bson:"created_at"`
+}
+
+// RefundInvoiceRequest refunds all that is left when Amount is zero.
+type RefundInvoiceRequest struct {
+	Amount int64             `json:"amount" validate:"min=0"`
+	To     RefundDestination `json:"to" validate:"omitempty,oneof=payment credit"`
+	Reason string            `json:"reason" validate:"required,max=500"`
+}
+
+// Invoice Total is the subtotal, or nothing if credit exceeds it, plus tax.
+// AmountDue is what is left after CreditApplied.
+type Invoice struct {
+	ID             primitive.ObjectID    `json:"id" bson:"_id,omitempty"`
+	Number         string                `json:"number,omitempty" bson:"number,omitempty"`
+	UserID         string                `json:"user_id" bson:"user_id"`
+	SubscriptionID primitive.ObjectID    `json:"subscription_id" bson:"subscription_id"`
+	EventID        primitive.ObjectID    `json:"event_id" bson:"event_id"`
+	Reason         SubscriptionEventType `json:"reason" bson:"reason"`
+	Status         InvoiceStatus         `json:"status" bson:"status"`
+	Currency       Currency              `json:"currency" bson:"currency"`
+	Lines          []InvoiceLine         `json:"lines" bson:"lines"`
+	Subtotal       Money                 `json:"subtotal" bson:"subtotal"`
+	TaxRate        float64               `json:"tax_rate,omitempty" bson:"tax_rate,omitempty"`
+	Tax            Money                 `json:"tax" bson:"tax"`
+	Total          Money                 `json:"total" bson:"total"`
+	CreditApplied  *Money                `json:"credit_applied,omitempty" bson:"credit_applied,omitempty"`
+	AmountDue      Money                 `json:"amount_due" bson:"amount_due"`
+	AmountRefunded *Money                `json:"amount_refunded,omitempty" bson:"amount_refunded,omitempty"`
+	Refunds        []InvoiceRefund       `json:"refunds,omitempty" bson:"refunds,omitempty"`
+	PeriodStart    time.Time             `json:"period_start" bson:"period_start"`
+	PeriodEnd      time.Time             `json:"period_end" bson:"period_end"`
+	CreatedAt      time.Time             `json:"created_at" bson:"created_at"`
+	FinalizedAt    *time.Time            `json:"finalized_at,omitempty" bson:"finalized_at,omitempty"`
+	PaidAt         *time.Time            `json:"paid_at,omitempty" bson:"paid_at,omitempty"`
+	VoidedAt       *time.Time            `json:"voided_at,omitempty" bson:"voided_at,omitempty"`
+	RefundedAt     *time.Time            `json:"refunded_at,omitempty" bson:"refunded_at,omitempty"`
+}
+
+// Only AmountDue, paid through the provider, can go back to the payment.
+func (i *Invoice) refundable(destination RefundDestination) int64 {
+	left := i.Total.Amount
+	if i.AmountRefunded != nil {
+		left -= i.AmountRefunded.Amount
+	}
+	if destination == RefundToPayment {
+		paid := i.AmountDue.Amount
+		for _, refund := range i.Refunds {
+			if refund.To == RefundToPayment {
+				paid -= refund.Amount.Amount
+			}
+		}
+		left = min(left, paid)
+	}
+	return max(left, 0)
+}
+
+// InvoiceFilter narrows a list of invoices. Empty fields match everything.
+type InvoiceFilter struct {
+	UserID         string
+	SubscriptionID *primitive.ObjectID
+	Status         InvoiceStatus
+}
+
+func (f *InvoiceFilter) Check() error {
+	switch f.Status {
+	case "", InvoiceDraft, InvoiceOpen, InvoicePaid, InvoiceVoid, InvoiceRefunded:
+		return nil
+	default:
+		return fmt.Errorf("unknown invoice status %q", f.Status)
+	}
+}
+
+// TaxRates are percentages. Invoices in other currencies are not taxed.
+type TaxRates map[Currency]float64
+
+// ParseTaxRates reads pairs such as "INR:18,EUR:20".
+func ParseTaxRates(value string) (TaxRates, error) {
+	rates := TaxRates{}
+	if strings.TrimSpace(value) == "" {
+		return rates, nil
+	}
+	for _, part := range strings.Split(value, ",") {
+		code, percent, found := strings.Cut(strings.TrimSpace(part), ":")
+		rate, err := strconv.ParseFloat(strings.TrimSpace(percent), 64)
+		if !found || err != nil || rate < 0 || rate > 100 {
+			return nil, errors.New("tax rates must be currency:percent pairs, such as INR:18")
+		}
+		currency := Currency(strings.ToUpper(strings.TrimSpace(code)))
+		if err := CheckCurrency(currency); err != nil {
+			return nil, err
+		}
+		rates[currency] = rate
+	}
+	return rates, nil
+}
+
+type InvoiceManager struct {
+	collection  *mongo.Collection
+	counters    *mongo.Collection
+	planManager *PlanManager
+	// credits takes back the credit spent on invoices that are voided
+	credits  *CreditManager
+	taxRates TaxRates
+}
+
+func NewInvoiceManager(db *mongo.Database, planManager *PlanManager, creditManager *CreditManager) *InvoiceManager {
+	manager := &InvoiceManager{
+		collection:  db.Collection("invoices"),
+		counters:    db.Collection("counters"),
+		planManager: planManager,
+		credits:     creditManager,
+		taxRates:    TaxRates{},
+	}
+	manager.createIndexes()
+	manager.migrateAmountDue()
+	return manager
+}
+
+// migrateAmountDue sets the amount due of invoices from before credit.
+func (m *InvoiceManager) migrateAmountDue() {
+	ctx := context.Background()
+	legacy := bson.M{"amount_due": bson.M{"$exists": false}}
+	pipeline := mongo.Pipeline{{{Key: "$set", Value: bson.M{"amount_due": "$total"}}}}
+	if _, err := m.collection.UpdateMany(ctx, legacy, pipeline); err != nil {
+		log.Printf("Failed to migrate invoice amounts due: %v", err)
+	}
+}
+
+// createIndexes allows drafts, which have no number yet.
+func (m *InvoiceManager) createIndexes() {
+	ctx := context.Background()
+	indexModels := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "event_id", Value: 1}},
+			Options: &options.IndexOptions{Unique: &[]bool{true}[0]},
+		},
+		{
+			Keys:    bson.D{{Key: "number", Value: 1}},
+			Options: &options.IndexOptions{Unique: &[]bool{true}[0], Sparse: &[]bool{true}[0]},
+		},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "subscription_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	}
+	m.collection.Indexes().CreateMany(ctx, indexModels)
+}
+
+// SetTaxRates should be called at startup.
+func (m *InvoiceManager) SetTaxRates(rates TaxRates) {
+	m.taxRates = rates
+}
+
+// Bill must run after the event is recorded, so the invoice can refer to it. An
+// invoice that could not be finalized stays a draft.
+func (m *InvoiceManager) Bill(ctx context.Context, subscription *Subscription, event *SubscriptionEvent) {
+	if !event.billable() {
+		return
+	}
+
+	invoice := m.draft(ctx, subscription, event)
+	if _, err := m.collection.InsertOne(ctx, invoice); err != nil {
+		if !mongo.IsDuplicateKeyError(err) {
+			log.Printf("Failed to invoice %s event for user %s: %v", event.Type, event.UserID, err)
+		}
+		return
+	}
+	if _, err := m.Finalize(ctx, invoice.ID); err != nil {
+		log.Printf("Failed to finalize invoice %s for user %s: %v", invoice.ID.Hex(), event.UserID, err)
+	}
+}
+
+// billable excludes trials.
+func (e *SubscriptionEvent) billable() bool {
+	return (e.Proration != nil && !e.Proration.Scheduled) || e.Renewal
+}
+
+func (m *InvoiceManager) draft(ctx context.Context, subscription *Subscription, event *SubscriptionEvent) *Invoice {
+	currency := event.Price.Currency
+	invoice := &Invoice{
+		ID:             primitive.NewObjectID(),
+		UserID:         event.UserID,
+		SubscriptionID: event.SubscriptionID,
+		EventID:        event.ID,
+		Reason:         event.Type,
+		Status:         InvoiceDraft,
+		Currency:       currency,
+		PeriodStart:    event.PeriodStart,
+		PeriodEnd:      event.PeriodEnd,
+		CreatedAt:      time.Now(),
+	}
+
+	lines := append(m.chargeLines(ctx, subscription, event), overageLines(event)...)
+	lines = append(lines, deductions(subscription.Discount, event)...)
+	invoice.price(lines, m.taxRates[currency])
+	invoice.applyCredit(event.CreditApplied)
+	return invoice
+}
+
+// Due is what the event's invoice will ask for, so it can be charged up front.
+func (m *InvoiceManager) Due(event *SubscriptionEvent) Money {
+	currency := event.Price.Currency
+	if !event.billable() {
+		return NewMoney(0, currency)
+	}
+	invoice := &Invoice{Currency: currency}
+	lines := append([]InvoiceLine{{Type: LinePlan, Amount: event.Price}}, overageLines(event)...)
+	lines = append(lines, deductions(nil, event)...)
+	invoice.price(lines, m.taxRates[currency])
+	invoice.applyCredit(event.CreditApplied)
+	return invoice.AmountDue
+}
+
+func overageLines(event *SubscriptionEvent) []InvoiceLine {
+	var lines []InvoiceLine
+	for _, meter := range event.Overage {
+		if meter.OverageCharge == nil {
+			continue
+		}
+		description := fmt.Sprintf("%s over the limit of %d", meter.Key, *meter.Limit)
+		if meter.Unit != "" {
+			description = fmt.Sprintf("%s over the limit of %d %s", meter.Key, *meter.Limit, meter.Unit)
+		}
+		unitPrice := NewMoney(meter.OverageCharge.Amount/meter.Overage, meter.OverageCharge.Currency)
+		lines = append(lines, InvoiceLine{
+			Type:        LineOverage,
+			Description: description,
+			Quantity:    int(meter.Overage),
+			UnitPrice:   &unitPrice,
+			Amount:      *meter.OverageCharge,
+		})
+	}
+	return lines
+}
+
+func deductions(discount *Discount, event *SubscriptionEvent) []InvoiceLine {
+	currency := event.Price.Currency
+	var lines []InvoiceLine
+	if event.Discount != nil && event.Discount.Amount > 0 {
+		description := "Discount"
+		if discount != nil {
+			description = "Promo code " + discount.Code
+		}
+		lines = append(lines, InvoiceLine{Type: LineDiscount, Description: description, Amount: NewMoney(-event.Discount.Amount, currency)})
+	}
+	if proration := event.Proration; proration != nil && proration.Credit.Amount > 0 {
+		lines = append(lines, InvoiceLine{
+			Type:        LineProration,
+			Description: fmt.Sprintf("Unused time on the previous plan (%.0f%% of its period)", proration.UnusedFraction*100),
+			Amount:      NewMoney(-proration.Credit.Amount, currency),
+		})
+	}
+	return lines
+}
+
+// chargeLines gives periods on an earlier version or price a single plan line.
+func (m *InvoiceManager) chargeLines(ctx context.Context, subscription *Subscription, event *SubscriptionEvent) []InvoiceLine {
+	plan := subscription.Plan
+	if plan == nil || subscription.PlanID != event.PlanID || subscription.PlanVersion != event.PlanVersion || subscription.amount() != event.Price {
+		description := "Subscription"
+		if plan, err := m.planManager.GetVersion(ctx, event.PlanID, event.PlanVersion); err == nil {
+			description = plan.Name
+		}
+		return []InvoiceLine{{Type: LinePlan, Description: description, Amount: event.Price}}
+	}
+
+	seats := InvoiceLine{Type: LinePlan, Description: plan.Name, Quantity: max(subscription.Quantity, 1), Amount: event.Price}
+	lines := []InvoiceLine{seats}
+	for _, item := range subscription.AddOns {
+		description := item.Code
+		if addOn := plan.addOn(item.Code); addOn != nil {
+			description = addOn.Name
+		}
+		unitPrice := item.Price
+		amount := item.Price.Times(item.Quantity)
+		lines = append(lines, InvoiceLine{Type: LineAddOn, Description: description, Quantity: item.Quantity, UnitPrice: &unitPrice, Amount: amount})
+		lines[0].Amount.Amount -= amount.Amount
+	}
+	// Tiered seats have no single unit price
+	if !plan.tiered() {
+		unitPrice := NewMoney(lines[0].Amount.Amount/int64(lines[0].Quantity), lines[0].Amount.Currency)
+		lines[0].UnitPrice = &unitPrice
+	}
+	return lines
+}
+
+// Credit beyond the charges is not taxed and brings the total to zero.
+func (i *Invoice) price(lines []InvoiceLine, rate float64) {
+	subtotal := NewMoney(0, i.Currency)
+	for _, line := range lines {
+		subtotal.Amount += line.Amount.Amount
+	}
+	taxable := NewMoney(max(subtotal.Amount, 0), i.Currency)
+	tax := taxable.Scale(rate / 100)
+	if rate > 0 {
+		lines = append(lines, InvoiceLine{Type: LineTax, Description: fmt.Sprintf("Tax at %g%%", rate), Amount: tax})
+	}
+
+	i.Lines, i.Subtotal, i.TaxRate, i.Tax = lines, subtotal, rate, tax
+	i.Total = NewMoney(taxable.Amount+tax.Amount, i.Currency)
+	i.AmountDue = i.Total
+}
+
+// applyCredit pays credit, up to the total, from the user's credit balance.
+func (i *Invoice) applyCredit(credit *Money) {
+	if credit == nil || credit.Amount <= 0 {
+		return
+	}
+	applied := NewMoney(min(credit.Amount, i.Total.Amount), i.Currency)
+	i.CreditApplied = &applied
+	i.AmountDue = NewMoney(i.Total.Amount-applied.Amount, i.Currency)
+}
+
+// Finalize marks invoices with nothing to pay, after credit, paid straight away.
+func (m *InvoiceManager) Finalize(ctx context.Context, id primitive.ObjectID) (*Invoice, error) {
+	invoice, err := m.GetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkInvoiceTransition(invoice.Status, InvoiceOpen); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	set := bson.M{"status": InvoiceOpen, "finalized_at": now}
+	if invoice.AmountDue.Amount == 0 {
+		set["status"], set["paid_at"] = InvoicePaid, now
+	}
+	// The unique index on number refuses it if a concurrent finalize took it first
+	for range maxNumberAttempts {
+		seq, err := m.lastNumber(ctx)
+		if err != nil {
+			return nil, err
+		}
+		set["number"] = fmt.Sprintf("INV-%06d", seq+1)
+		updated, err := m.update(ctx, invoice, set)
+		if mongo.IsDuplicateKeyError(err) {
+			m.advanceNumber(ctx, seq+1)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.advanceNumber(ctx, seq+1)
+		return updated, nil
+	}
+	return nil, ErrInvoiceChanged
+}
+
+// MarkPaid records that an open invoice was paid.
+func (m *InvoiceManager) MarkPaid(ctx context.Context, id primitive.ObjectID) (*Invoice, error) {
+	return m.setStatus(ctx, id, InvoicePaid, "paid_at")
+}
+
+// Void keeps the invoice and its number, and gives back the credit spent on it.
+func (m *InvoiceManager) Void(ctx context.Context, id primitive.ObjectID) (*Invoice, error) {
+	invoice, err := m.setStatus(ctx, id, InvoiceVoid, "voided_at")
+	if err != nil {
+		return nil, err
+	}
+	if err := m.returnCredit(ctx, invoice); err != nil {
+		log.Printf("Failed to give back credit spent on invoice %s: %v", invoice.ID.Hex(), err)
+	}
+	return invoice, nil
+}
+
+func (m *InvoiceManager) PayEvents(ctx context.Context, eventIDs []primitive.ObjectID) error {
+	return m.setEventsStatus(ctx, eventIDs, InvoicePaid, "paid_at")
+}
+
+// VoidEvents leaves paid invoices alone.
+func (m *InvoiceManager) VoidEvents(ctx context.Context, eventIDs []primitive.ObjectID) error {
+	if err := m.setEventsStatus(ctx, eventIDs, InvoiceVoid, "voided_at"); err != nil || len(eventIDs) == 0 {
+		return err
+	}
+
+	filter := bson.M{"event_id": bson.M{"$in": eventIDs}, "status": InvoiceVoid, "credit_applied": bson.M{"$exists": true}}
+	cursor, err := m.collection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	var voided []Invoice
+	if err := cursor.All(ctx, &voided); err != nil {
+		return err
+	}
+	for i := range voided {
+		if err := m.returnCredit(ctx, &voided[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// returnCredit changes nothing when repeated.
+func (m *InvoiceManager) returnCredit(ctx context.Context, invoice *Invoice) error {
+	if invoice.CreditApplied == nil || invoice.CreditApplied.Amount <= 0 {
+		return nil
+	}
+	return m.credits.giveBack(ctx, invoice.UserID, *invoice.CreditApplied, invoice.EventID, &invoice.ID)
+}
+
+// addRefund fails if another refund was recorded since the invoice was read.
+func (m *InvoiceManager) addRefund(ctx context.Context, invoice *Invoice, refund *InvoiceRefund) (*Invoice, error) {
+	refunded := NewMoney(refund.Amount.Amount, invoice.Currency)
+	if invoice.AmountRefunded != nil {
+		refunded.Amount += invoice.AmountRefunded.Amount
+	}
+	set := bson.M{"amount_refunded": refunded}
+	if refunded.Amount >= invoice.Total.Amount {
+		set["status"], set["refunded_at"] = InvoiceRefunded, refund.CreatedAt
+	}
+
+	filter := bson.M{"_id": invoice.ID, "status": InvoicePaid, "amount_refunded": invoice.AmountRefunded}
+	update := bson.M{"$set": set, "$push": bson.M{"refunds": refund}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var updated Invoice
+	err := m.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&updated)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvoiceChanged
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// removeRefund takes back a refund whose money could not be moved.
+func (m *InvoiceManager) removeRefund(ctx context.Context, invoice *Invoice, refund *InvoiceRefund) error {
+	filter := bson.M{"_id": invoice.ID, "refunds.id": refund.ID}
+	update := bson.M{
+		"$set":   bson.M{"status": InvoicePaid},
+		"$inc":   bson.M{"amount_refunded.amount": -refund.Amount.Amount},
+		"$pull":  bson.M{"refunds": bson.M{"id": refund.ID}},
+		"$unset": bson.M{"refunded_at": ""},
+	}
+	_, err := m.collection.UpdateOne(ctx, filter, update)
+	return err
+}
+
+func (m *InvoiceManager) setProviderRefundID(ctx context.Context, invoiceID, refundID primitive.ObjectID, providerRefundID string) error {
+	filter := bson.M{"_id": invoiceID, "refunds.id": refundID}
+	update := bson.M{"$set": bson.M{"refunds.$.provider_refund_id": providerRefundID}}
+	_, err := m.collection.UpdateOne(ctx, filter, update)
+	return err
+}
+
+func (m *InvoiceManager) setEventsStatus(ctx context.Context, eventIDs []primitive.ObjectID, status InvoiceStatus, field string) error {
+	if len(eventIDs) == 0 {
+		return nil
+	}
+	var from []InvoiceStatus
+	for current := range invoiceTransitions {
+		if checkInvoiceTransition(current, status) == nil {
+			from = append(from, current)
+		}
+	}
+	filter := bson.M{"event_id": bson.M{"$in": eventIDs}, "status": bson.M{"$in": from}}
+	_, err := m.collection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"status": status, field: time.Now()}})
+	return err
+}
+
+// setStatus moves an invoice to status, recording the time in field.
+func (m *InvoiceManager) setStatus(ctx context.Context, id primitive.ObjectID, status InvoiceStatus, field string) (*Invoice, error) {
+	invoice, err := m.GetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkInvoiceTransition(invoice.Status, status); err != nil {
+		return nil, err
+	}
+	return m.update(ctx, invoice, bson.M{"status": status, field: time.Now()})
+}
+
+// update only applies while the invoice still has the status it was read with.
+func (m *InvoiceManager) update(ctx context.Context, invoice *Invoice, set bson.M) (*Invoice, error) {
+	filter := bson.M{"_id": invoice.ID, "status": invoice.Status}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var updated Invoice
+	err := m.collection.FindOneAndUpdate(ctx, filter, bson.M{"$set": set}, opts).Decode(&updated)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvoiceChanged
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// lastNumber only counts numbers an invoice holds, so failures leave no gaps.
+func (m *InvoiceManager) lastNumber(ctx context.Context) (int64, error) {
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := m.counters.FindOne(ctx, bson.M{"_id": "invoice_number"}).Decode(&counter)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	return counter.Seq, err
+}
+
+// advanceNumber failing is harmless: the next Finalize runs into the number.
+func (m *InvoiceManager) advanceNumber(ctx context.Context, seq int64) {
+	opts := options.Update().SetUpsert(true)
+	if _, err := m.counters.UpdateOne(ctx, bson.M{"_id": "invoice_number"}, bson.M{"$max": bson.M{"seq": seq}}, opts); err != nil {
+		log.Printf("Failed to advance invoice number to %d: %v", seq, err)
+	}
+}
+
+func (m *InvoiceManager) GetByID(ctx context.Context, id primitive.ObjectID) (*Invoice, error) {
+	var invoice Invoice
+	if err := m.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&invoice); err != nil {
+		return nil, err
+	}
+	return &invoice, nil
+}
+
+// List returns the invoices matching filter, newest first.
+func (m *InvoiceManager) List(ctx context.Context, filter InvoiceFilter) ([]Invoice, error) {
+	query := bson.M{}
+	if filter.UserID != "" {
+		query["user_id"] = filter.UserID
+	}
+	if filter.SubscriptionID != nil {
+		query["subscription_id"] = *filter.SubscriptionID
+	}
+	if filter.Status != "" {
+		query["status"] = filter.Status
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := m.collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	invoices := []Invoice{}
+	err = cursor.All(ctx, &invoices)
+	return invoices, err
+}
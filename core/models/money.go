@@ -0,0 +1,106 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Currency is an ISO 4217 currency code.
+type Currency string
+
+// DefaultCurrency is the currency of prices from before plans had one.
+const DefaultCurrency Currency = "INR"
+
+// currencyExponents holds the minor unit digits of each supported currency.
+var currencyExponents = map[Currency]int{
+	"INR": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"USD": 2,
+	"JPY": 0,
+}
+
+var ErrCurrencyMismatch = errors.New("amounts are in different currencies")
+
+// CheckCurrency reports whether plans can be sold in currency.
+func CheckCurrency(currency Currency) error {
+	if _, ok := currencyExponents[currency]; !ok {
+		return fmt.Errorf("unsupported currency %q", currency)
+	}
+	return nil
+}
+
+// Money is in minor units, such as paise or cents, to avoid rounding errors.
+type Money struct {
+	Amount   int64    `json:"amount" bson:"amount"`
+	Currency Currency `json:"currency" bson:"currency"`
+}
+
+func NewMoney(amount int64, currency Currency) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+// Add returns m plus other, which must be in the same currency.
+func (m Money) Add(other Money) (Money, error) {
+	if m.Currency != other.Currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+	return NewMoney(m.Amount+other.Amount, m.Currency), nil
+}
+
+// Times returns m multiplied by a whole quantity.
+func (m Money) Times(quantity int) Money {
+	return NewMoney(m.Amount*int64(quantity), m.Currency)
+}
+
+// Scale returns m multiplied by factor, rounded to the nearest minor unit.
+func (m Money) Scale(factor float64) Money {
+	return NewMoney(int64(math.Round(float64(m.Amount)*factor)), m.Currency)
+}
+
+// String formats m in major units, such as "EUR 12.50".
+func (m Money) String() string {
+	exponent := currencyExponents[m.Currency]
+	if exponent == 0 {
+		return fmt.Sprintf("%s %d", m.Currency, m.Amount)
+	}
+
+	sign, amount := "", m.Amount
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	unit := int64(math.Pow10(exponent))
+	return fmt.Sprintf("%s %s%d.%0*d", m.Currency, sign, amount/unit, exponent, amount%unit)
+}
+
+// legacyMinorUnits converts a float64 amount in DefaultCurrency to minor units.
+func legacyMinorUnits(amount any) bson.M {
+	return bson.M{"$toLong": bson.M{"$round": bson.A{bson.M{"$multiply": bson.A{amount, 100}}, 0}}}
+}
+
+// legacyMoney converts a float64 amount to Money, leaving missing ones missing.
+func legacyMoney(field string) bson.M {
+	return bson.M{"$cond": bson.A{
+		bson.M{"$isNumber": field},
+		bson.M{"amount": legacyMinorUnits(field), "currency": DefaultCurrency},
+		"$$REMOVE",
+	}}
+}
+
+func legacyAddOnItems(field string) bson.M {
+	return bson.M{"$cond": bson.A{
+		bson.M{"$isArray": field},
+		bson.M{"$map": bson.M{
+			"input": field,
+			"in": bson.M{
+				"code":     "$$this.code",
+				"quantity": "$$this.quantity",
+				"price":    legacyMoney("$$this.price"),
+			},
+		}},
+		"$$REMOVE",
+	}}
+}
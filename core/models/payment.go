@@ -0,0 +1,824 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"subservice/core/payments"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// IncompleteTimeout is how long a payment may wait to be used.
+const IncompleteTimeout = 24 * time.Hour
+
+var (
+	ErrNoPaymentMethod  = errors.New("a payment method is required")
+	ErrNotPaidByPayment = errors.New("the invoice was not paid through the payment provider, refund it to credit instead")
+	// ErrRefundInProgress makes the webhook retry until the refund is recorded
+	ErrRefundInProgress = errors.New("a refund of the charge is being recorded")
+)
+
+// refundLease is how long a refund made here may take to be recorded.
+const refundLease = time.Minute
+
+// Payment is one attempt to charge for a purpose, reused by submissions of the
+// same purpose until it fails or is used. Unused payments are abandoned.
+type Payment struct {
+	ID             primitive.ObjectID    `json:"id" bson:"_id"`
+	UserID         string                `json:"user_id" bson:"user_id"`
+	SubscriptionID primitive.ObjectID    `json:"subscription_id" bson:"subscription_id"`
+	Purpose        string                `json:"purpose" bson:"purpose"`
+	Attempt        int                   `json:"attempt" bson:"attempt"`
+	Key            string                `json:"-" bson:"key"`
+	CustomerID     string                `json:"-" bson:"customer_id"`
+	PaymentMethod  string                `json:"payment_method" bson:"payment_method"`
+	ChargeID       string                `json:"charge_id" bson:"charge_id"`
+	Amount         Money                 `json:"amount" bson:"amount"`
+	Status         payments.ChargeStatus `json:"status" bson:"status"`
+	FailureReason  string                `json:"failure_reason,omitempty" bson:"failure_reason,omitempty"`
+	NextActionURL  string                `json:"next_action_url,omitempty" bson:"next_action_url,omitempty"`
+	EventIDs       []primitive.ObjectID  `json:"event_ids,omitempty" bson:"event_ids,omitempty"`
+	RefundID       string                `json:"refund_id,omitempty" bson:"refund_id,omitempty"`
+	RefundIDs      []string              `json:"refund_ids,omitempty" bson:"refund_ids,omitempty"`
+	RefundedAmount int64                 `json:"refunded_amount,omitempty" bson:"refunded_amount,omitempty"`
+	DisputedAt     *time.Time            `json:"disputed_at,omitempty" bson:"disputed_at,omitempty"`
+	RefundingUntil *time.Time            `json:"-" bson:"refunding_until,omitempty"`
+	CreatedAt      time.Time             `json:"created_at" bson:"created_at"`
+	UpdatedAt      time.Time             `json:"updated_at" bson:"updated_at"`
+	AppliedAt      *time.Time            `json:"applied_at,omitempty" bson:"applied_at,omitempty"`
+	AbandonedAt    *time.Time            `json:"abandoned_at,omitempty" bson:"abandoned_at,omitempty"`
+}
+
+func (p *Payment) Paid() bool {
+	return p.Status == payments.ChargeSucceeded
+}
+
+// Refunded reports whether the whole charge was given back.
+func (p *Payment) Refunded() bool {
+	return p.Paid() && p.RefundedAmount >= p.Amount.Amount
+}
+
+// reusable reports whether a new submission can use p rather than charge again.
+func (p *Payment) reusable(paymentMethod string, amount Money) bool {
+	return p.AppliedAt == nil && p.AbandonedAt == nil && p.Status != payments.ChargeFailed &&
+		p.PaymentMethod == paymentMethod && p.Amount == amount
+}
+
+// PaymentError.Payment tells the customer what to do next.
+type PaymentError struct {
+	Payment *Payment
+}
+
+func (e *PaymentError) Error() string {
+	switch e.Payment.Status {
+	case payments.ChargeFailed:
+		if e.Payment.FailureReason == "" {
+			return "payment failed"
+		}
+		return "payment failed: " + e.Payment.FailureReason
+	case payments.ChargeRequiresAction:
+		return "payment requires authentication, complete it and submit again"
+	default:
+		return "payment is still processing, submit again once it has settled"
+	}
+}
+
+type PaymentCustomer struct {
+	UserID        string    `json:"user_id" bson:"user_id"`
+	CustomerID    string    `json:"customer_id" bson:"customer_id"`
+	PaymentMethod string    `json:"payment_method,omitempty" bson:"payment_method,omitempty"`
+	UpdatedAt     time.Time `json:"updated_at" bson:"updated_at"`
+}
+
+type PaymentManager struct {
+	collection *mongo.Collection
+	customers  *mongo.Collection
+	provider   payments.Provider
+	invoices   *InvoiceManager
+	credits    *CreditManager
+}
+
+func NewPaymentManager(db *mongo.Database, provider payments.Provider, invoices *InvoiceManager, credits *CreditManager) *PaymentManager {
+	manager := &PaymentManager{
+		collection: db.Collection("payments"),
+		customers:  db.Collection("payment_customers"),
+		provider:   provider,
+		invoices:   invoices,
+		credits:    credits,
+	}
+	manager.createIndexes()
+	return manager
+}
+
+func (m *PaymentManager) createIndexes() {
+	ctx := context.Background()
+	indexModels := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "key", Value: 1}},
+			Options: &options.IndexOptions{Unique: &[]bool{true}[0]},
+		},
+		{Keys: bson.D{{Key: "purpose", Value: 1}, {Key: "attempt", Value: -1}}},
+		{Keys: bson.D{{Key: "charge_id", Value: 1}}},
+		{Keys: bson.D{{Key: "subscription_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	}
+	m.collection.Indexes().CreateMany(ctx, indexModels)
+
+	m.customers.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user_id", Value: 1}},
+		Options: &options.IndexOptions{Unique: &[]bool{true}[0]},
+	})
+}
+
+// SavePaymentMethod sets the method charged on renewals.
+func (m *PaymentManager) SavePaymentMethod(ctx context.Context, userID, paymentMethod string) error {
+	_, err := m.customer(ctx, userID, paymentMethod)
+	return err
+}
+
+// customer creates the user's customer at the provider the first time.
+func (m *PaymentManager) customer(ctx context.Context, userID, paymentMethod string) (*PaymentCustomer, error) {
+	var customer PaymentCustomer
+	err := m.customers.FindOne(ctx, bson.M{"user_id": userID}).Decode(&customer)
+	if err == mongo.ErrNoDocuments {
+		created, err := m.provider.CreateCustomer(ctx, payments.CustomerRequest{Reference: userID})
+		if err != nil {
+			return nil, err
+		}
+		customer = PaymentCustomer{UserID: userID, CustomerID: created.ID}
+	} else if err != nil {
+		return nil, err
+	} else if paymentMethod == "" || paymentMethod == customer.PaymentMethod {
+		return &customer, nil
+	}
+
+	if paymentMethod != "" {
+		customer.PaymentMethod = paymentMethod
+	}
+	customer.UpdatedAt = time.Now()
+	opts := options.Update().SetUpsert(true)
+	if _, err := m.customers.UpdateOne(ctx, bson.M{"user_id": userID}, bson.M{"$set": customer}, opts); err != nil {
+		return nil, err
+	}
+	return &customer, nil
+}
+
+// Collect charges what credit does not cover, reusing the purpose's last payment
+// if it can. The caller must SpendCredit before writing the events, and Apply
+// the payment after.
+func (m *PaymentManager) Collect(ctx context.Context, userID string, subscriptionID primitive.ObjectID, purpose string, events []*SubscriptionEvent, paymentMethod string) (*Payment, error) {
+	if err := m.allocateCredit(ctx, userID, events); err != nil {
+		return nil, err
+	}
+	var amount Money
+	for i, event := range events {
+		due := m.invoices.Due(event)
+		if i == 0 {
+			amount = due
+		} else {
+			amount.Amount += due.Amount
+		}
+	}
+	if amount.Amount <= 0 {
+		return nil, nil
+	}
+
+	customer, err := m.customer(ctx, userID, paymentMethod)
+	if err != nil {
+		return nil, err
+	}
+	if customer.PaymentMethod == "" {
+		return nil, ErrNoPaymentMethod
+	}
+
+	attempt := 1
+	var payment *Payment
+	last, err := m.latest(ctx, purpose)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	if last != nil {
+		if last.reusable(customer.PaymentMethod, amount) {
+			payment = last
+		} else {
+			attempt = last.Attempt + 1
+			if last.AppliedAt == nil && last.AbandonedAt == nil {
+				if err := m.Abandon(ctx, last.ID); err != nil {
+					log.Printf("Failed to abandon payment %s for user %s: %v", last.ID.Hex(), userID, err)
+				}
+			}
+		}
+	}
+	if payment == nil {
+		payment = &Payment{
+			ID:             primitive.NewObjectID(),
+			UserID:         userID,
+			SubscriptionID: subscriptionID,
+			Purpose:        purpose,
+			Attempt:        attempt,
+			Key:            fmt.Sprintf("%s#%d", purpose, attempt),
+			CustomerID:     customer.CustomerID,
+			PaymentMethod:  customer.PaymentMethod,
+			Amount:         amount,
+			CreatedAt:      time.Now(),
+		}
+	}
+
+	charge, err := m.provider.Charge(ctx, payments.ChargeRequest{
+		CustomerID:     payment.CustomerID,
+		PaymentMethod:  payment.PaymentMethod,
+		Amount:         payment.Amount.Amount,
+		Currency:       string(payment.Amount.Currency),
+		Description:    "Subscription " + subscriptionID.Hex(),
+		IdempotencyKey: payment.Key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	payment.ChargeID, payment.Status = charge.ID, charge.Status
+	payment.FailureReason, payment.NextActionURL = charge.FailureReason, charge.NextActionURL
+	payment.UpdatedAt = time.Now()
+
+	// Inserting by key lets concurrent submissions share one attempt
+	update := bson.M{
+		"$set": bson.M{
+			"charge_id":       payment.ChargeID,
+			"status":          payment.Status,
+			"failure_reason":  payment.FailureReason,
+			"next_action_url": payment.NextActionURL,
+			"updated_at":      payment.UpdatedAt,
+		},
+		"$setOnInsert": bson.M{
+			"_id":             payment.ID,
+			"user_id":         payment.UserID,
+			"subscription_id": payment.SubscriptionID,
+			"purpose":         payment.Purpose,
+			"attempt":         payment.Attempt,
+			"customer_id":     payment.CustomerID,
+			"payment_method":  payment.PaymentMethod,
+			"amount":          payment.Amount,
+			"created_at":      payment.CreatedAt,
+		},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var stored Payment
+	if err := m.collection.FindOneAndUpdate(ctx, bson.M{"key": payment.Key}, update, opts).Decode(&stored); err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// allocateCredit sets each event's CreditApplied.
+func (m *PaymentManager) allocateCredit(ctx context.Context, userID string, events []*SubscriptionEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	for _, event := range events {
+		event.CreditApplied = nil
+	}
+	balance, err := m.credits.Balance(ctx, userID, events[0].Price.Currency)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		if balance.Amount <= 0 {
+			break
+		}
+		applied := NewMoney(min(balance.Amount, m.invoices.Due(event).Amount), balance.Currency)
+		if applied.Amount > 0 {
+			event.CreditApplied = &applied
+			balance.Amount -= applied.Amount
+		}
+	}
+	return nil
+}
+
+// SpendCredit fails with ErrConcurrentUpdate if the balance changed.
+func (m *PaymentManager) SpendCredit(ctx context.Context, userID string, events []*SubscriptionEvent) error {
+	err := m.credits.spend(ctx, userID, events)
+	if err == ErrInsufficientCredit {
+		return ErrConcurrentUpdate
+	}
+	return err
+}
+
+func (m *PaymentManager) ReturnCredit(ctx context.Context, userID string, events []*SubscriptionEvent) {
+	for _, event := range events {
+		if event.CreditApplied == nil {
+			continue
+		}
+		if err := m.credits.giveBack(ctx, userID, *event.CreditApplied, event.ID, nil); err != nil {
+			log.Printf("Failed to give back credit for user %s: %v", userID, err)
+		}
+	}
+}
+
+// PricedAt lets a purchase submitted again be priced as it was charged.
+func (m *PaymentManager) PricedAt(ctx context.Context, purpose string) *time.Time {
+	last, err := m.latest(ctx, purpose)
+	if err != nil || last.AppliedAt != nil || last.AbandonedAt != nil || last.Status == payments.ChargeFailed {
+		return nil
+	}
+	return &last.CreatedAt
+}
+
+func (m *PaymentManager) latest(ctx context.Context, purpose string) (*Payment, error) {
+	opts := options.FindOne().SetSort(bson.D{{Key: "attempt", Value: -1}})
+	var payment Payment
+	if err := m.collection.FindOne(ctx, bson.M{"purpose": purpose}, opts).Decode(&payment); err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+// OwnerOfCharge looks up the user a provider charge was made for.
+func (m *PaymentManager) OwnerOfCharge(ctx context.Context, chargeID string) (string, error) {
+	var payment Payment
+	opts := options.FindOne().SetProjection(bson.M{"user_id": 1})
+	if err := m.collection.FindOne(ctx, bson.M{"charge_id": chargeID}, opts).Decode(&payment); err != nil {
+		return "", err
+	}
+	return payment.UserID, nil
+}
+
+func (m *PaymentManager) GetByID(ctx context.Context, id primitive.ObjectID) (*Payment, error) {
+	var payment Payment
+	if err := m.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&payment); err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+// Apply also abandons older unused payments for the subscription.
+func (m *PaymentManager) Apply(ctx context.Context, payment *Payment, events []*SubscriptionEvent) (*Payment, error) {
+	eventIDs := make([]primitive.ObjectID, len(events))
+	for i, event := range events {
+		eventIDs[i] = event.ID
+	}
+
+	// A payment reused after losing a race was charged under another subscription ID
+	filter := bson.M{"_id": payment.ID, "applied_at": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"applied_at": time.Now(), "event_ids": eventIDs, "subscription_id": events[0].SubscriptionID}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var applied Payment
+	if err := m.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&applied); err != nil {
+		return nil, err
+	}
+
+	var err error
+	switch applied.Status {
+	case payments.ChargeSucceeded:
+		err = m.invoices.PayEvents(ctx, eventIDs)
+	case payments.ChargeFailed:
+		err = m.invoices.VoidEvents(ctx, eventIDs)
+	}
+	if err != nil {
+		log.Printf("Failed to update invoices paid by payment %s: %v", applied.ID.Hex(), err)
+	}
+
+	stale := bson.M{
+		"subscription_id": applied.SubscriptionID,
+		"_id":             bson.M{"$ne": applied.ID},
+		"created_at":      bson.M{"$lte": applied.CreatedAt},
+		"applied_at":      bson.M{"$exists": false},
+		"abandoned_at":    bson.M{"$exists": false},
+	}
+	if _, err := m.abandonAll(ctx, stale, 0); err != nil {
+		log.Printf("Failed to abandon stale payments for subscription %s: %v", applied.SubscriptionID.Hex(), err)
+	}
+	return &applied, nil
+}
+
+// Settle returns nil for events already recorded and charges made elsewhere.
+func (m *PaymentManager) Settle(ctx context.Context, event *payments.Event) (*Payment, error) {
+	switch event.Type {
+	case payments.EventChargeSucceeded:
+		return m.settle(ctx, event.ChargeID, payments.ChargeSucceeded, "")
+	case payments.EventChargeFailed:
+		return m.settle(ctx, event.ChargeID, payments.ChargeFailed, event.FailureReason)
+	case payments.EventChargeRefunded:
+		if event.RefundID == "" {
+			return nil, errors.New("refund event without a refund id")
+		}
+		refunding := bson.M{
+			"charge_id":       event.ChargeID,
+			"refund_ids":      bson.M{"$ne": event.RefundID},
+			"refunding_until": bson.M{"$gt": time.Now()},
+		}
+		if count, err := m.collection.CountDocuments(ctx, refunding); err != nil || count > 0 {
+			if err == nil {
+				err = ErrRefundInProgress
+			}
+			return nil, err
+		}
+		return m.recordRefund(ctx, event.ChargeID, event.RefundID, event.Amount)
+	case payments.EventChargeDisputed:
+		filter := bson.M{"charge_id": event.ChargeID, "disputed_at": bson.M{"$exists": false}}
+		now := time.Now()
+		update := bson.M{"$set": bson.M{"disputed_at": now, "updated_at": now}}
+		return m.record(ctx, filter, update)
+	default:
+		return nil, nil
+	}
+}
+
+func (m *PaymentManager) recordRefund(ctx context.Context, chargeID, refundID string, amount int64) (*Payment, error) {
+	filter := bson.M{"charge_id": chargeID, "refund_ids": bson.M{"$ne": refundID}}
+	update := bson.M{
+		"$push": bson.M{"refund_ids": refundID},
+		"$inc":  bson.M{"refunded_amount": amount},
+		"$set":  bson.M{"updated_at": time.Now()},
+	}
+	return m.record(ctx, filter, update)
+}
+
+func (m *PaymentManager) record(ctx context.Context, filter, update bson.M) (*Payment, error) {
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var payment Payment
+	err := m.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&payment)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+// lastApplied is the payment for the current period.
+func (m *PaymentManager) lastApplied(ctx context.Context, subscriptionID primitive.ObjectID) (*Payment, error) {
+	filter := bson.M{"subscription_id": subscriptionID, "applied_at": bson.M{"$exists": true}}
+	opts := options.FindOne().SetSort(bson.D{{Key: "applied_at", Value: -1}})
+	var payment Payment
+	if err := m.collection.FindOne(ctx, filter, opts).Decode(&payment); err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+func (m *PaymentManager) Refresh(ctx context.Context, id primitive.ObjectID) (*Payment, error) {
+	payment, err := m.GetByID(ctx, id)
+	if err != nil || payment.Paid() || payment.Status == payments.ChargeFailed {
+		return payment, err
+	}
+
+	charge, err := m.provider.Charge(ctx, payments.ChargeRequest{
+		CustomerID:     payment.CustomerID,
+		PaymentMethod:  payment.PaymentMethod,
+		Amount:         payment.Amount.Amount,
+		Currency:       string(payment.Amount.Currency),
+		IdempotencyKey: payment.Key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if charge.Status != payments.ChargeSucceeded && charge.Status != payments.ChargeFailed {
+		return payment, nil
+	}
+	if settled, err := m.settle(ctx, payment.ChargeID, charge.Status, charge.FailureReason); err != nil || settled != nil {
+		return settled, err
+	}
+	return m.GetByID(ctx, id)
+}
+
+// settle refunds an abandoned payment that went through.
+func (m *PaymentManager) settle(ctx context.Context, chargeID string, status payments.ChargeStatus, failureReason string) (*Payment, error) {
+	filter := bson.M{
+		"charge_id": chargeID,
+		"status":    bson.M{"$in": []payments.ChargeStatus{payments.ChargePending, payments.ChargeRequiresAction}},
+	}
+	update := bson.M{
+		"$set":   bson.M{"status": status, "failure_reason": failureReason, "updated_at": time.Now()},
+		"$unset": bson.M{"next_action_url": ""},
+	}
+	payment, err := m.record(ctx, filter, update)
+	if err != nil || payment == nil {
+		return nil, err
+	}
+
+	switch {
+	case payment.AbandonedAt != nil:
+		if payment.Paid() {
+			err = m.refund(ctx, payment)
+		}
+	case payment.AppliedAt != nil:
+		if payment.Paid() {
+			err = m.invoices.PayEvents(ctx, payment.EventIDs)
+		} else {
+			err = m.invoices.VoidEvents(ctx, payment.EventIDs)
+		}
+	}
+	return payment, err
+}
+
+// Abandon voids the invoices and refunds the charge if it went through, even later.
+func (m *PaymentManager) Abandon(ctx context.Context, id primitive.ObjectID) error {
+	filter := bson.M{"_id": id, "abandoned_at": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"abandoned_at": time.Now()}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var payment Payment
+	err := m.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&payment)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := m.invoices.VoidEvents(ctx, payment.EventIDs); err != nil {
+		return err
+	}
+	if payment.Paid() {
+		return m.refund(ctx, &payment)
+	}
+	return nil
+}
+
+func (m *PaymentManager) AbandonStaleDue(ctx context.Context, now time.Time, limit int) (int, error) {
+	due := bson.M{
+		"created_at":   bson.M{"$lt": now.Add(-IncompleteTimeout)},
+		"status":       bson.M{"$ne": payments.ChargeFailed},
+		"applied_at":   bson.M{"$exists": false},
+		"abandoned_at": bson.M{"$exists": false},
+	}
+	return m.abandonAll(ctx, due, limit)
+}
+
+func (m *PaymentManager) abandonAll(ctx context.Context, filter bson.M, limit int) (int, error) {
+	opts := options.Find().SetProjection(bson.M{"_id": 1, "user_id": 1})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	cursor, err := m.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return 0, err
+	}
+	var stale []Payment
+	if err := cursor.All(ctx, &stale); err != nil {
+		return 0, err
+	}
+
+	done := 0
+	for _, payment := range stale {
+		if err := m.Abandon(ctx, payment.ID); err != nil {
+			log.Printf("Failed to abandon payment %s for user %s: %v", payment.ID.Hex(), payment.UserID, err)
+			continue
+		}
+		done++
+	}
+	return done, nil
+}
+
+// The idempotency key makes repeated refunds of the same payment safe.
+func (m *PaymentManager) refund(ctx context.Context, payment *Payment) error {
+	refundID, err := m.refundCharge(ctx, payment, payment.Amount.Amount, "refund:"+payment.Key, "unused")
+	if err != nil {
+		return err
+	}
+	_, err = m.collection.UpdateOne(ctx, bson.M{"_id": payment.ID}, bson.M{"$set": bson.M{"refund_id": refundID}})
+	return err
+}
+
+// Webhooks about the refund wait until it is recorded.
+func (m *PaymentManager) refundCharge(ctx context.Context, payment *Payment, amount int64, key, reason string) (string, error) {
+	lease := bson.M{"$set": bson.M{"refunding_until": time.Now().Add(refundLease)}}
+	if _, err := m.collection.UpdateOne(ctx, bson.M{"_id": payment.ID}, lease); err != nil {
+		return "", err
+	}
+	defer func() {
+		release := bson.M{"$unset": bson.M{"refunding_until": ""}}
+		if _, err := m.collection.UpdateOne(ctx, bson.M{"_id": payment.ID}, release); err != nil {
+			log.Printf("Failed to release refund lease of payment %s: %v", payment.ID.Hex(), err)
+		}
+	}()
+
+	refund, err := m.provider.Refund(ctx, payments.RefundRequest{
+		ChargeID:       payment.ChargeID,
+		Amount:         amount,
+		Reason:         reason,
+		IdempotencyKey: key,
+	})
+	if err != nil {
+		return "", err
+	}
+	if _, err := m.recordRefund(ctx, payment.ChargeID, refund.ID, refund.Amount); err != nil {
+		return "", err
+	}
+	return refund.ID, nil
+}
+
+// RefundInvoice records the refund on the invoice first, so concurrent refunds
+// cannot give back more than was paid. Credit spent can only go back to credit.
+func (m *PaymentManager) RefundInvoice(ctx context.Context, invoiceID primitive.ObjectID, req *RefundInvoiceRequest, actor *Actor) (*Invoice, error) {
+	invoice, err := m.invoices.GetByID(ctx, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	if invoice.Status != InvoicePaid {
+		return nil, fmt.Errorf("%w: only paid invoices can be refunded, this one is %s", ErrInvoiceStatus, invoice.Status)
+	}
+
+	to := req.To
+	if to == "" {
+		to = RefundToPayment
+	}
+	var payment *Payment
+	if to == RefundToPayment {
+		filter := bson.M{"event_ids": invoice.EventID, "applied_at": bson.M{"$exists": true}, "status": payments.ChargeSucceeded}
+		var paid Payment
+		err := m.collection.FindOne(ctx, filter).Decode(&paid)
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNotPaidByPayment
+		}
+		if err != nil {
+			return nil, err
+		}
+		payment = &paid
+	}
+
+	limit := invoice.refundable(to)
+	amount := req.Amount
+	if amount == 0 {
+		amount = limit
+	}
+	if amount <= 0 || amount > limit {
+		return nil, fmt.Errorf("%w: at most %s can be refunded to the %s", ErrInvalidRefund, NewMoney(limit, invoice.Currency), to)
+	}
+
+	refund := &InvoiceRefund{
+		ID:        primitive.NewObjectID(),
+		Amount:    NewMoney(amount, invoice.Currency),
+		To:        to,
+		Reason:    req.Reason,
+		Actor:     actor,
+		CreatedAt: time.Now(),
+	}
+	updated, err := m.invoices.addRefund(ctx, invoice, refund)
+	if err != nil {
+		return nil, err
+	}
+
+	if to == RefundToCredit {
+		transaction := &CreditTransaction{
+			UserID:    invoice.UserID,
+			Type:      CreditRefund,
+			Amount:    refund.Amount,
+			Reason:    req.Reason,
+			Key:       "refund:" + refund.ID.Hex(),
+			InvoiceID: &invoice.ID,
+			Actor:     actor,
+		}
+		if _, err = m.credits.add(ctx, transaction); err != nil {
+			m.undoRefund(ctx, invoice, refund)
+			return nil, err
+		}
+		return updated, nil
+	}
+
+	providerRefundID, err := m.refundCharge(ctx, payment, amount, "invoice-refund:"+refund.ID.Hex(), req.Reason)
+	if err != nil {
+		m.undoRefund(ctx, invoice, refund)
+		return nil, err
+	}
+	if err := m.invoices.setProviderRefundID(ctx, invoice.ID, refund.ID, providerRefundID); err != nil {
+		log.Printf("Failed to record provider refund %s on invoice %s: %v", providerRefundID, invoice.ID.Hex(), err)
+	}
+	return m.invoices.GetByID(ctx, invoice.ID)
+}
+
+func (m *PaymentManager) undoRefund(ctx context.Context, invoice *Invoice, refund *InvoiceRefund) {
+	if err := m.invoices.removeRefund(ctx, invoice, refund); err != nil {
+		log.Printf("Failed to take back refund %s of invoice %s: %v", refund.ID.Hex(), invoice.ID.Hex(), err)
+	}
+}
+
+// purchasePurpose ties changes to a running subscription to its current period.
+func purchasePurpose(userID string, previous *Subscription, plan *Plan, currency Currency, quantity int, addOns []AddOnItem, total Money, discount *Discount) string {
+	key := fmt.Sprintf("%s|%s|%s|%d|%s|%d|%v|%v", userID, plan.Line(), plan.ID.Hex(), plan.Version, currency, quantity, addOns, total)
+	if discount != nil {
+		key += "|" + discount.CouponID.Hex()
+	}
+	if previous != nil && previous.Status.HasAccess() {
+		key += fmt.Sprintf("|%s|%d", previous.PlanID.Hex(), previous.StartDate.Unix())
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "purchase:" + hex.EncodeToString(sum[:16])
+}
+
+func renewalPurpose(subscription *Subscription) string {
+	return fmt.Sprintf("renewal:%s:%d", subscription.ID.Hex(), subscription.ExpiresAt.Unix())
+}
+
+// HandlePaymentEvent activates or renews subscriptions waiting for a charge, and
+// cancels the current period's on a dispute or a full refund made elsewhere.
+func (m *SubscriptionManager) HandlePaymentEvent(ctx context.Context, event *payments.Event) error {
+	payment, err := m.payments.Settle(ctx, event)
+	if err != nil || payment == nil || payment.AbandonedAt != nil {
+		return err
+	}
+	switch event.Type {
+	case payments.EventChargeRefunded:
+		if !payment.Refunded() {
+			return nil
+		}
+		return m.revoke(ctx, payment, EventRefunded)
+	case payments.EventChargeDisputed:
+		return m.revoke(ctx, payment, EventDisputed)
+	}
+	if !payment.Paid() {
+		return nil
+	}
+
+	subscription, err := m.findOne(ctx, bson.M{"_id": payment.SubscriptionID})
+	if err != nil {
+		return err
+	}
+	switch {
+	case subscription.Status == StatusIncomplete && subscription.PaymentID != nil && *subscription.PaymentID == payment.ID:
+		err = m.activate(ctx, subscription, nil)
+	case payment.AppliedAt == nil && payment.Purpose == renewalPurpose(subscription) && (subscription.inPeriod() || subscription.Status == StatusPastDue):
+		_, err = m.renew(ctx, subscription, time.Now())
+	}
+	if err == ErrConcurrentUpdate {
+		return nil
+	}
+	return err
+}
+
+// revoke only cancels if the payment paid for the current period.
+func (m *SubscriptionManager) revoke(ctx context.Context, payment *Payment, eventType SubscriptionEventType) error {
+	if payment.AppliedAt == nil {
+		return nil
+	}
+	subscription, err := m.findOne(ctx, bson.M{"_id": payment.SubscriptionID})
+	if err != nil {
+		return err
+	}
+	if !CanTransition(subscription.Status, StatusCancelled) {
+		return nil
+	}
+	current, err := m.payments.lastApplied(ctx, subscription.ID)
+	if err != nil || current.ID != payment.ID {
+		return err
+	}
+
+	err = m.cancelNow(ctx, subscription, eventType, nil)
+	if err == ErrConcurrentUpdate {
+		return nil
+	}
+	return err
+}
+
+func (m *SubscriptionManager) activate(ctx context.Context, subscription *Subscription, actor *Actor) error {
+	guard := bson.M{"payment_id": subscription.PaymentID}
+	update := bson.M{"$unset": bson.M{"payment_id": ""}}
+	subscription.PaymentID = nil
+	return m.transition(ctx, subscription, StatusActive, EventActivated, guard, update, actor)
+}
+
+func (m *SubscriptionManager) ExpireIncompleteDue(ctx context.Context, now time.Time, limit int) (int, error) {
+	due := bson.M{"status": StatusIncomplete, "start_date": bson.M{"$lt": now.Add(-IncompleteTimeout)}}
+	return m.eachDue(ctx, due, limit, "expire incomplete", func(subscription *Subscription) error {
+		paymentID := subscription.PaymentID
+		guard := bson.M{"payment_id": paymentID}
+		update := bson.M{"$unset": bson.M{"payment_id": ""}}
+		subscription.PaymentID = nil
+		if err := m.transition(ctx, subscription, StatusExpired, EventExpired, guard, update, nil); err != nil {
+			return err
+		}
+		m.abandonPayment(ctx, subscription, paymentID)
+		return nil
+	})
+}
+
+// applyPayment logs failures, like the other steps after a write.
+func (m *SubscriptionManager) applyPayment(ctx context.Context, payment *Payment, events []*SubscriptionEvent) *Payment {
+	applied, err := m.payments.Apply(ctx, payment, events)
+	if err != nil {
+		log.Printf("Failed to apply payment %s for user %s: %v", payment.ID.Hex(), payment.UserID, err)
+		return payment
+	}
+	return applied
+}
+
+// abandonPayment abandons the payment a subscription no longer waits for.
+func (m *SubscriptionManager) abandonPayment(ctx context.Context, subscription *Subscription, paymentID *primitive.ObjectID) {
+	if paymentID == nil {
+		return
+	}
+	if err := m.payments.Abandon(ctx, *paymentID); err != nil {
+		log.Printf("Failed to abandon payment %s for user %s: %v", paymentID.Hex(), subscription.UserID, err)
+	}
+}
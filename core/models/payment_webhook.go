@@ -0,0 +1,212 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"subservice/core/payments"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// webhookLease is how long one delivery has before another may try
+	webhookLease       = time.Minute
+	webhookMaxAttempts = 5
+)
+
+var ErrInvalidWebhook = errors.New("invalid webhook")
+
+// WebhookEvent is unique by event_id, so each event is handled once.
+type WebhookEvent struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id"`
+	EventID     string             `json:"event_id" bson:"event_id"`
+	Event       payments.Event     `json:"event" bson:"event"`
+	Payload     string             `json:"-" bson:"payload"`
+	ReceivedAt  time.Time          `json:"received_at" bson:"received_at"`
+	Attempts    int                `json:"attempts" bson:"attempts"`
+	LockedUntil *time.Time         `json:"-" bson:"locked_until,omitempty"`
+	ProcessedAt *time.Time         `json:"processed_at,omitempty" bson:"processed_at,omitempty"`
+	Error       string             `json:"error,omitempty" bson:"error,omitempty"`
+	// FailedAt is set once the event ran out of attempts; only a redelivery retries it
+	FailedAt  *time.Time `json:"failed_at,omitempty" bson:"failed_at,omitempty"`
+	Duplicate bool       `json:"duplicate,omitempty" bson:"-"`
+}
+
+type WebhookManager struct {
+	collection *mongo.Collection
+	provider   payments.Provider
+	handle     func(ctx context.Context, event *payments.Event) error
+}
+
+func NewWebhookManager(db *mongo.Database, provider payments.Provider, handle func(ctx context.Context, event *payments.Event) error) *WebhookManager {
+	manager := &WebhookManager{
+		collection: db.Collection("payment_webhook_events"),
+		provider:   provider,
+		handle:     handle,
+	}
+	manager.createIndexes()
+	return manager
+}
+
+func (m *WebhookManager) createIndexes() {
+	ctx := context.Background()
+	indexModels := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "event_id", Value: 1}},
+			Options: &options.IndexOptions{Unique: &[]bool{true}[0]},
+		},
+		{Keys: bson.D{{Key: "processed_at", Value: 1}, {Key: "received_at", Value: 1}}},
+	}
+	m.collection.Indexes().CreateMany(ctx, indexModels)
+}
+
+// Receive handles an event again only if its handling failed before.
+func (m *WebhookManager) Receive(ctx context.Context, payload []byte, signature string) (*WebhookEvent, error) {
+	event, err := m.provider.VerifyWebhook(payload, signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidWebhook, err)
+	}
+
+	received := &WebhookEvent{
+		ID:         primitive.NewObjectID(),
+		EventID:    event.ID,
+		Event:      *event,
+		Payload:    string(payload),
+		ReceivedAt: time.Now(),
+	}
+	_, err = m.collection.InsertOne(ctx, received)
+	if mongo.IsDuplicateKeyError(err) {
+		if err := m.collection.FindOne(ctx, bson.M{"event_id": event.ID}).Decode(received); err != nil {
+			return nil, err
+		}
+		if received.ProcessedAt != nil {
+			received.Duplicate = true
+			return received, nil
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return received, m.process(ctx, received, time.Now())
+}
+
+// process skips events another delivery is handling.
+func (m *WebhookManager) process(ctx context.Context, event *WebhookEvent, now time.Time) error {
+	filter := bson.M{
+		"_id":          event.ID,
+		"processed_at": bson.M{"$exists": false},
+		"$or": bson.A{
+			bson.M{"locked_until": bson.M{"$exists": false}},
+			bson.M{"locked_until": bson.M{"$lt": now}},
+		},
+	}
+	claim := bson.M{"$set": bson.M{"locked_until": now.Add(webhookLease)}, "$inc": bson.M{"attempts": 1}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := m.collection.FindOneAndUpdate(ctx, filter, claim, opts).Decode(event)
+	if err == mongo.ErrNoDocuments {
+		event.Duplicate = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	handleErr := m.handle(ctx, &event.Event)
+	update := bson.M{"$unset": bson.M{"locked_until": ""}}
+	event.LockedUntil = nil
+	if handleErr != nil {
+		event.Error = handleErr.Error()
+		set := bson.M{"error": event.Error}
+		if event.Attempts >= webhookMaxAttempts {
+			failedAt := time.Now()
+			event.FailedAt = &failedAt
+			set["failed_at"] = failedAt
+			log.Printf("Payment webhook %s failed for good after %d attempts: %v", event.EventID, event.Attempts, handleErr)
+		}
+		update["$set"] = set
+	} else {
+		processedAt := time.Now()
+		event.ProcessedAt, event.Error, event.FailedAt = &processedAt, "", nil
+		update["$set"] = bson.M{"processed_at": processedAt}
+		update["$unset"] = bson.M{"locked_until": "", "error": "", "failed_at": ""}
+	}
+	if _, err := m.collection.UpdateOne(ctx, bson.M{"_id": event.ID}, update); err != nil {
+		log.Printf("Failed to record outcome of payment webhook %s: %v", event.EventID, err)
+	}
+	return handleErr
+}
+
+// ListFailed lists the events that ran out of attempts, newest first.
+func (m *WebhookManager) ListFailed(ctx context.Context) ([]WebhookEvent, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "failed_at", Value: -1}})
+	cursor, err := m.collection.Find(ctx, bson.M{"failed_at": bson.M{"$exists": true}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	events := []WebhookEvent{}
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (m *WebhookManager) RetryDue(ctx context.Context, now time.Time, limit int) (int, error) {
+	due := bson.M{
+		"processed_at": bson.M{"$exists": false},
+		"failed_at":    bson.M{"$exists": false},
+		"received_at":  bson.M{"$lt": now.Add(-webhookLease)},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "received_at", Value: 1}}).SetLimit(int64(limit))
+	cursor, err := m.collection.Find(ctx, due, opts)
+	if err != nil {
+		return 0, err
+	}
+	var events []WebhookEvent
+	if err := cursor.All(ctx, &events); err != nil {
+		return 0, err
+	}
+
+	done := 0
+	for i := range events {
+		event := &events[i]
+		if event.Attempts >= webhookMaxAttempts {
+			m.fail(ctx, event, now)
+			continue
+		}
+		if err := m.process(ctx, event, now); err != nil {
+			log.Printf("Failed to handle payment webhook %s: %v", event.EventID, err)
+			continue
+		}
+		if !event.Duplicate {
+			done++
+		}
+	}
+	return done, nil
+}
+
+// fail marks an event whose attempts ran out without its outcome being recorded.
+func (m *WebhookManager) fail(ctx context.Context, event *WebhookEvent, now time.Time) {
+	filter := bson.M{
+		"_id":          event.ID,
+		"processed_at": bson.M{"$exists": false},
+		"$or": bson.A{
+			bson.M{"locked_until": bson.M{"$exists": false}},
+			bson.M{"locked_until": bson.M{"$lt": now}},
+		},
+	}
+	result, err := m.collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"failed_at": now}})
+	if err != nil {
+		log.Printf("Failed to mark payment webhook %s failed: %v", event.EventID, err)
+		return
+	}
+	if result.ModifiedCount > 0 {
+		log.Printf("Payment webhook %s failed for good after %d attempts: %s", event.EventID, event.Attempts, event.Error)
+	}
+}
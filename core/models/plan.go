@@ -2,38 +2,153 @@ package models
 
 import (
 	"context"
+	"errors"
+	"log"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type Plan struct {
-	ID       primitive.ObjectID `json:"id" bson:"_id,omitempty"`
-	Name     string             `json:"name" bson:"name" validate:"required"`
-	Price    float64            `json:"price" bson:"price" validate:"required,min=0"`
-	Features []string           `json:"features" bson:"features" validate:"required"`
-	Duration string             `json:"duration" bson:"duration" validate:"required,oneof=monthly yearly"`
+	ID           primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name         string             `json:"name" bson:"name" validate:"required"`
+	Prices       []PricePoint       `json:"prices" bson:"prices" validate:"required,min=1,dive"`
+	Features     []string           `json:"features" bson:"features" validate:"required"`
+	Duration     string             `json:"duration" bson:"duration" validate:"required,oneof=monthly yearly"`
+	Family       string             `json:"family,omitempty" bson:"family,omitempty"`
+	TrialDays    int                `json:"trial_days" bson:"trial_days" validate:"min=0"`
+	MaxPauseDays int                `json:"max_pause_days" bson:"max_pause_days" validate:"min=0"`
+	GraceDays    int                `json:"grace_days" bson:"grace_days" validate:"min=0"`
+	ProductLine  string             `json:"product_line,omitempty" bson:"product_line,omitempty"`
+	PricingMode  PricingMode        `json:"pricing_mode,omitempty" bson:"pricing_mode,omitempty" validate:"omitempty,oneof=flat per_unit graduated volume"`
+	MinQuantity  int                `json:"min_quantity,omitempty" bson:"min_quantity,omitempty" validate:"min=0"`
+	MaxQuantity  int                `json:"max_quantity,omitempty" bson:"max_quantity,omitempty" validate:"omitempty,gtefield=MinQuantity"`
+	AddOns       []AddOn            `json:"add_ons,omitempty" bson:"add_ons,omitempty" validate:"dive"`
+	// Version is the latest published version, see PlanVersion
+	Version int `json:"version" bson:"version"`
+	// ArchivedAt is set while the plan is withdrawn from sale
+	ArchivedAt *time.Time `json:"archived_at,omitempty" bson:"archived_at,omitempty"`
+	// Features remain the text shown to customers
+	Entitlements []Entitlement `json:"entitlements,omitempty" bson:"entitlements,omitempty" validate:"omitempty,unique=Key,dive"`
+}
+
+var ErrPlanArchived = errors.New("plan is archived and no longer sold")
+
+// DefaultProductLine is the product line of plans that do not name one.
+const DefaultProductLine = "core"
+
+// Line returns the plan's product line. A user holds at most one subscription
+// per line, so plans in different lines, such as add-ons, can be combined.
+func (p *Plan) Line() string {
+	if p.ProductLine != "" {
+		return p.ProductLine
+	}
+	return DefaultProductLine
+}
+
+// CanPause reports whether subscriptions to this plan may be paused.
+func (p *Plan) CanPause() bool {
+	return p.MaxPauseDays > 0
+}
+
+// TrialKey identifies the trial this plan uses up. Plans in a family share one.
+func (p *Plan) TrialKey() string {
+	if p.Family != "" {
+		return "family:" + p.Family
+	}
+	return "plan:" + p.ID.Hex()
+}
+
+// PeriodEnd returns when a billing period of this plan starting at start ends.
+func (p *Plan) PeriodEnd(start time.Time) (time.Time, error) {
+	switch p.Duration {
+	case "monthly":
+		return start.AddDate(0, 1, 0), nil
+	case "yearly":
+		return start.AddDate(1, 0, 0), nil
+	default:
+		return time.Time{}, errors.New("invalid plan duration")
+	}
+}
+
+// GraceEnd returns when a subscription whose period ended at expiresAt loses access.
+func (p *Plan) GraceEnd(expiresAt time.Time) time.Time {
+	return expiresAt.AddDate(0, 0, p.GraceDays)
 }
 
 type PlanManager struct {
 	collection *mongo.Collection
+	versions   *mongo.Collection
 }
 
 func NewPlanManager(db *mongo.Database) *PlanManager {
-	return &PlanManager{
+	manager := &PlanManager{
 		collection: db.Collection("plans"),
+		versions:   db.Collection("plan_versions"),
 	}
+	manager.migratePrices()
+	manager.createVersionIndexes()
+	manager.backfillVersions()
+	return manager
 }
 
+// migratePrices converts float64 rupee amounts to a single INR price point.
+func (m *PlanManager) migratePrices() {
+	ctx := context.Background()
+	legacy := bson.M{"prices": bson.M{"$exists": false}}
+	tiers := bson.M{"$map": bson.M{
+		"input": bson.M{"$ifNull": bson.A{"$tiers", bson.A{}}},
+		"in": bson.M{
+			"up_to":      "$$this.up_to",
+			"unit_price": legacyMinorUnits("$$this.unit_price"),
+			"flat_fee":   legacyMinorUnits(bson.M{"$ifNull": bson.A{"$$this.flat_fee", 0}}),
+		},
+	}}
+	addOns := bson.M{"$map": bson.M{
+		"input": bson.M{"$ifNull": bson.A{"$add_ons", bson.A{}}},
+		"in": bson.M{
+			"code":   "$$this.code",
+			"name":   "$$this.name",
+			"prices": bson.A{legacyMoney("$$this.price")},
+		},
+	}}
+	pipeline := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"prices": bson.A{bson.M{
+				"currency": DefaultCurrency,
+				"amount":   legacyMinorUnits(bson.M{"$ifNull": bson.A{"$price", 0}}),
+				"tiers":    tiers,
+			}},
+			"add_ons": addOns,
+		}}},
+		{{Key: "$unset", Value: bson.A{"price", "tiers"}}},
+	}
+	if _, err := m.collection.UpdateMany(ctx, legacy, pipeline); err != nil {
+		log.Printf("Failed to migrate plan prices: %v", err)
+	}
+}
+
+// Create inserts plan as version 1 of a new plan.
 func (m *PlanManager) Create(ctx context.Context, plan *Plan) error {
 	plan.ID = primitive.NewObjectID()
+	plan.Version = 1
+	plan.ArchivedAt = nil
+	if err := m.insertVersion(ctx, plan); err != nil {
+		return err
+	}
 	_, err := m.collection.InsertOne(ctx, plan)
 	return err
 }
 
-func (m *PlanManager) GetAll(ctx context.Context) ([]Plan, error) {
-	cursor, err := m.collection.Find(ctx, bson.M{})
+func (m *PlanManager) GetAll(ctx context.Context, includeArchived bool) ([]Plan, error) {
+	filter := bson.M{"archived_at": bson.M{"$exists": false}}
+	if includeArchived {
+		filter = bson.M{}
+	}
+	cursor, err := m.collection.Find(ctx, filter)
 	if err != nil {
 		return nil, err
 	}
@@ -50,12 +165,46 @@ func (m *PlanManager) GetByID(ctx context.Context, id primitive.ObjectID) (*Plan
 	return &plan, err
 }
 
-func (m *PlanManager) Update(ctx context.Context, id primitive.ObjectID, plan *Plan) error {
-	_, err := m.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": plan})
-	return err
+func (m *PlanManager) GracePlanIDs(ctx context.Context) ([]primitive.ObjectID, error) {
+	values, err := m.versions.Distinct(ctx, "plan_id", bson.M{"plan.grace_days": bson.M{"$gt": 0}})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(values))
+	for _, value := range values {
+		if id, ok := value.(primitive.ObjectID); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
 }
 
-func (m *PlanManager) Delete(ctx context.Context, id primitive.ObjectID) error {
-	_, err := m.collection.DeleteOne(ctx, bson.M{"_id": id})
-	return err
+// Archive withdraws a plan from sale. Its subscribers keep it.
+func (m *PlanManager) Archive(ctx context.Context, id primitive.ObjectID) (*Plan, error) {
+	return m.update(ctx, id, bson.M{"$set": bson.M{"archived_at": time.Now()}})
+}
+
+// Unarchive puts an archived plan back on sale.
+func (m *PlanManager) Unarchive(ctx context.Context, id primitive.ObjectID) (*Plan, error) {
+	return m.update(ctx, id, bson.M{"$unset": bson.M{"archived_at": ""}})
+}
+
+func (m *PlanManager) update(ctx context.Context, id primitive.ObjectID, update bson.M) (*Plan, error) {
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var plan Plan
+	err := m.collection.FindOneAndUpdate(ctx, bson.M{"_id": id}, update, opts).Decode(&plan)
+	return &plan, err
+}
+
+// deleteArchived keeps the published versions for the subscriptions that were on it.
+func (m *PlanManager) deleteArchived(ctx context.Context, id primitive.ObjectID, archivedAt time.Time) error {
+	result, err := m.collection.DeleteOne(ctx, bson.M{"_id": id, "archived_at": archivedAt})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrPlanChanged
+	}
+	return nil
 }
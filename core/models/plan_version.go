@@ -0,0 +1,165 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrPlanChanged = errors.New("plan was changed by another request, reload it and try again")
+
+// PlanVersion is an immutable snapshot of a plan, which subscriptions pin.
+type PlanVersion struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	PlanID      primitive.ObjectID `json:"plan_id" bson:"plan_id"`
+	Version     int                `json:"version" bson:"version"`
+	Plan        Plan               `json:"plan" bson:"plan"`
+	MigrateTo   int                `json:"migrate_to,omitempty" bson:"migrate_to,omitempty"`
+	PublishedAt time.Time          `json:"published_at" bson:"published_at"`
+}
+
+type PublishPlanRequest struct {
+	Plan
+	MigrateSubscribers bool `json:"migrate_subscribers" bson:"-"`
+}
+
+func (m *PlanManager) createVersionIndexes() {
+	ctx := context.Background()
+	indexModel := mongo.IndexModel{
+		Keys:    bson.D{{Key: "plan_id", Value: 1}, {Key: "version", Value: 1}},
+		Options: &options.IndexOptions{Unique: &[]bool{true}[0]},
+	}
+	m.versions.Indexes().CreateOne(ctx, indexModel)
+}
+
+// backfillVersions makes plans from before versioning their own version 1.
+func (m *PlanManager) backfillVersions() {
+	ctx := context.Background()
+	cursor, err := m.collection.Find(ctx, bson.M{"version": bson.M{"$exists": false}})
+	if err != nil {
+		log.Printf("Failed to backfill plan versions: %v", err)
+		return
+	}
+
+	var plans []Plan
+	if err := cursor.All(ctx, &plans); err != nil {
+		log.Printf("Failed to backfill plan versions: %v", err)
+		return
+	}
+	for i := range plans {
+		plan := &plans[i]
+		plan.Version = 1
+		if err := m.insertVersion(ctx, plan); err != nil && !mongo.IsDuplicateKeyError(err) {
+			log.Printf("Failed to backfill version of plan %s: %v", plan.ID.Hex(), err)
+			continue
+		}
+		m.collection.UpdateOne(ctx, bson.M{"_id": plan.ID}, bson.M{"$set": bson.M{"version": 1}})
+	}
+}
+
+func (m *PlanManager) insertVersion(ctx context.Context, plan *Plan) error {
+	// Archiving is a catalogue setting, not part of what subscribers bought
+	snapshot := *plan
+	snapshot.ArchivedAt = nil
+	version := &PlanVersion{
+		ID:          primitive.NewObjectID(),
+		PlanID:      plan.ID,
+		Version:     plan.Version,
+		Plan:        snapshot,
+		PublishedAt: time.Now(),
+	}
+	_, err := m.versions.InsertOne(ctx, version)
+	return err
+}
+
+// Publish makes plan the next version. The plan document always shows the latest.
+func (m *PlanManager) Publish(ctx context.Context, id primitive.ObjectID, req *PublishPlanRequest) (*Plan, error) {
+	current, err := m.GetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := req.Plan
+	plan.ID = id
+	plan.Version = current.Version + 1
+	plan.ArchivedAt = current.ArchivedAt
+	if err := m.insertVersion(ctx, &plan); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrPlanChanged
+		}
+		return nil, err
+	}
+
+	result, err := m.collection.ReplaceOne(ctx, bson.M{"_id": id, "version": current.Version}, plan)
+	if err != nil {
+		return nil, err
+	}
+	if result.MatchedCount == 0 {
+		return nil, ErrPlanChanged
+	}
+
+	if req.MigrateSubscribers {
+		_, err := m.versions.UpdateMany(
+			ctx,
+			bson.M{"plan_id": id, "version": bson.M{"$lt": plan.Version}},
+			bson.M{"$set": bson.M{"migrate_to": plan.Version}},
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &plan, nil
+}
+
+// GetVersion resolves version 0, from before versions, to the current plan.
+func (m *PlanManager) GetVersion(ctx context.Context, id primitive.ObjectID, version int) (*Plan, error) {
+	if version == 0 {
+		return m.GetByID(ctx, id)
+	}
+	planVersion, err := m.getVersion(ctx, id, version)
+	if err != nil {
+		return nil, err
+	}
+	return &planVersion.Plan, nil
+}
+
+func (m *PlanManager) getVersion(ctx context.Context, id primitive.ObjectID, version int) (*PlanVersion, error) {
+	var planVersion PlanVersion
+	err := m.versions.FindOne(ctx, bson.M{"plan_id": id, "version": version}).Decode(&planVersion)
+	return &planVersion, err
+}
+
+// MigrationTarget returns version itself if its subscribers keep it.
+func (m *PlanManager) MigrationTarget(ctx context.Context, id primitive.ObjectID, version int) (int, error) {
+	if version == 0 {
+		return 0, nil
+	}
+	planVersion, err := m.getVersion(ctx, id, version)
+	if err != nil {
+		return 0, err
+	}
+	if planVersion.MigrateTo > version {
+		return planVersion.MigrateTo, nil
+	}
+	return version, nil
+}
+
+// ListVersions returns every published version of a plan, oldest first.
+func (m *PlanManager) ListVersions(ctx context.Context, id primitive.ObjectID) ([]PlanVersion, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "version", Value: 1}})
+	cursor, err := m.versions.Find(ctx, bson.M{"plan_id": id}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	versions := []PlanVersion{}
+	err = cursor.All(ctx, &versions)
+	return versions, err
+}
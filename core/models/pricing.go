@@ -0,0 +1,365 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type PricingMode string
+
+const (
+	// PricingFlat charges Price per period whatever the quantity
+	PricingFlat PricingMode = "flat"
+	// PricingPerUnit charges Price per seat per period
+	PricingPerUnit PricingMode = "per_unit"
+	// PricingGraduated charges each seat at the price of its own tier
+	PricingGraduated PricingMode = "graduated"
+	// PricingVolume charges every seat at the tier the total quantity falls in
+	PricingVolume PricingMode = "volume"
+)
+
+// PricePoint amounts are in minor units of Currency.
+type PricePoint struct {
+	Currency Currency    `json:"currency" bson:"currency" validate:"required"`
+	Amount   int64       `json:"amount" bson:"amount" validate:"min=0"`
+	Tiers    []PriceTier `json:"tiers,omitempty" bson:"tiers,omitempty" validate:"dive"`
+}
+
+// PriceTier covers seats up to UpTo, or all remaining seats when UpTo is 0.
+// FlatFee is charged once when any seat falls in it.
+type PriceTier struct {
+	UpTo      int   `json:"up_to" bson:"up_to" validate:"min=0"`
+	UnitPrice int64 `json:"unit_price" bson:"unit_price" validate:"min=0"`
+	FlatFee   int64 `json:"flat_fee,omitempty" bson:"flat_fee,omitempty" validate:"min=0"`
+}
+
+type Quote struct {
+	PlanID      primitive.ObjectID `json:"plan_id"`
+	PricingMode PricingMode        `json:"pricing_mode"`
+	Currency    Currency           `json:"currency"`
+	Quantity    int                `json:"quantity"`
+	Lines       []QuoteLine        `json:"lines"`
+	Total       Money              `json:"total"`
+}
+
+// QuoteLine is the charge for the seats First to Last at one price.
+type QuoteLine struct {
+	First     int   `json:"first"`
+	Last      int   `json:"last"`
+	UnitPrice int64 `json:"unit_price"`
+	FlatFee   int64 `json:"flat_fee,omitempty"`
+	Amount    int64 `json:"amount"`
+}
+
+// AddOn needs a price in every currency the plan is sold in.
+type AddOn struct {
+	Code   string  `json:"code" bson:"code" validate:"required"`
+	Name   string  `json:"name" bson:"name" validate:"required"`
+	Prices []Money `json:"prices" bson:"prices" validate:"required,min=1"`
+}
+
+type AddOnItem struct {
+	Code     string `json:"code" bson:"code" validate:"required"`
+	Quantity int    `json:"quantity" bson:"quantity" validate:"min=1"`
+	// Price is the unit price when the add-on was added, ignored in requests
+	Price Money `json:"price" bson:"price"`
+}
+
+func (p *Plan) mode() PricingMode {
+	if p.PricingMode == "" {
+		return PricingFlat
+	}
+	return p.PricingMode
+}
+
+func (p *Plan) tiered() bool {
+	return p.mode() == PricingGraduated || p.mode() == PricingVolume
+}
+
+// BaseCurrency is the currency of the plan's first price point.
+func (p *Plan) BaseCurrency() Currency {
+	if len(p.Prices) == 0 {
+		return DefaultCurrency
+	}
+	return p.Prices[0].Currency
+}
+
+// PriceIn returns the plan's price point in currency.
+func (p *Plan) PriceIn(currency Currency) (*PricePoint, error) {
+	for i := range p.Prices {
+		if p.Prices[i].Currency == currency {
+			return &p.Prices[i], nil
+		}
+	}
+	return nil, fmt.Errorf("this plan is not sold in %s", currency)
+}
+
+// CheckPricing requires add-ons and overage to be priced in every currency.
+func (p *Plan) CheckPricing() error {
+	seen := make(map[Currency]bool)
+	for _, point := range p.Prices {
+		if err := CheckCurrency(point.Currency); err != nil {
+			return err
+		}
+		if seen[point.Currency] {
+			return fmt.Errorf("%s is priced more than once", point.Currency)
+		}
+		seen[point.Currency] = true
+		if err := p.checkTiers(point.Tiers); err != nil {
+			return err
+		}
+	}
+
+	for _, addOn := range p.AddOns {
+		priced := make(map[Currency]bool)
+		for _, price := range addOn.Prices {
+			if price.Amount < 0 {
+				return fmt.Errorf("add-on %q has a negative price", addOn.Code)
+			}
+			priced[price.Currency] = true
+		}
+		for currency := range seen {
+			if !priced[currency] {
+				return fmt.Errorf("add-on %q has no price in %s", addOn.Code, currency)
+			}
+		}
+	}
+
+	for _, entitlement := range p.Entitlements {
+		if err := entitlement.checkOverage(seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Plan) checkTiers(tiers []PriceTier) error {
+	if !p.tiered() {
+		if len(tiers) > 0 {
+			return errors.New("tiers are only used by graduated and volume plans")
+		}
+		return nil
+	}
+	if len(tiers) == 0 {
+		return errors.New("graduated and volume plans need at least one tier")
+	}
+	previous := 0
+	for i, tier := range tiers {
+		last := i == len(tiers)-1
+		if tier.UpTo == 0 && !last {
+			return errors.New("only the last tier can be open ended")
+		}
+		if tier.UpTo != 0 && tier.UpTo <= previous {
+			return errors.New("tiers must be in increasing order of up_to")
+		}
+		previous = tier.UpTo
+	}
+	return nil
+}
+
+// CheckQuantity allows flat plans only a quantity of 1.
+func (p *Plan) CheckQuantity(quantity int) error {
+	if p.mode() == PricingFlat {
+		if quantity != 1 {
+			return errors.New("this plan does not take a quantity")
+		}
+		return nil
+	}
+	if quantity < p.MinQuantity || quantity < 1 {
+		return fmt.Errorf("quantity must be at least %d", max(p.MinQuantity, 1))
+	}
+	if p.MaxQuantity > 0 && quantity > p.MaxQuantity {
+		return fmt.Errorf("quantity must be at most %d", p.MaxQuantity)
+	}
+	return nil
+}
+
+// CalculateCharge prices seats without add-ons.
+func CalculateCharge(plan *Plan, currency Currency, quantity int) (*Quote, error) {
+	if err := plan.CheckPricing(); err != nil {
+		return nil, err
+	}
+	if err := plan.CheckQuantity(quantity); err != nil {
+		return nil, err
+	}
+	point, err := plan.PriceIn(currency)
+	if err != nil {
+		return nil, err
+	}
+
+	quote := &Quote{PlanID: plan.ID, PricingMode: plan.mode(), Currency: currency, Quantity: quantity}
+	switch plan.mode() {
+	case PricingFlat:
+		quote.Lines = []QuoteLine{{First: 1, Last: 1, FlatFee: point.Amount, Amount: point.Amount}}
+
+	case PricingPerUnit:
+		quote.Lines = []QuoteLine{{First: 1, Last: quantity, UnitPrice: point.Amount, Amount: point.Amount * int64(quantity)}}
+
+	case PricingGraduated:
+		first := 1
+		for _, tier := range point.Tiers {
+			last := quantity
+			if tier.UpTo != 0 && tier.UpTo < quantity {
+				last = tier.UpTo
+			}
+			quote.Lines = append(quote.Lines, tier.line(first, last))
+			if last == quantity {
+				break
+			}
+			first = last + 1
+		}
+
+	case PricingVolume:
+		for _, tier := range point.Tiers {
+			if tier.UpTo == 0 || quantity <= tier.UpTo {
+				quote.Lines = []QuoteLine{tier.line(1, quantity)}
+				break
+			}
+		}
+
+	default:
+		return nil, errors.New("invalid pricing mode")
+	}
+
+	if plan.tiered() {
+		if top := point.Tiers[len(point.Tiers)-1].UpTo; top > 0 && quantity > top {
+			return nil, fmt.Errorf("quantity must be at most %d", top)
+		}
+	}
+
+	quote.Total = NewMoney(0, currency)
+	for _, line := range quote.Lines {
+		quote.Total.Amount += line.Amount
+	}
+	return quote, nil
+}
+
+func (t PriceTier) line(first, last int) QuoteLine {
+	return QuoteLine{
+		First:     first,
+		Last:      last,
+		UnitPrice: t.UnitPrice,
+		FlatFee:   t.FlatFee,
+		Amount:    t.UnitPrice*int64(last-first+1) + t.FlatFee,
+	}
+}
+
+// Total returns the add-ons with their current unit prices filled in.
+func (p *Plan) Total(currency Currency, quantity int, addOns []AddOnItem) (Money, []AddOnItem, error) {
+	quote, err := CalculateCharge(p, currency, quantity)
+	if err != nil {
+		return Money{}, nil, err
+	}
+	total := quote.Total
+
+	priced := make([]AddOnItem, 0, len(addOns))
+	seen := make(map[string]bool)
+	for _, item := range addOns {
+		if seen[item.Code] {
+			return Money{}, nil, fmt.Errorf("add-on %q is listed more than once", item.Code)
+		}
+		seen[item.Code] = true
+
+		addOn := p.addOn(item.Code)
+		if addOn == nil {
+			return Money{}, nil, fmt.Errorf("add-on %q is not offered with this plan", item.Code)
+		}
+		if item.Quantity < 1 {
+			return Money{}, nil, fmt.Errorf("add-on %q needs a quantity of at least 1", item.Code)
+		}
+		price, err := addOn.priceIn(currency)
+		if err != nil {
+			return Money{}, nil, err
+		}
+		item.Price = price
+		total.Amount += price.Amount * int64(item.Quantity)
+		priced = append(priced, item)
+	}
+
+	return total, priced, nil
+}
+
+func (p *Plan) addOn(code string) *AddOn {
+	for i := range p.AddOns {
+		if p.AddOns[i].Code == code {
+			return &p.AddOns[i]
+		}
+	}
+	return nil
+}
+
+func (a *AddOn) priceIn(currency Currency) (Money, error) {
+	for _, price := range a.Prices {
+		if price.Currency == currency {
+			return price, nil
+		}
+	}
+	return Money{}, fmt.Errorf("add-on %q is not sold in %s", a.Code, currency)
+}
+
+// quantityFor keeps the current seats and add-ons unless req names new ones.
+func (req *CreateSubscriptionRequest) quantityFor(previous *Subscription) (int, []AddOnItem) {
+	quantity, addOns := req.Quantity, req.AddOns
+	if previous != nil && previous.PlanID == req.PlanID {
+		if quantity == 0 {
+			quantity = previous.Quantity
+		}
+		if addOns == nil {
+			addOns = previous.AddOns
+		}
+	}
+	if quantity == 0 {
+		quantity = 1
+	}
+	return quantity, addOns
+}
+
+// currencyFor keeps a running period's currency, as it could not be prorated.
+func (req *CreateSubscriptionRequest) currencyFor(previous *Subscription, plan *Plan) (Currency, error) {
+	currency := req.Currency
+	if currency == "" && previous != nil {
+		currency = previous.currency()
+	}
+	if currency == "" {
+		currency = plan.BaseCurrency()
+	}
+	if previous != nil && previous.Status.HasAccess() && currency != previous.currency() {
+		return "", errors.New("currency cannot change while the subscription is running")
+	}
+	return currency, CheckCurrency(currency)
+}
+
+func (s *Subscription) currency() Currency {
+	if s.Currency == "" {
+		return DefaultCurrency
+	}
+	return s.Currency
+}
+
+// amount treats subscriptions from before quantities as one seat.
+func (s *Subscription) amount() Money {
+	if s.Quantity == 0 && s.Plan != nil {
+		if total, _, err := s.Plan.Total(s.currency(), 1, nil); err == nil {
+			return total
+		}
+	}
+	if s.Total.Currency == "" {
+		return NewMoney(s.Total.Amount, s.currency())
+	}
+	return s.Total
+}
+
+// charge is the amount less any discount.
+func (s *Subscription) charge() Money {
+	return discounted(s.amount(), s.Discount)
+}
+
+func (s *Subscription) pendingTotal(plan *Plan) (Money, []AddOnItem, error) {
+	quantity := s.PendingQuantity
+	if quantity == 0 {
+		quantity = 1
+	}
+	return plan.Total(s.currency(), quantity, s.PendingAddOns)
+}
@@ -0,0 +1,136 @@
+package models
+
+import "testing"
+
+func tieredPlan(mode PricingMode, tiers ...PriceTier) *Plan {
+	return &Plan{
+		Name:        "Team",
+		Duration:    "monthly",
+		PricingMode: mode,
+		Prices:      []PricePoint{{Currency: "INR", Tiers: tiers}},
+	}
+}
+
+// openTiers charge 1000 a seat, plus a 2000 fee, for the first 10 seats, 800
+// for seats 11 to 50 and 500 for every seat after that.
+var openTiers = []PriceTier{
+	{UpTo: 10, UnitPrice: 1000, FlatFee: 2000},
+	{UpTo: 50, UnitPrice: 800},
+	{UpTo: 0, UnitPrice: 500},
+}
+
+// closedTiers stop at 20 seats.
+var closedTiers = []PriceTier{
+	{UpTo: 10, UnitPrice: 1000},
+	{UpTo: 20, UnitPrice: 900},
+}
+
+func TestCalculateCharge(t *testing.T) {
+	flat := &Plan{Name: "Basic", Duration: "monthly", Prices: []PricePoint{{Currency: "INR", Amount: 99900}}}
+	perUnit := &Plan{
+		Name:        "Seats",
+		Duration:    "monthly",
+		PricingMode: PricingPerUnit,
+		MinQuantity: 2,
+		MaxQuantity: 5,
+		Prices:      []PricePoint{{Currency: "INR", Amount: 500}},
+	}
+
+	tests := []struct {
+		name     string
+		plan     *Plan
+		quantity int
+		want     int64
+		lines    int
+		wantErr  bool
+	}{
+		{name: "flat", plan: flat, quantity: 1, want: 99900, lines: 1},
+		{name: "flat with a quantity", plan: flat, quantity: 2, wantErr: true},
+
+		{name: "per unit below the minimum", plan: perUnit, quantity: 1, wantErr: true},
+		{name: "per unit at the minimum", plan: perUnit, quantity: 2, want: 1000, lines: 1},
+		{name: "per unit at the maximum", plan: perUnit, quantity: 5, want: 2500, lines: 1},
+		{name: "per unit above the maximum", plan: perUnit, quantity: 6, wantErr: true},
+
+		{name: "graduated below the first boundary", plan: tieredPlan(PricingGraduated, openTiers...), quantity: 9, want: 11000, lines: 1},
+		{name: "graduated at the first boundary", plan: tieredPlan(PricingGraduated, openTiers...), quantity: 10, want: 12000, lines: 1},
+		{name: "graduated above the first boundary", plan: tieredPlan(PricingGraduated, openTiers...), quantity: 11, want: 12800, lines: 2},
+		{name: "graduated below the second boundary", plan: tieredPlan(PricingGraduated, openTiers...), quantity: 49, want: 43200, lines: 2},
+		{name: "graduated at the second boundary", plan: tieredPlan(PricingGraduated, openTiers...), quantity: 50, want: 44000, lines: 2},
+		{name: "graduated above the second boundary", plan: tieredPlan(PricingGraduated, openTiers...), quantity: 51, want: 44500, lines: 3},
+		{name: "graduated deep in the open tier", plan: tieredPlan(PricingGraduated, openTiers...), quantity: 200, want: 119000, lines: 3},
+		{name: "graduated at the top of the last tier", plan: tieredPlan(PricingGraduated, closedTiers...), quantity: 20, want: 19000, lines: 2},
+		{name: "graduated past the last tier", plan: tieredPlan(PricingGraduated, closedTiers...), quantity: 21, wantErr: true},
+
+		{name: "volume below the first boundary", plan: tieredPlan(PricingVolume, openTiers...), quantity: 9, want: 11000, lines: 1},
+		{name: "volume at the first boundary", plan: tieredPlan(PricingVolume, openTiers...), quantity: 10, want: 12000, lines: 1},
+		{name: "volume above the first boundary", plan: tieredPlan(PricingVolume, openTiers...), quantity: 11, want: 8800, lines: 1},
+		{name: "volume below the second boundary", plan: tieredPlan(PricingVolume, openTiers...), quantity: 49, want: 39200, lines: 1},
+		{name: "volume at the second boundary", plan: tieredPlan(PricingVolume, openTiers...), quantity: 50, want: 40000, lines: 1},
+		{name: "volume above the second boundary", plan: tieredPlan(PricingVolume, openTiers...), quantity: 51, want: 25500, lines: 1},
+		{name: "volume deep in the open tier", plan: tieredPlan(PricingVolume, openTiers...), quantity: 200, want: 100000, lines: 1},
+		{name: "volume at the top of the last tier", plan: tieredPlan(PricingVolume, closedTiers...), quantity: 20, want: 18000, lines: 1},
+		{name: "volume past the last tier", plan: tieredPlan(PricingVolume, closedTiers...), quantity: 21, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quote, err := CalculateCharge(tt.plan, "INR", tt.quantity)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("CalculateCharge(%d) = %v, want an error", tt.quantity, quote.Total)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CalculateCharge(%d): %v", tt.quantity, err)
+			}
+			if quote.Total != NewMoney(tt.want, "INR") {
+				t.Errorf("total = %v, want %v", quote.Total, NewMoney(tt.want, "INR"))
+			}
+			if len(quote.Lines) != tt.lines {
+				t.Errorf("got %d lines, want %d: %+v", len(quote.Lines), tt.lines, quote.Lines)
+			}
+			if last := quote.Lines[len(quote.Lines)-1].Last; tt.plan.mode() != PricingFlat && last != tt.quantity {
+				t.Errorf("last line ends at seat %d, want %d", last, tt.quantity)
+			}
+		})
+	}
+}
+
+func TestCalculateChargeGraduatedLines(t *testing.T) {
+	quote, err := CalculateCharge(tieredPlan(PricingGraduated, openTiers...), "INR", 51)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []QuoteLine{
+		{First: 1, Last: 10, UnitPrice: 1000, FlatFee: 2000, Amount: 12000},
+		{First: 11, Last: 50, UnitPrice: 800, Amount: 32000},
+		{First: 51, Last: 51, UnitPrice: 500, Amount: 500},
+	}
+	for i, line := range want {
+		if quote.Lines[i] != line {
+			t.Errorf("line %d = %+v, want %+v", i, quote.Lines[i], line)
+		}
+	}
+}
+
+func TestCalculateChargeRefusesInvalidPlans(t *testing.T) {
+	tests := []struct {
+		name     string
+		plan     *Plan
+		currency Currency
+	}{
+		{name: "currency not sold", plan: tieredPlan(PricingVolume, openTiers...), currency: "EUR"},
+		{name: "open tier before the last", plan: tieredPlan(PricingGraduated, PriceTier{UpTo: 0, UnitPrice: 1}, PriceTier{UpTo: 10, UnitPrice: 1}), currency: "INR"},
+		{name: "tiers out of order", plan: tieredPlan(PricingGraduated, PriceTier{UpTo: 10, UnitPrice: 1}, PriceTier{UpTo: 10, UnitPrice: 1}), currency: "INR"},
+		{name: "tiered without tiers", plan: tieredPlan(PricingVolume), currency: "INR"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := CalculateCharge(tt.plan, tt.currency, 5); err == nil {
+				t.Error("want an error")
+			}
+		})
+	}
+}
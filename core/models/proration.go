@@ -0,0 +1,67 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Proration credits the unused share of the current period against the new plan.
+type Proration struct {
+	CurrentPlanID   *primitive.ObjectID `json:"current_plan_id,omitempty" bson:"current_plan_id,omitempty"`
+	NewPlanID       primitive.ObjectID  `json:"new_plan_id" bson:"new_plan_id"`
+	ChangeAt        time.Time           `json:"change_at" bson:"change_at"`
+	UnusedFraction  float64             `json:"unused_fraction" bson:"unused_fraction"`
+	Credit          Money               `json:"credit" bson:"credit"`
+	Charge          Money               `json:"charge" bson:"charge"`
+	AmountDue       Money               `json:"amount_due" bson:"amount_due"`
+	RemainingCredit Money               `json:"remaining_credit" bson:"remaining_credit"`
+	PeriodStart     time.Time           `json:"period_start" bson:"period_start"`
+	PeriodEnd       time.Time           `json:"period_end" bson:"period_end"`
+	TrialDays       int                 `json:"trial_days,omitempty" bson:"trial_days,omitempty"`
+	Scheduled       bool                `json:"scheduled,omitempty" bson:"scheduled,omitempty"`
+}
+
+// CalculateProration may take a nil current when there is no period to credit.
+// Credit beyond the new charge is kept as RemainingCredit.
+func CalculateProration(current *Plan, currentAmount Money, periodStart, periodEnd time.Time, next *Plan, nextAmount Money, changeAt time.Time) (*Proration, error) {
+	newEnd, err := next.PeriodEnd(changeAt)
+	if err != nil {
+		return nil, err
+	}
+
+	currency := nextAmount.Currency
+	proration := &Proration{
+		NewPlanID:   next.ID,
+		ChangeAt:    changeAt,
+		Credit:      NewMoney(0, currency),
+		Charge:      nextAmount,
+		PeriodStart: changeAt,
+		PeriodEnd:   newEnd,
+	}
+
+	if current != nil && changeAt.Before(periodEnd) {
+		total := periodEnd.Sub(periodStart)
+		if total <= 0 {
+			return nil, errors.New("invalid current period")
+		}
+		remaining := periodEnd.Sub(changeAt)
+		if remaining > total {
+			remaining = total
+		}
+
+		if currentAmount.Currency != currency {
+			return nil, ErrCurrencyMismatch
+		}
+
+		proration.CurrentPlanID = &current.ID
+		proration.UnusedFraction = float64(remaining) / float64(total)
+		proration.Credit = currentAmount.Scale(proration.UnusedFraction)
+	}
+
+	difference := proration.Charge.Amount - proration.Credit.Amount
+	proration.AmountDue = NewMoney(max(difference, 0), currency)
+	proration.RemainingCredit = NewMoney(max(-difference, 0), currency)
+	return proration, nil
+}
@@ -0,0 +1,119 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCalculateProration(t *testing.T) {
+	basic := &Plan{ID: primitive.NewObjectID(), Name: "Basic", Duration: "monthly"}
+	pro := &Plan{ID: primitive.NewObjectID(), Name: "Pro", Duration: "monthly"}
+	start := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC)
+	midway := time.Date(2025, 6, 16, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		current       *Plan
+		currentAmount Money
+		periodStart   time.Time
+		periodEnd     time.Time
+		next          *Plan
+		nextAmount    Money
+		changeAt      time.Time
+
+		wantFraction  float64
+		wantCredit    int64
+		wantDue       int64
+		wantRemaining int64
+		wantErr       error
+	}{
+		{
+			name:    "upgrade mid-period",
+			current: basic, currentAmount: NewMoney(1000, "INR"), periodStart: start, periodEnd: end,
+			next: pro, nextAmount: NewMoney(3000, "INR"), changeAt: midway,
+			wantFraction: 0.5, wantCredit: 500, wantDue: 2500,
+		},
+		{
+			name:    "downgrade mid-period",
+			current: pro, currentAmount: NewMoney(3000, "INR"), periodStart: start, periodEnd: end,
+			next: basic, nextAmount: NewMoney(1000, "INR"), changeAt: midway,
+			wantFraction: 0.5, wantCredit: 1500, wantDue: 0, wantRemaining: 500,
+		},
+		{
+			name:    "change at the period start",
+			current: basic, currentAmount: NewMoney(1000, "INR"), periodStart: start, periodEnd: end,
+			next: pro, nextAmount: NewMoney(3000, "INR"), changeAt: start,
+			wantFraction: 1, wantCredit: 1000, wantDue: 2000,
+		},
+		{
+			name:    "change before the period start credits no more than the period",
+			current: basic, currentAmount: NewMoney(1000, "INR"), periodStart: start, periodEnd: end,
+			next: pro, nextAmount: NewMoney(3000, "INR"), changeAt: start.AddDate(0, 0, -3),
+			wantFraction: 1, wantCredit: 1000, wantDue: 2000,
+		},
+		{
+			name:    "change at the period end",
+			current: basic, currentAmount: NewMoney(1000, "INR"), periodStart: start, periodEnd: end,
+			next: pro, nextAmount: NewMoney(3000, "INR"), changeAt: end,
+			wantDue: 3000,
+		},
+		{
+			name: "no running period",
+			next: pro, nextAmount: NewMoney(3000, "INR"), changeAt: midway,
+			wantDue: 3000,
+		},
+		{
+			name:    "zero-length period",
+			current: basic, currentAmount: NewMoney(1000, "INR"), periodStart: end, periodEnd: end,
+			next: pro, nextAmount: NewMoney(3000, "INR"), changeAt: midway,
+			wantErr: errors.New("invalid current period"),
+		},
+		{
+			name:    "currency mismatch",
+			current: basic, currentAmount: NewMoney(1000, "EUR"), periodStart: start, periodEnd: end,
+			next: pro, nextAmount: NewMoney(3000, "INR"), changeAt: midway,
+			wantErr: ErrCurrencyMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proration, err := CalculateProration(tt.current, tt.currentAmount, tt.periodStart, tt.periodEnd, tt.next, tt.nextAmount, tt.changeAt)
+			if tt.wantErr != nil {
+				if err == nil || (!errors.Is(err, tt.wantErr) && err.Error() != tt.wantErr.Error()) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if proration.UnusedFraction != tt.wantFraction {
+				t.Errorf("unused fraction = %g, want %g", proration.UnusedFraction, tt.wantFraction)
+			}
+			if proration.Credit != NewMoney(tt.wantCredit, "INR") {
+				t.Errorf("credit = %v, want %d", proration.Credit, tt.wantCredit)
+			}
+			if proration.Charge != tt.nextAmount {
+				t.Errorf("charge = %v, want %v", proration.Charge, tt.nextAmount)
+			}
+			if proration.AmountDue != NewMoney(tt.wantDue, "INR") {
+				t.Errorf("amount due = %v, want %d", proration.AmountDue, tt.wantDue)
+			}
+			if proration.RemainingCredit != NewMoney(tt.wantRemaining, "INR") {
+				t.Errorf("remaining credit = %v, want %d", proration.RemainingCredit, tt.wantRemaining)
+			}
+			if (proration.CurrentPlanID != nil) != (tt.wantFraction > 0) {
+				t.Errorf("current plan ID = %v, want it set only when credited", proration.CurrentPlanID)
+			}
+			if !proration.PeriodStart.Equal(tt.changeAt) || !proration.PeriodEnd.Equal(tt.changeAt.AddDate(0, 1, 0)) {
+				t.Errorf("new period = %v to %v, want a month from %v", proration.PeriodStart, proration.PeriodEnd, tt.changeAt)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package models
+
+type Role string
+
+const (
+	RoleAdmin          Role = "admin"
+	RoleBillingManager Role = "billing-manager"
+	RoleSupport        Role = "support"
+	RoleViewer         Role = "viewer"
+	RoleCustomer       Role = "customer"
+)
+
+// Permissions are plain strings so they can travel in JWT claims and be
+// passed straight to middleware.RequirePermission.
+const (
+	PermPlansWrite            = "plans:write"
+	PermSubscriptionsRead     = "subscriptions:read"
+	PermSubscriptionsWrite    = "subscriptions:write"
+	PermSubscriptionsReadAny  = "subscriptions:read_any"
+	PermSubscriptionsWriteAny = "subscriptions:write_any"
+	PermUsersManage           = "users:manage"
+	PermUsageWrite            = "usage:write"
+	PermCouponsWrite          = "coupons:write"
+	PermInvoicesWrite         = "invoices:write"
+	PermCreditsWrite          = "credits:write"
+)
+
+var rolePermissions = map[Role][]string{
+	RoleAdmin: {
+		PermPlansWrite,
+		PermSubscriptionsRead,
+		PermSubscriptionsWrite,
+		PermSubscriptionsReadAny,
+		PermSubscriptionsWriteAny,
+		PermUsersManage,
+		PermUsageWrite,
+		PermCouponsWrite,
+		PermInvoicesWrite,
+		PermCreditsWrite,
+	},
+	RoleBillingManager: {
+		PermPlansWrite,
+		PermSubscriptionsRead,
+		PermSubscriptionsWrite,
+		PermSubscriptionsReadAny,
+		PermSubscriptionsWriteAny,
+		PermUsageWrite,
+		PermCouponsWrite,
+		PermInvoicesWrite,
+		PermCreditsWrite,
+	},
+	RoleSupport: {
+		PermSubscriptionsRead,
+		PermSubscriptionsReadAny,
+	},
+	RoleViewer: {
+		PermSubscriptionsRead,
+	},
+	RoleCustomer: {
+		PermSubscriptionsRead,
+		PermSubscriptionsWrite,
+	},
+}
+
+func (r Role) IsValid() bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+// IsValidPermission reports whether permission is a declared one. Admins hold
+// every permission, so their list is the full set.
+func IsValidPermission(permission string) bool {
+	for _, p := range rolePermissions[RoleAdmin] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// PermissionsFor returns the role's permissions merged with any extra grants,
+// without duplicates.
+func PermissionsFor(role Role, extra []string) []string {
+	seen := make(map[string]bool)
+	var permissions []string
+	for _, list := range [][]string{rolePermissions[role], extra} {
+		for _, p := range list {
+			if !seen[p] {
+				seen[p] = true
+				permissions = append(permissions, p)
+			}
+		}
+	}
+	return permissions
+}
@@ -0,0 +1,175 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrNoPendingChange = errors.New("no pending plan change")
+
+// PendingChange is a plan change waiting for the current period to end.
+type PendingChange struct {
+	PlanID      primitive.ObjectID `json:"plan_id"`
+	Plan        *Plan              `json:"plan,omitempty"`
+	Quantity    int                `json:"quantity"`
+	AddOns      []AddOnItem        `json:"add_ons,omitempty"`
+	Total       Money              `json:"total"`
+	EffectiveAt time.Time          `json:"effective_at"`
+}
+
+// schedulesChange reports whether the change waits for ExpiresAt, as downgrades do.
+func (s *Subscription) schedulesChange(plan *Plan, total Money) bool {
+	return s.Status == StatusActive && s.Plan != nil && s.PlanID != plan.ID && total.Amount < s.amount().Amount
+}
+
+func planChangeType(previousID primitive.ObjectID, previousAmount Money, nextID primitive.ObjectID, nextAmount Money) SubscriptionEventType {
+	switch {
+	case nextAmount.Amount > previousAmount.Amount:
+		return EventUpgraded
+	case previousID == nextID && nextAmount == previousAmount:
+		return EventRenewed
+	default:
+		return EventDowngraded
+	}
+}
+
+// pendingChangeFields returns an $unset for the fields of a pending change.
+func pendingChangeFields() bson.M {
+	return bson.M{
+		"pending_plan_id":      "",
+		"pending_plan_version": "",
+		"pending_quantity":     "",
+		"pending_add_ons":      "",
+		"change_effective_at":  "",
+	}
+}
+
+func (s *Subscription) clearPendingChange() {
+	s.PendingPlanID, s.PendingPlanVersion, s.ChangeEffectiveAt = nil, 0, nil
+	s.PendingQuantity, s.PendingAddOns = 0, nil
+}
+
+// schedulePlanChange replaces any pending change and scheduled cancellation.
+func (m *SubscriptionManager) schedulePlanChange(ctx context.Context, subscription *Subscription, plan *Plan, quantity int, addOns []AddOnItem, autoRenew *bool, actor *Actor) (*Subscription, error) {
+	effectiveAt := subscription.ExpiresAt
+	subscription.PendingPlanID, subscription.PendingPlanVersion = &plan.ID, plan.Version
+	subscription.PendingQuantity, subscription.PendingAddOns = quantity, addOns
+	subscription.ChangeEffectiveAt = &effectiveAt
+	subscription.CancelAt = nil
+
+	set := bson.M{
+		"pending_plan_id":      plan.ID,
+		"pending_plan_version": plan.Version,
+		"pending_quantity":     quantity,
+		"pending_add_ons":      addOns,
+		"change_effective_at":  effectiveAt,
+	}
+	if autoRenew != nil {
+		subscription.AutoRenew = *autoRenew
+		set["auto_renew"] = *autoRenew
+	}
+	update := bson.M{"$set": set, "$unset": bson.M{"cancel_at": ""}}
+	guard := bson.M{"plan_id": subscription.PlanID, "expires_at": subscription.ExpiresAt}
+	if err := m.transition(ctx, subscription, subscription.Status, EventPlanChangeScheduled, guard, update, actor); err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+func (m *SubscriptionManager) GetPendingChange(ctx context.Context, subscriptionID string) (*PendingChange, error) {
+	subscription, err := m.GetSubscription(ctx, subscriptionID)
+	if err != nil {
+		return nil, errors.New("subscription not found")
+	}
+	if subscription.PendingPlanID == nil {
+		return nil, ErrNoPendingChange
+	}
+
+	change := &PendingChange{
+		PlanID:      *subscription.PendingPlanID,
+		Quantity:    max(subscription.PendingQuantity, 1),
+		AddOns:      subscription.PendingAddOns,
+		EffectiveAt: *subscription.ChangeEffectiveAt,
+	}
+	if plan, err := m.planManager.GetVersion(ctx, change.PlanID, subscription.PendingPlanVersion); err == nil {
+		change.Plan = plan
+		change.Total, _, _ = subscription.pendingTotal(plan)
+	}
+	return change, nil
+}
+
+func (m *SubscriptionManager) CancelPendingChange(ctx context.Context, subscriptionID string, actor *Actor) (*Subscription, error) {
+	subscription, err := m.GetSubscription(ctx, subscriptionID)
+	if err != nil {
+		return nil, errors.New("subscription not found")
+	}
+	if subscription.PendingPlanID == nil {
+		return nil, ErrNoPendingChange
+	}
+
+	guard := bson.M{"pending_plan_id": *subscription.PendingPlanID}
+	update := bson.M{"$unset": pendingChangeFields()}
+	subscription.clearPendingChange()
+	if err := m.transition(ctx, subscription, subscription.Status, EventPlanChangeCancelled, guard, update, actor); err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+// applyPendingChange is for lapsed periods; renewals apply the change themselves.
+func (m *SubscriptionManager) applyPendingChange(ctx context.Context, subscription *Subscription) error {
+	next, err := m.planManager.GetVersion(ctx, *subscription.PendingPlanID, subscription.PendingPlanVersion)
+	if err != nil {
+		return errors.New("pending plan not found")
+	}
+	total, addOns, err := subscription.pendingTotal(next)
+	if err != nil {
+		return err
+	}
+	quantity := max(subscription.PendingQuantity, 1)
+	discount := subscription.Discount.carriedTo(next, total)
+
+	set := bson.M{
+		"plan_id":      next.ID,
+		"plan_version": next.Version,
+		"quantity":     quantity,
+		"add_ons":      addOns,
+		"total":        total,
+	}
+	unset := pendingChangeFields()
+	if discount != nil {
+		set["discount"] = discount
+	} else {
+		unset["discount"] = ""
+	}
+	result, err := m.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": subscription.ID, "status": subscription.Status, "pending_plan_id": next.ID},
+		bson.M{
+			"$set":   set,
+			"$unset": unset,
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrConcurrentUpdate
+	}
+
+	previousID, previousAmount := subscription.PlanID, subscription.amount()
+	subscription.PlanID, subscription.PlanVersion, subscription.Plan = next.ID, next.Version, next
+	subscription.Quantity, subscription.AddOns, subscription.Total = quantity, addOns, total
+	subscription.Discount = discount
+	subscription.clearPendingChange()
+
+	event := subscription.newEvent(planChangeType(previousID, previousAmount, next.ID, total), subscription.Status, nil)
+	event.PreviousPlanID = &previousID
+	event.PreviousPrice = &previousAmount
+	m.transitioned(ctx, subscription, event)
+	return nil
+}
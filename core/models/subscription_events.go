@@ -0,0 +1,144 @@
+package models
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type SubscriptionEventType string
+
+const (
+	EventCreated    SubscriptionEventType = "created"
+	EventUpgraded   SubscriptionEventType = "upgraded"
+	EventDowngraded SubscriptionEventType = "downgraded"
+	EventRenewed    SubscriptionEventType = "renewed"
+	EventCancelled  SubscriptionEventType = "cancelled"
+	EventExpired    SubscriptionEventType = "expired"
+
+	EventCancellationScheduled SubscriptionEventType = "cancellation_scheduled"
+	EventCancellationUndone    SubscriptionEventType = "cancellation_undone"
+	EventTrialStarted          SubscriptionEventType = "trial_started"
+	EventTrialConverted        SubscriptionEventType = "trial_converted"
+	EventPaused                SubscriptionEventType = "paused"
+	EventResumed               SubscriptionEventType = "resumed"
+	EventPastDue               SubscriptionEventType = "past_due"
+	EventDunningReminder       SubscriptionEventType = "dunning_reminder"
+	EventPlanChangeScheduled   SubscriptionEventType = "plan_change_scheduled"
+	EventPlanChangeCancelled   SubscriptionEventType = "plan_change_cancelled"
+	EventActivated             SubscriptionEventType = "activated"
+	// Refunds and disputes of the current period's payment cancel it
+	EventRefunded SubscriptionEventType = "refunded"
+	EventDisputed SubscriptionEventType = "disputed"
+)
+
+// SubscriptionEvent is an append-only record of a subscription change. Actor is nil for system changes.
+type SubscriptionEvent struct {
+	ID                primitive.ObjectID    `json:"id" bson:"_id,omitempty"`
+	SubscriptionID    primitive.ObjectID    `json:"subscription_id" bson:"subscription_id"`
+	UserID            string                `json:"user_id" bson:"user_id"`
+	Type              SubscriptionEventType `json:"type" bson:"type"`
+	PreviousPlanID    *primitive.ObjectID   `json:"previous_plan_id,omitempty" bson:"previous_plan_id,omitempty"`
+	PreviousPrice     *Money                `json:"previous_price,omitempty" bson:"previous_price,omitempty"`
+	PreviousStatus    SubscriptionStatus    `json:"previous_status,omitempty" bson:"previous_status,omitempty"`
+	PlanID            primitive.ObjectID    `json:"plan_id" bson:"plan_id"`
+	PlanVersion       int                   `json:"plan_version,omitempty" bson:"plan_version,omitempty"`
+	Price             Money                 `json:"price" bson:"price"`
+	Discount          *Money                `json:"discount,omitempty" bson:"discount,omitempty"`
+	Status            SubscriptionStatus    `json:"status" bson:"status"`
+	PeriodStart       time.Time             `json:"period_start" bson:"period_start"`
+	PeriodEnd         time.Time             `json:"period_end" bson:"period_end"`
+	Proration         *Proration            `json:"proration,omitempty" bson:"proration,omitempty"`
+	Dunning           *Dunning              `json:"dunning,omitempty" bson:"dunning,omitempty"`
+	PendingPlanID     *primitive.ObjectID   `json:"pending_plan_id,omitempty" bson:"pending_plan_id,omitempty"`
+	ChangeEffectiveAt *time.Time            `json:"change_effective_at,omitempty" bson:"change_effective_at,omitempty"`
+	Actor             *Actor                `json:"actor,omitempty" bson:"actor,omitempty"`
+	OccurredAt        time.Time             `json:"occurred_at" bson:"occurred_at"`
+	Renewal           bool                  `json:"renewal,omitempty" bson:"renewal,omitempty"`
+	CreditApplied     *Money                `json:"credit_applied,omitempty" bson:"credit_applied,omitempty"`
+	// Overage of the period a renewal ends is billed on the renewal's invoice
+	Overage []MeterUsage `json:"overage,omitempty" bson:"overage,omitempty"`
+}
+
+type SubscriptionEventManager struct {
+	collection *mongo.Collection
+}
+
+func NewSubscriptionEventManager(db *mongo.Database) *SubscriptionEventManager {
+	manager := &SubscriptionEventManager{
+		collection: db.Collection("subscription_events"),
+	}
+	manager.createIndexes()
+	manager.migrateAmounts()
+	return manager
+}
+
+func (m *SubscriptionEventManager) migrateAmounts() {
+	ctx := context.Background()
+	legacy := bson.M{"price": bson.M{"$type": "double"}}
+	proration := bson.M{"$cond": bson.A{
+		bson.M{"$eq": bson.A{bson.M{"$type": "$proration"}, "object"}},
+		bson.M{"$mergeObjects": bson.A{"$proration", bson.M{
+			"credit":           legacyMoney("$proration.credit"),
+			"charge":           legacyMoney("$proration.charge"),
+			"amount_due":       legacyMoney("$proration.amount_due"),
+			"remaining_credit": legacyMoney("$proration.remaining_credit"),
+		}}},
+		"$$REMOVE",
+	}}
+	pipeline := mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		"price":          legacyMoney("$price"),
+		"previous_price": legacyMoney("$previous_price"),
+		"proration":      proration,
+	}}}}
+	if _, err := m.collection.UpdateMany(ctx, legacy, pipeline); err != nil {
+		log.Printf("Failed to migrate subscription event amounts: %v", err)
+	}
+}
+
+func (m *SubscriptionEventManager) createIndexes() {
+	ctx := context.Background()
+	indexModels := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "occurred_at", Value: 1}}},
+		{Keys: bson.D{{Key: "subscription_id", Value: 1}, {Key: "occurred_at", Value: 1}}},
+	}
+	m.collection.Indexes().CreateMany(ctx, indexModels)
+}
+
+// Events written along with a payment already have their ID.
+func (m *SubscriptionEventManager) Record(ctx context.Context, event *SubscriptionEvent) error {
+	if event.ID.IsZero() {
+		event.ID = primitive.NewObjectID()
+	}
+	if event.OccurredAt.IsZero() {
+		event.OccurredAt = time.Now()
+	}
+	_, err := m.collection.InsertOne(ctx, event)
+	return err
+}
+
+func (m *SubscriptionEventManager) ListByUser(ctx context.Context, userID string) ([]SubscriptionEvent, error) {
+	return m.list(ctx, bson.M{"user_id": userID})
+}
+
+func (m *SubscriptionEventManager) ListBySubscription(ctx context.Context, subscriptionID primitive.ObjectID) ([]SubscriptionEvent, error) {
+	return m.list(ctx, bson.M{"subscription_id": subscriptionID})
+}
+
+func (m *SubscriptionEventManager) list(ctx context.Context, filter bson.M) ([]SubscriptionEvent, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "occurred_at", Value: 1}})
+	cursor, err := m.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	events := []SubscriptionEvent{}
+	err = cursor.All(ctx, &events)
+	return events, err
+}
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// StatusNone is the status of a subscription that does not exist yet.
+const StatusNone SubscriptionStatus = ""
+
+var (
+	ErrIllegalTransition = errors.New("illegal subscription status transition")
+	ErrConcurrentUpdate  = errors.New("subscription was changed by another request, please retry")
+)
+
+// TransitionError matches ErrIllegalTransition with errors.Is.
+type TransitionError struct {
+	From SubscriptionStatus
+	To   SubscriptionStatus
+}
+
+func (e *TransitionError) Error() string {
+	from := e.From
+	if from == StatusNone {
+		from = "NONE"
+	}
+	return fmt.Sprintf("cannot move subscription from %s to %s", from, e.To)
+}
+
+func (e *TransitionError) Is(target error) bool {
+	return target == ErrIllegalTransition
+}
+
+// Every status write must be checked against this table.
+var transitions = map[SubscriptionStatus][]SubscriptionStatus{
+	StatusNone:       {StatusActive, StatusTrialing, StatusIncomplete},
+	StatusInactive:   {StatusActive, StatusTrialing, StatusIncomplete},
+	StatusIncomplete: {StatusIncomplete, StatusActive, StatusTrialing, StatusCancelled, StatusExpired},
+	StatusTrialing:   {StatusTrialing, StatusActive, StatusPastDue, StatusCancelled, StatusExpired},
+	StatusActive:     {StatusActive, StatusPaused, StatusPastDue, StatusCancelled, StatusExpired},
+	StatusPaused:     {StatusPaused, StatusActive, StatusCancelled},
+	StatusPastDue:    {StatusPastDue, StatusActive, StatusCancelled, StatusExpired},
+	StatusCancelled:  {StatusActive, StatusTrialing, StatusIncomplete},
+	StatusExpired:    {StatusActive, StatusTrialing, StatusIncomplete},
+}
+
+func CanTransition(from, to SubscriptionStatus) bool {
+	for _, allowed := range transitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+func checkTransition(from, to SubscriptionStatus) error {
+	if !CanTransition(from, to) {
+		return &TransitionError{From: from, To: to}
+	}
+	return nil
+}
+
+// TransitionHook runs after every successful transition.
+type TransitionHook func(ctx context.Context, subscription *Subscription, event *SubscriptionEvent)
+
+// OnTransition registers a hook. Call it at startup, before serving requests.
+func (m *SubscriptionManager) OnTransition(hook TransitionHook) {
+	m.hooks = append(m.hooks, hook)
+}
+
+func (m *SubscriptionManager) transitioned(ctx context.Context, subscription *Subscription, event *SubscriptionEvent) {
+	for _, hook := range m.hooks {
+		hook(ctx, subscription, event)
+	}
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTransitions(t *testing.T) {
+	statuses := []SubscriptionStatus{
+		StatusNone, StatusInactive, StatusIncomplete, StatusTrialing, StatusActive,
+		StatusPaused, StatusPastDue, StatusCancelled, StatusExpired,
+	}
+	// Kept apart from the table on purpose, so changing one without the
+	// other fails here
+	allowed := map[[2]SubscriptionStatus]bool{
+		{StatusNone, StatusActive}:     true,
+		{StatusNone, StatusTrialing}:   true,
+		{StatusNone, StatusIncomplete}: true,
+
+		{StatusInactive, StatusActive}:     true,
+		{StatusInactive, StatusTrialing}:   true,
+		{StatusInactive, StatusIncomplete}: true,
+
+		{StatusIncomplete, StatusIncomplete}: true,
+		{StatusIncomplete, StatusActive}:     true,
+		{StatusIncomplete, StatusTrialing}:   true,
+		{StatusIncomplete, StatusCancelled}:  true,
+		{StatusIncomplete, StatusExpired}:    true,
+
+		{StatusTrialing, StatusTrialing}:  true,
+		{StatusTrialing, StatusActive}:    true,
+		{StatusTrialing, StatusPastDue}:   true,
+		{StatusTrialing, StatusCancelled}: true,
+		{StatusTrialing, StatusExpired}:   true,
+
+		{StatusActive, StatusActive}:    true,
+		{StatusActive, StatusPaused}:    true,
+		{StatusActive, StatusPastDue}:   true,
+		{StatusActive, StatusCancelled}: true,
+		{StatusActive, StatusExpired}:   true,
+
+		{StatusPaused, StatusPaused}:    true,
+		{StatusPaused, StatusActive}:    true,
+		{StatusPaused, StatusCancelled}: true,
+
+		{StatusPastDue, StatusPastDue}:   true,
+		{StatusPastDue, StatusActive}:    true,
+		{StatusPastDue, StatusCancelled}: true,
+		{StatusPastDue, StatusExpired}:   true,
+
+		{StatusCancelled, StatusActive}:     true,
+		{StatusCancelled, StatusTrialing}:   true,
+		{StatusCancelled, StatusIncomplete}: true,
+
+		{StatusExpired, StatusActive}:     true,
+		{StatusExpired, StatusTrialing}:   true,
+		{StatusExpired, StatusIncomplete}: true,
+	}
+
+	for _, from := range statuses {
+		for _, to := range statuses {
+			want := allowed[[2]SubscriptionStatus{from, to}]
+			if got := CanTransition(from, to); got != want {
+				t.Errorf("CanTransition(%q, %q) = %v, want %v", from, to, got, want)
+			}
+
+			err := checkTransition(from, to)
+			if want && err != nil {
+				t.Errorf("checkTransition(%q, %q) = %v, want nil", from, to, err)
+			}
+			if !want && !errors.Is(err, ErrIllegalTransition) {
+				t.Errorf("checkTransition(%q, %q) = %v, want ErrIllegalTransition", from, to, err)
+			}
+		}
+	}
+
+	for from, targets := range transitions {
+		for _, to := range targets {
+			if !allowed[[2]SubscriptionStatus{from, to}] {
+				t.Errorf("transition table allows %q to %q, which this test does not expect", from, to)
+			}
+		}
+	}
+}
@@ -3,9 +3,12 @@ package models
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"time"
 
+	"subservice/core/payments"
+
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -19,134 +22,1415 @@ const (
 	StatusInactive  SubscriptionStatus = "INACTIVE"
 	StatusCancelled SubscriptionStatus = "CANCELLED"
 	StatusExpired   SubscriptionStatus = "EXPIRED"
+	StatusTrialing  SubscriptionStatus = "TRIALING"
+	StatusPaused    SubscriptionStatus = "PAUSED"
+	StatusPastDue   SubscriptionStatus = "PAST_DUE"
+	// StatusIncomplete subscriptions wait for their first payment
+	StatusIncomplete SubscriptionStatus = "INCOMPLETE"
 )
 
+// accessStatuses are the statuses in which the user can use their plan.
+var accessStatuses = []SubscriptionStatus{StatusActive, StatusTrialing, StatusPastDue}
+
+// periodStatuses renew or lapse at ExpiresAt.
+var periodStatuses = []SubscriptionStatus{StatusActive, StatusTrialing}
+
+func (s SubscriptionStatus) HasAccess() bool {
+	for _, status := range accessStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
 type Subscription struct {
-	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
-	UserID    string             `json:"user_id" bson:"user_id" validate:"required"`
-	PlanID    primitive.ObjectID `json:"plan_id" bson:"plan_id" validate:"required"`
-	Plan      *Plan              `json:"plan,omitempty" bson:"-"`
-	Status    SubscriptionStatus `json:"status" bson:"status"`
-	StartDate time.Time          `json:"start_date" bson:"start_date"`
-	ExpiresAt time.Time          `json:"expires_at" bson:"expires_at"`
-	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID      string             `json:"user_id" bson:"user_id" validate:"required"`
+	PlanID      primitive.ObjectID `json:"plan_id" bson:"plan_id" validate:"required"`
+	PlanVersion int                `json:"plan_version" bson:"plan_version"`
+	// ProductLine is the line of the subscription's plan, see Plan.Line
+	ProductLine string             `json:"product_line" bson:"product_line"`
+	Plan        *Plan              `json:"plan,omitempty" bson:"-"`
+	Proration   *Proration         `json:"proration,omitempty" bson:"-"`
+	Status      SubscriptionStatus `json:"status" bson:"status"`
+	StartDate   time.Time          `json:"start_date" bson:"start_date"`
+	ExpiresAt   time.Time          `json:"expires_at" bson:"expires_at"`
+	AutoRenew   bool               `json:"auto_renew" bson:"auto_renew"`
+	// RenewalFailedAt is when the renewal sweep last failed to renew
+	RenewalFailedAt *time.Time  `json:"renewal_failed_at,omitempty" bson:"renewal_failed_at,omitempty"`
+	TrialEnd        *time.Time  `json:"trial_end,omitempty" bson:"trial_end,omitempty"`
+	CancelAt        *time.Time  `json:"cancel_at,omitempty" bson:"cancel_at,omitempty"`
+	PausedAt        *time.Time  `json:"paused_at,omitempty" bson:"paused_at,omitempty"`
+	ResumeAt        *time.Time  `json:"resume_at,omitempty" bson:"resume_at,omitempty"`
+	Dunning         *Dunning    `json:"dunning,omitempty" bson:"dunning,omitempty"`
+	Currency        Currency    `json:"currency" bson:"currency"`
+	Quantity        int         `json:"quantity" bson:"quantity"`
+	AddOns          []AddOnItem `json:"add_ons,omitempty" bson:"add_ons,omitempty"`
+	// Total is the per-period cost of Quantity seats and AddOns
+	Total Money `json:"total" bson:"total"`
+	// Discount is taken off Total while the promo code it came from lasts
+	Discount *Discount `json:"discount,omitempty" bson:"discount,omitempty"`
+	// The pending plan, seats and add-ons take over at ChangeEffectiveAt
+	PendingPlanID      *primitive.ObjectID `json:"pending_plan_id,omitempty" bson:"pending_plan_id,omitempty"`
+	PendingPlanVersion int                 `json:"pending_plan_version,omitempty" bson:"pending_plan_version,omitempty"`
+	PendingQuantity    int                 `json:"pending_quantity,omitempty" bson:"pending_quantity,omitempty"`
+	PendingAddOns      []AddOnItem         `json:"pending_add_ons,omitempty" bson:"pending_add_ons,omitempty"`
+	ChangeEffectiveAt  *time.Time          `json:"change_effective_at,omitempty" bson:"change_effective_at,omitempty"`
+	CreatedAt          time.Time           `json:"created_at" bson:"created_at"`
+	LastActor          *Actor              `json:"last_actor,omitempty" bson:"last_actor,omitempty"`
+	// PaymentID is the payment an INCOMPLETE subscription waits for
+	PaymentID *primitive.ObjectID `json:"payment_id,omitempty" bson:"payment_id,omitempty"`
+	Payment   *Payment            `json:"payment,omitempty" bson:"-"`
 }
 
 type CreateSubscriptionRequest struct {
-	UserID string             `json:"user_id" validate:"required"`
+	UserID string             `json:"user_id"`
 	PlanID primitive.ObjectID `json:"plan_id" validate:"required"`
+	// Quantity and AddOns default to the current ones when buying the same plan
+	Quantity int         `json:"quantity" validate:"omitempty,min=1"`
+	AddOns   []AddOnItem `json:"add_ons" validate:"dive"`
+	// Currency defaults to the current subscription's, or the plan's base currency
+	Currency Currency `json:"currency"`
+	// AutoRenew defaults to true, or to the running subscription's setting
+	AutoRenew *bool `json:"auto_renew"`
+	// Without a PromoCode, a running subscription keeps a discount covering the plan
+	PromoCode string `json:"promo_code" validate:"max=64"`
+	// PaymentMethod becomes the user's saved method
+	PaymentMethod string `json:"payment_method" validate:"max=255"`
+}
+
+type CancelMode string
+
+const (
+	// CancelAtPeriodEnd keeps access until ExpiresAt and then cancels
+	CancelAtPeriodEnd CancelMode = "period_end"
+	CancelImmediately CancelMode = "immediate"
+)
+
+// PauseRequest asks to pause for Days, or for the plan's maximum when omitted.
+type PauseRequest struct {
+	Days int `json:"days" validate:"omitempty,min=1"`
+}
+
+type AutoRenewRequest struct {
+	AutoRenew *bool `json:"auto_renew" validate:"required"`
 }
 
 type SubscriptionManager struct {
-	collection  *mongo.Collection
-	planManager *PlanManager
+	collection *mongo.Collection
+	usage      *mongo.Collection
+	// usageCounters total each period's usage per key, to reserve quota against
+	usageCounters *mongo.Collection
+	planManager   *PlanManager
+	eventManager  *SubscriptionEventManager
+	trialManager  *TrialManager
+	dunning       DunningSchedule
+	hooks         []TransitionHook
+	// couponManager redeems the promo codes subscriptions are bought with
+	couponManager *CouponManager
+	payments      *PaymentManager
 }
 
-func NewSubscriptionManager(db *mongo.Database, planManager *PlanManager) *SubscriptionManager {
+func NewSubscriptionManager(db *mongo.Database, planManager *PlanManager, eventManager *SubscriptionEventManager, trialManager *TrialManager, couponManager *CouponManager, paymentManager *PaymentManager) *SubscriptionManager {
 	manager := &SubscriptionManager{
-		collection:  db.Collection("subscriptions"),
-		planManager: planManager,
+		collection:    db.Collection("subscriptions"),
+		usage:         db.Collection("usage_records"),
+		usageCounters: db.Collection("usage_counters"),
+		planManager:   planManager,
+		eventManager:  eventManager,
+		trialManager:  trialManager,
+		couponManager: couponManager,
+		payments:      paymentManager,
+		dunning:       DefaultDunningSchedule,
 	}
 	manager.createIndexes()
+	manager.createUsageIndexes()
+	manager.migrateAmounts()
+	manager.OnTransition(manager.recordEvent)
 	return manager
 }
 
+// createIndexes replaces the old one-subscription-per-user index.
 func (m *SubscriptionManager) createIndexes() {
 	ctx := context.Background()
+	missing := bson.M{"product_line": bson.M{"$exists": false}}
+	if _, err := m.collection.UpdateMany(ctx, missing, bson.M{"$set": bson.M{"product_line": DefaultProductLine}}); err != nil {
+		log.Printf("Failed to backfill subscription product lines: %v", err)
+	}
+	m.collection.Indexes().DropOne(ctx, "user_id_1")
+
 	indexModel := mongo.IndexModel{
-		Keys:    bson.D{{Key: "user_id", Value: 1}},
+		Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "product_line", Value: 1}},
 		Options: &options.IndexOptions{Unique: &[]bool{true}[0]},
 	}
 	m.collection.Indexes().CreateOne(ctx, indexModel)
+	m.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "sweep.id", Value: 1}},
+		Options: &options.IndexOptions{Sparse: &[]bool{true}[0]},
+	})
 }
 
-func (m *SubscriptionManager) UpsertSubscription(ctx context.Context, req *CreateSubscriptionRequest) (*Subscription, error) {
+// migrateAmounts moves subscriptions from before Money to DefaultCurrency.
+func (m *SubscriptionManager) migrateAmounts() {
+	ctx := context.Background()
+	legacy := bson.M{"currency": bson.M{"$exists": false}}
+	pipeline := mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		"currency":        DefaultCurrency,
+		"total":           legacyMoney("$total"),
+		"add_ons":         legacyAddOnItems("$add_ons"),
+		"pending_add_ons": legacyAddOnItems("$pending_add_ons"),
+	}}}}
+	if _, err := m.collection.UpdateMany(ctx, legacy, pipeline); err != nil {
+		log.Printf("Failed to migrate subscription amounts: %v", err)
+	}
+
+	// Plans from before versioning became version 1
+	unpinned := bson.M{"plan_version": bson.M{"$exists": false}}
+	if _, err := m.collection.UpdateMany(ctx, unpinned, bson.M{"$set": bson.M{"plan_version": 1}}); err != nil {
+		log.Printf("Failed to backfill subscription plan versions: %v", err)
+	}
+}
+
+func (m *SubscriptionManager) UpsertSubscription(ctx context.Context, req *CreateSubscriptionRequest, actor *Actor) (*Subscription, error) {
 	// Get plan details
 	plan, err := m.planManager.GetByID(ctx, req.PlanID)
 	if err != nil {
 		return nil, errors.New("plan not found")
 	}
 
-	// Calculate expiry date
 	now := time.Now()
-	var expiryDate time.Time
-	switch plan.Duration {
-	case "monthly":
-		expiryDate = now.AddDate(0, 1, 0)
-	case "yearly":
-		expiryDate = now.AddDate(1, 0, 0)
-	default:
-		return nil, errors.New("invalid plan duration")
+	previous, err := m.findByLine(ctx, req.UserID, plan.Line())
+	if err == mongo.ErrNoDocuments {
+		previous = nil
+	} else if err != nil {
+		return nil, err
 	}
 
-	subscription := &Subscription{
-		UserID:    req.UserID,
-		PlanID:    req.PlanID,
-		Status:    StatusActive,
-		StartDate: now,
-		ExpiresAt: expiryDate,
-		CreatedAt: now,
+	// Resume first, so the paused time is given back before pricing the change
+	if previous != nil && previous.Status == StatusPaused {
+		if err := m.resume(ctx, previous, now, actor); err != nil {
+			return nil, err
+		}
 	}
 
-	// Upsert subscription
-	filter := bson.M{"user_id": req.UserID}
-	update := bson.M{
-		"$set": bson.M{
-			"plan_id":    subscription.PlanID,
-			"status":     subscription.Status,
-			"start_date": subscription.StartDate,
-			"expires_at": subscription.ExpiresAt,
-			"created_at": subscription.CreatedAt,
-		},
-		"$setOnInsert": bson.M{"_id": primitive.NewObjectID()},
+	// Running subscriptions keep their plan version, even once the plan is archived
+	if previous.keeps(plan) {
+		plan = previous.Plan
+	} else if plan.ArchivedAt != nil {
+		return nil, ErrPlanArchived
+	}
+
+	// Calculate expiry date
+	expiryDate, err := plan.PeriodEnd(now)
+	if err != nil {
+		return nil, err
+	}
+
+	currency, err := req.currencyFor(previous, plan)
+	if err != nil {
+		return nil, err
+	}
+	quantity, addOns := req.quantityFor(previous)
+	total, addOns, err := plan.Total(currency, quantity, addOns)
+	if err != nil {
+		return nil, err
+	}
+	coupon, discount, err := m.discountFor(ctx, req, previous, plan, total, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// Downgrades wait for the end of the paid period
+	if previous != nil && previous.schedulesChange(plan, total) {
+		if coupon != nil {
+			return nil, errors.New("promo codes cannot be used on a downgrade scheduled for renewal")
+		}
+		return m.schedulePlanChange(ctx, previous, plan, quantity, addOns, req.AutoRenew, actor)
+	}
+
+	from := StatusNone
+	if previous != nil {
+		from = previous.Status
 	}
 
-	opts := options.Update().SetUpsert(true)
-	_, err = m.collection.UpdateOne(ctx, filter, update, opts)
+	// Submitting an incomplete purchase again checks on its payment
+	purpose := purchasePurpose(req.UserID, previous, plan, currency, quantity, addOns, total, discount)
+	if from == StatusIncomplete && previous.PaymentID != nil {
+		payment, err := m.payments.Refresh(ctx, *previous.PaymentID)
+		if err != nil {
+			return nil, err
+		}
+		if payment.Purpose == purpose && payment.Status != payments.ChargeFailed {
+			if payment.Paid() {
+				if err := m.activate(ctx, previous, actor); err != nil {
+					return nil, err
+				}
+			}
+			previous.Payment = payment
+			return previous, nil
+		}
+	}
+
+	// A purchase whose payment is still being confirmed keeps its price
+	if pricedAt := m.payments.PricedAt(ctx, purpose); pricedAt != nil && pricedAt.Before(now) {
+		now = *pricedAt
+		if expiryDate, err = plan.PeriodEnd(now); err != nil {
+			return nil, err
+		}
+	}
+
+	proration, err := m.prorate(ctx, previous, plan, discounted(total, discount), now)
 	if err != nil {
 		return nil, err
 	}
 
+	autoRenew := true
+	if req.AutoRenew != nil {
+		autoRenew = *req.AutoRenew
+	} else if from.HasAccess() {
+		autoRenew = previous.AutoRenew
+	}
+
+	// Trials replace the first paid period, once per plan or family
+	status := StatusActive
+	if plan.TrialDays > 0 && !from.HasAccess() && CanTransition(from, StatusTrialing) {
+		claimed, err := m.trialManager.Claim(ctx, req.UserID, plan)
+		if err != nil {
+			return nil, err
+		}
+		if claimed {
+			status = StatusTrialing
+			expiryDate = now.AddDate(0, 0, plan.TrialDays)
+			proration = nil
+		}
+	}
+
+	if err := checkTransition(from, status); err != nil {
+		return nil, err
+	}
+
+	subscriptionID := primitive.NewObjectID()
+	if previous != nil {
+		subscriptionID = previous.ID
+	}
+	event := &SubscriptionEvent{
+		ID:             primitive.NewObjectID(),
+		SubscriptionID: subscriptionID,
+		UserID:         req.UserID,
+		Type:           EventCreated,
+		PreviousStatus: from,
+		PlanID:         plan.ID,
+		PlanVersion:    plan.Version,
+		Price:          total,
+		Discount:       discount.amount(),
+		Status:         status,
+		PeriodStart:    now,
+		PeriodEnd:      expiryDate,
+		Proration:      proration,
+		Actor:          actor,
+		OccurredAt:     now,
+	}
+	if previous != nil {
+		previousAmount := previous.amount()
+		event.Type = planChangeType(previous.PlanID, previousAmount, plan.ID, total)
+		event.PreviousPlanID = &previous.PlanID
+		event.PreviousPrice = &previousAmount
+	}
+	if status == StatusTrialing {
+		event.Type = EventTrialStarted
+	}
+
+	if coupon != nil {
+		if err := m.couponManager.Redeem(ctx, coupon); err != nil {
+			if status == StatusTrialing {
+				m.trialManager.Release(ctx, req.UserID, plan)
+			}
+			return nil, err
+		}
+	}
+
+	// Paid periods use up credit first, then are charged before they are written
+	var payment *Payment
+	events := []*SubscriptionEvent{event}
+	if status == StatusActive {
+		payment, err = m.payments.Collect(ctx, req.UserID, subscriptionID, purpose, events, req.PaymentMethod)
+		if err == nil && payment != nil && !payment.Paid() {
+			if payment.Status == payments.ChargeFailed || from.HasAccess() {
+				err = &PaymentError{Payment: payment}
+			} else {
+				status, event.Status = StatusIncomplete, StatusIncomplete
+			}
+		}
+		if err == nil {
+			err = m.payments.SpendCredit(ctx, req.UserID, events)
+		}
+	} else if req.PaymentMethod != "" {
+		err = m.payments.SavePaymentMethod(ctx, req.UserID, req.PaymentMethod)
+	}
+	if err != nil {
+		if status == StatusTrialing {
+			m.trialManager.Release(ctx, req.UserID, plan)
+		}
+		if coupon != nil {
+			m.couponManager.Release(ctx, coupon)
+		}
+		return nil, err
+	}
+
+	set := bson.M{
+		"plan_id":      req.PlanID,
+		"plan_version": plan.Version,
+		"product_line": plan.Line(),
+		"currency":     currency,
+		"quantity":     quantity,
+		"add_ons":      addOns,
+		"total":        total,
+		"status":       status,
+		"start_date":   now,
+		"expires_at":   expiryDate,
+		"auto_renew":   autoRenew,
+		"last_actor":   actor,
+	}
+	unset := bson.M{
+		"cancel_at": "",
+		"paused_at": "",
+		"resume_at": "",
+		"dunning":   "",
+	}
+	for field := range pendingChangeFields() {
+		unset[field] = ""
+	}
+	if status == StatusTrialing {
+		set["trial_end"] = expiryDate
+	} else {
+		unset["trial_end"] = ""
+	}
+	if discount != nil {
+		set["discount"] = discount
+	} else {
+		unset["discount"] = ""
+	}
+	if status == StatusIncomplete {
+		set["payment_id"] = payment.ID
+	} else {
+		unset["payment_id"] = ""
+	}
+
+	// Guarding on the status read makes a concurrent change hit the unique index
+	filter := bson.M{"user_id": req.UserID, "product_line": plan.Line(), "status": from}
+	update := bson.M{
+		"$set":         set,
+		"$unset":       unset,
+		"$setOnInsert": bson.M{"_id": subscriptionID, "created_at": now},
+	}
+
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var subscription Subscription
+	if err := m.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&subscription); err != nil {
+		if status == StatusTrialing {
+			m.trialManager.Release(ctx, req.UserID, plan)
+		}
+		if coupon != nil {
+			m.couponManager.Release(ctx, coupon)
+		}
+		m.payments.ReturnCredit(ctx, req.UserID, events)
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrConcurrentUpdate
+		}
+		return nil, err
+	}
+
 	subscription.Plan = plan
-	log.Printf("Subscription upserted for user %s", req.UserID)
-	return subscription, nil
+	subscription.Proration = proration
+	m.transitioned(ctx, &subscription, event)
+
+	// An incomplete purchase replaced by this one will not be paid for
+	if previous != nil && previous.PaymentID != nil && (payment == nil || *previous.PaymentID != payment.ID) {
+		m.abandonPayment(ctx, previous, previous.PaymentID)
+	}
+	if payment != nil {
+		payment = m.applyPayment(ctx, payment, events)
+		subscription.Payment = payment
+		// The charge may have gone through while the purchase was written
+		if subscription.Status == StatusIncomplete && payment.Paid() {
+			if err := m.activate(ctx, &subscription, actor); err != nil && err != ErrConcurrentUpdate {
+				log.Printf("Failed to activate subscription for user %s: %v", req.UserID, err)
+			}
+		}
+	}
+
+	log.Printf("Subscription upserted for user %s in product line %s", req.UserID, plan.Line())
+	return &subscription, nil
+}
+
+// PreviewChange prices the change req would make without applying it.
+func (m *SubscriptionManager) PreviewChange(ctx context.Context, req *CreateSubscriptionRequest) (*Proration, error) {
+	plan, err := m.planManager.GetByID(ctx, req.PlanID)
+	if err != nil {
+		return nil, errors.New("plan not found")
+	}
+
+	current, err := m.findByLine(ctx, req.UserID, plan.Line())
+	if err == mongo.ErrNoDocuments {
+		current = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if current.keeps(plan) {
+		plan = current.Plan
+	} else if plan.ArchivedAt != nil {
+		return nil, ErrPlanArchived
+	}
+
+	now := time.Now()
+	if plan.TrialDays > 0 && (current == nil || !current.Status.HasAccess()) {
+		used, err := m.trialManager.HasUsed(ctx, req.UserID, plan)
+		if err != nil {
+			return nil, err
+		}
+		if !used {
+			return &Proration{
+				NewPlanID:   plan.ID,
+				ChangeAt:    now,
+				PeriodStart: now,
+				PeriodEnd:   now.AddDate(0, 0, plan.TrialDays),
+				TrialDays:   plan.TrialDays,
+			}, nil
+		}
+	}
+
+	currency, err := req.currencyFor(current, plan)
+	if err != nil {
+		return nil, err
+	}
+	quantity, addOns := req.quantityFor(current)
+	total, _, err := plan.Total(currency, quantity, addOns)
+	if err != nil {
+		return nil, err
+	}
+	coupon, discount, err := m.discountFor(ctx, req, current, plan, total, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if current != nil && current.schedulesChange(plan, total) {
+		if coupon != nil {
+			return nil, errors.New("promo codes cannot be used on a downgrade scheduled for renewal")
+		}
+		proration, err := CalculateProration(current.Plan, current.charge(), current.StartDate, current.ExpiresAt, plan, total, current.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		proration.CurrentPlanID = &current.PlanID
+		proration.Scheduled = true
+		return proration, nil
+	}
+
+	return m.prorate(ctx, current, plan, discounted(total, discount), now)
+}
+
+// discountFor leaves counting a redemption to the caller.
+func (m *SubscriptionManager) discountFor(ctx context.Context, req *CreateSubscriptionRequest, previous *Subscription, plan *Plan, total Money, now time.Time) (*Coupon, *Discount, error) {
+	running := previous != nil && previous.Status.HasAccess()
+	if req.PromoCode == "" {
+		if !running {
+			return nil, nil, nil
+		}
+		return nil, previous.Discount.carriedTo(plan, total), nil
+	}
+
+	coupon, err := m.couponManager.Find(ctx, req.PromoCode, plan)
+	if err != nil {
+		return nil, nil, err
+	}
+	if running && previous.Discount != nil && previous.Discount.CouponID == coupon.ID {
+		return nil, nil, errors.New("this promo code is already applied to the subscription")
+	}
+	discount, err := coupon.discount(total, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	return coupon, discount, nil
+}
+
+// keeps reports whether s stays on its plan version when buying plan.
+func (s *Subscription) keeps(plan *Plan) bool {
+	return s != nil && s.Status.HasAccess() && s.PlanID == plan.ID && s.Plan != nil
+}
+
+// prorate credits the unused part of current's period if it is still active.
+func (m *SubscriptionManager) prorate(ctx context.Context, current *Subscription, plan *Plan, total Money, now time.Time) (*Proration, error) {
+	var currentPlan *Plan
+	var currentAmount Money
+	var periodStart, periodEnd time.Time
+	if current != nil && current.Status == StatusActive {
+		if p, err := m.planOf(ctx, current); err == nil {
+			currentPlan, periodStart, periodEnd = p, current.StartDate, current.ExpiresAt
+			currentAmount = current.charge()
+		}
+	}
+	return CalculateProration(currentPlan, currentAmount, periodStart, periodEnd, plan, total, now)
+}
+
+// GetSubscription applies lifecycle changes that are due.
+func (m *SubscriptionManager) GetSubscription(ctx context.Context, subscriptionID string) (*Subscription, error) {
+	objectID, err := primitive.ObjectIDFromHex(subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	return m.findOne(ctx, bson.M{"_id": objectID})
+}
+
+func (m *SubscriptionManager) ListSubscriptions(ctx context.Context, userID string) ([]Subscription, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := m.collection.Find(ctx, bson.M{"user_id": userID}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	subscriptions := []Subscription{}
+	if err := cursor.All(ctx, &subscriptions); err != nil {
+		return nil, err
+	}
+	for i := range subscriptions {
+		m.refresh(ctx, &subscriptions[i])
+	}
+	return subscriptions, nil
 }
 
-func (m *SubscriptionManager) GetSubscription(ctx context.Context, userID string) (*Subscription, error) {
+// OwnerOf returns the ID of the user holding a subscription.
+func (m *SubscriptionManager) OwnerOf(ctx context.Context, subscriptionID string) (string, error) {
+	objectID, err := primitive.ObjectIDFromHex(subscriptionID)
+	if err != nil {
+		return "", err
+	}
+
 	var subscription Subscription
-	err := m.collection.FindOne(ctx, bson.M{"user_id": userID}).Decode(&subscription)
+	opts := options.FindOne().SetProjection(bson.M{"user_id": 1})
+	if err := m.collection.FindOne(ctx, bson.M{"_id": objectID}, opts).Decode(&subscription); err != nil {
+		return "", err
+	}
+	return subscription.UserID, nil
+}
+
+// PlanSubscriber is a running subscription on a plan or moving to it.
+type PlanSubscriber struct {
+	SubscriptionID primitive.ObjectID  `json:"subscription_id" bson:"_id"`
+	UserID         string              `json:"user_id" bson:"user_id"`
+	Status         SubscriptionStatus  `json:"status" bson:"status"`
+	PlanID         primitive.ObjectID  `json:"plan_id" bson:"plan_id"`
+	PlanVersion    int                 `json:"plan_version" bson:"plan_version"`
+	PendingPlanID  *primitive.ObjectID `json:"pending_plan_id,omitempty" bson:"pending_plan_id,omitempty"`
+}
+
+// PlanSubscribers includes paused and INCOMPLETE subscriptions.
+func (m *SubscriptionManager) PlanSubscribers(ctx context.Context, planID primitive.ObjectID) ([]PlanSubscriber, error) {
+	running := append([]SubscriptionStatus{StatusPaused, StatusIncomplete}, accessStatuses...)
+	filter := bson.M{
+		"status": bson.M{"$in": running},
+		"$or":    bson.A{bson.M{"plan_id": planID}, bson.M{"pending_plan_id": planID}},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := m.collection.Find(ctx, filter, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	// Check if expired and update status
-	if subscription.Status == StatusActive && time.Now().After(subscription.ExpiresAt) {
-		subscription.Status = StatusExpired
-		m.collection.UpdateOne(ctx, bson.M{"user_id": userID}, bson.M{"$set": bson.M{"status": StatusExpired}})
+	subscribers := []PlanSubscriber{}
+	err = cursor.All(ctx, &subscribers)
+	return subscribers, err
+}
+
+// DeletePlan archives the plan before counting subscribers, so none can start on
+// it meanwhile, and only deletes it if it is still archived.
+func (m *SubscriptionManager) DeletePlan(ctx context.Context, planID primitive.ObjectID) ([]PlanSubscriber, error) {
+	plan, err := m.planManager.GetByID(ctx, planID)
+	if err != nil {
+		return nil, err
+	}
+	archivedAt := plan.ArchivedAt
+	if archivedAt == nil {
+		archived, err := m.planManager.Archive(ctx, planID)
+		if err != nil {
+			return nil, err
+		}
+		archivedAt = archived.ArchivedAt
+	}
+
+	subscribers, err := m.PlanSubscribers(ctx, planID)
+	if err == nil && len(subscribers) == 0 {
+		if err = m.planManager.deleteArchived(ctx, planID, *archivedAt); err == nil {
+			return nil, nil
+		}
+	}
+	if plan.ArchivedAt == nil {
+		if _, unarchiveErr := m.planManager.Unarchive(ctx, planID); unarchiveErr != nil {
+			log.Printf("Failed to put plan %s back on sale: %v", planID.Hex(), unarchiveErr)
+		}
+	}
+	return subscribers, err
+}
+
+func (m *SubscriptionManager) findByLine(ctx context.Context, userID, line string) (*Subscription, error) {
+	return m.findOne(ctx, bson.M{"user_id": userID, "product_line": line})
+}
+
+func (m *SubscriptionManager) findOne(ctx context.Context, filter bson.M) (*Subscription, error) {
+	var subscription Subscription
+	if err := m.collection.FindOne(ctx, filter).Decode(&subscription); err != nil {
+		return nil, err
 	}
+	m.refresh(ctx, &subscription)
+	return &subscription, nil
+}
 
+// refresh applies lifecycle changes that are already due.
+func (m *SubscriptionManager) refresh(ctx context.Context, subscription *Subscription) {
 	// Get plan details
-	if plan, err := m.planManager.GetByID(ctx, subscription.PlanID); err == nil {
+	if plan, err := m.planOf(ctx, subscription); err == nil {
 		subscription.Plan = plan
 	}
 
-	return &subscription, nil
+	// The sweeper may not have run yet. Losing a race to it is harmless
+	now := time.Now()
+	if subscription.Status == StatusPaused && subscription.ResumeAt != nil && !now.Before(*subscription.ResumeAt) {
+		if err := m.resume(ctx, subscription, *subscription.ResumeAt, nil); err != nil && err != ErrConcurrentUpdate {
+			log.Printf("Failed to resume subscription for user %s: %v", subscription.UserID, err)
+		}
+	}
+
+	if subscription.Status.HasAccess() && subscription.CancelAt != nil && !now.Before(*subscription.CancelAt) {
+		guard := bson.M{"cancel_at": subscription.CancelAt}
+		if err := m.transition(ctx, subscription, StatusCancelled, EventCancelled, guard, nil, nil); err != nil && err != ErrConcurrentUpdate {
+			log.Printf("Failed to cancel subscription for user %s: %v", subscription.UserID, err)
+		}
+	}
+
+	if subscription.inPeriod() && subscription.AutoRenew && subscription.CancelAt == nil && now.After(subscription.ExpiresAt) {
+		if _, err := m.renew(ctx, subscription, now); err != nil {
+			log.Printf("Failed to renew subscription for user %s: %v", subscription.UserID, err)
+		}
+	}
+
+	// A lapsed period enters the plan's grace period first
+	if subscription.inPeriod() && now.After(subscription.ExpiresAt) {
+		if err := m.lapse(ctx, subscription, now); err != nil && err != ErrConcurrentUpdate {
+			log.Printf("Failed to lapse subscription for user %s: %v", subscription.UserID, err)
+		}
+	}
+
+	if subscription.Status == StatusPastDue && subscription.Dunning != nil && now.After(subscription.Dunning.GraceEnd) {
+		guard := bson.M{"dunning.grace_end": subscription.Dunning.GraceEnd}
+		if err := m.transition(ctx, subscription, StatusExpired, EventExpired, guard, nil, nil); err != nil && err != ErrConcurrentUpdate {
+			log.Printf("Failed to expire subscription for user %s: %v", subscription.UserID, err)
+		}
+	}
 }
 
-func (m *SubscriptionManager) CancelSubscription(ctx context.Context, userID string) error {
-	subscription, err := m.GetSubscription(ctx, userID)
+// CancelSubscription at period end stops renewal until the sweeper cancels it.
+func (m *SubscriptionManager) CancelSubscription(ctx context.Context, subscriptionID string, mode CancelMode, actor *Actor) (*Subscription, error) {
+	subscription, err := m.GetSubscription(ctx, subscriptionID)
 	if err != nil {
-		return errors.New("subscription not found")
+		return nil, errors.New("subscription not found")
 	}
 
-	if subscription.Status != StatusActive {
-		return errors.New("can only cancel active subscriptions")
+	if err := checkTransition(subscription.Status, StatusCancelled); err != nil {
+		return nil, err
+	}
+
+	// Past due periods are already over, and incomplete ones never started
+	if subscription.Status == StatusPastDue || subscription.Status == StatusIncomplete {
+		mode = CancelImmediately
 	}
 
-	_, err = m.collection.UpdateOne(
+	switch mode {
+	case CancelAtPeriodEnd:
+		if subscription.CancelAt != nil {
+			return nil, errors.New("subscription is already scheduled for cancellation")
+		}
+		// Cancelling supersedes a scheduled plan change
+		cancelAt := subscription.ExpiresAt
+		subscription.CancelAt = &cancelAt
+		subscription.clearPendingChange()
+		update := bson.M{
+			"$set":   bson.M{"cancel_at": cancelAt},
+			"$unset": pendingChangeFields(),
+		}
+		guard := bson.M{"cancel_at": bson.M{"$exists": false}}
+		err = m.transition(ctx, subscription, subscription.Status, EventCancellationScheduled, guard, update, actor)
+
+	case CancelImmediately:
+		err = m.cancelNow(ctx, subscription, EventCancelled, actor)
+
+	default:
+		return nil, errors.New("invalid cancellation mode")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+// cancelNow also abandons the payment the subscription was waiting for.
+func (m *SubscriptionManager) cancelNow(ctx context.Context, subscription *Subscription, eventType SubscriptionEventType, actor *Actor) error {
+	paymentID := subscription.PaymentID
+	subscription.AutoRenew = false
+	subscription.CancelAt, subscription.PausedAt, subscription.ResumeAt = nil, nil, nil
+	subscription.Dunning, subscription.PaymentID = nil, nil
+	subscription.clearPendingChange()
+	unset := pendingChangeFields()
+	for _, field := range []string{"cancel_at", "paused_at", "resume_at", "dunning", "payment_id"} {
+		unset[field] = ""
+	}
+	update := bson.M{"$set": bson.M{"auto_renew": false}, "$unset": unset}
+	guard := bson.M{"payment_id": paymentID}
+	if err := m.transition(ctx, subscription, StatusCancelled, eventType, guard, update, actor); err != nil {
+		return err
+	}
+	m.abandonPayment(ctx, subscription, paymentID)
+	return nil
+}
+
+// UndoCancellation removes a scheduled cancellation before the period ends.
+func (m *SubscriptionManager) UndoCancellation(ctx context.Context, subscriptionID string, actor *Actor) (*Subscription, error) {
+	subscription, err := m.GetSubscription(ctx, subscriptionID)
+	if err != nil {
+		return nil, errors.New("subscription not found")
+	}
+
+	if subscription.CancelAt == nil || !time.Now().Before(*subscription.CancelAt) {
+		return nil, errors.New("no scheduled cancellation to undo")
+	}
+
+	guard := bson.M{"cancel_at": subscription.CancelAt}
+	update := bson.M{"$unset": bson.M{"cancel_at": ""}}
+	subscription.CancelAt = nil
+	if err := m.transition(ctx, subscription, subscription.Status, EventCancellationUndone, guard, update, actor); err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+// PauseSubscription pauses for up to the plan's MaxPauseDays.
+func (m *SubscriptionManager) PauseSubscription(ctx context.Context, subscriptionID string, req *PauseRequest, actor *Actor) (*Subscription, error) {
+	subscription, err := m.GetSubscription(ctx, subscriptionID)
+	if err != nil {
+		return nil, errors.New("subscription not found")
+	}
+
+	if err := checkTransition(subscription.Status, StatusPaused); err != nil {
+		return nil, err
+	}
+	if subscription.Plan == nil || !subscription.Plan.CanPause() {
+		return nil, errors.New("this plan cannot be paused")
+	}
+
+	days := req.Days
+	if days == 0 {
+		days = subscription.Plan.MaxPauseDays
+	}
+	if days > subscription.Plan.MaxPauseDays {
+		return nil, fmt.Errorf("pause cannot exceed %d days", subscription.Plan.MaxPauseDays)
+	}
+
+	now := time.Now()
+	resumeAt := now.AddDate(0, 0, days)
+	subscription.PausedAt, subscription.ResumeAt = &now, &resumeAt
+	update := bson.M{"$set": bson.M{"paused_at": now, "resume_at": resumeAt}}
+	if err := m.transition(ctx, subscription, StatusPaused, EventPaused, nil, update, actor); err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+func (m *SubscriptionManager) ResumeSubscription(ctx context.Context, subscriptionID string, actor *Actor) (*Subscription, error) {
+	subscription, err := m.GetSubscription(ctx, subscriptionID)
+	if err != nil {
+		return nil, errors.New("subscription not found")
+	}
+
+	if subscription.Status != StatusPaused {
+		return nil, &TransitionError{From: subscription.Status, To: StatusActive}
+	}
+
+	if err := m.resume(ctx, subscription, time.Now(), actor); err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+// resume pushes ExpiresAt and any scheduled change back by the time spent paused.
+func (m *SubscriptionManager) resume(ctx context.Context, subscription *Subscription, at time.Time, actor *Actor) error {
+	if subscription.PausedAt == nil {
+		return errors.New("subscription has no pause start")
+	}
+
+	paused := at.Sub(*subscription.PausedAt)
+	if paused < 0 {
+		paused = 0
+	}
+
+	subscription.ExpiresAt = subscription.ExpiresAt.Add(paused)
+	set := bson.M{"expires_at": subscription.ExpiresAt}
+	if subscription.CancelAt != nil {
+		cancelAt := subscription.CancelAt.Add(paused)
+		subscription.CancelAt = &cancelAt
+		set["cancel_at"] = cancelAt
+	}
+	if subscription.ChangeEffectiveAt != nil {
+		changeAt := subscription.ChangeEffectiveAt.Add(paused)
+		subscription.ChangeEffectiveAt = &changeAt
+		set["change_effective_at"] = changeAt
+	}
+	subscription.PausedAt, subscription.ResumeAt = nil, nil
+
+	update := bson.M{"$set": set, "$unset": bson.M{"paused_at": "", "resume_at": ""}}
+	return m.transition(ctx, subscription, StatusActive, EventResumed, nil, update, actor)
+}
+
+// ResumeDue resumes paused subscriptions whose pause has run its full length.
+func (m *SubscriptionManager) ResumeDue(ctx context.Context, now time.Time, limit int) (int, error) {
+	due := bson.M{"status": StatusPaused, "resume_at": bson.M{"$lte": now}}
+	return m.eachDue(ctx, due, limit, "resume", func(subscription *Subscription) error {
+		return m.resume(ctx, subscription, *subscription.ResumeAt, nil)
+	})
+}
+
+func (m *SubscriptionManager) SetAutoRenew(ctx context.Context, subscriptionID string, autoRenew bool, actor *Actor) (*Subscription, error) {
+	objectID, err := primitive.ObjectIDFromHex(subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := m.collection.UpdateOne(
 		ctx,
-		bson.M{"user_id": userID},
-		bson.M{"$set": bson.M{"status": StatusCancelled}},
+		bson.M{"_id": objectID, "status": bson.M{"$in": accessStatuses}},
+		bson.M{"$set": bson.M{"auto_renew": autoRenew, "last_actor": actor}},
 	)
-	return err
+	if err != nil {
+		return nil, err
+	}
+	if result.MatchedCount == 0 {
+		return nil, errors.New("no active subscription found")
+	}
+	return m.GetSubscription(ctx, subscriptionID)
+}
+
+// transition fails with ErrConcurrentUpdate unless the subscription still has
+// the status it was read with and matches guard.
+func (m *SubscriptionManager) transition(ctx context.Context, subscription *Subscription, to SubscriptionStatus, eventType SubscriptionEventType, guard, update bson.M, actor *Actor) error {
+	from := subscription.Status
+	if err := checkTransition(from, to); err != nil {
+		return err
+	}
+
+	filter := bson.M{"_id": subscription.ID, "status": from}
+	for key, value := range guard {
+		filter[key] = value
+	}
+
+	set := bson.M{"status": to}
+	if actor != nil {
+		set["last_actor"] = actor
+	}
+	if extra, ok := update["$set"].(bson.M); ok {
+		for key, value := range extra {
+			set[key] = value
+		}
+	}
+	write := bson.M{"$set": set}
+	if unset, ok := update["$unset"]; ok {
+		write["$unset"] = unset
+	}
+
+	result, err := m.collection.UpdateOne(ctx, filter, write)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrConcurrentUpdate
+	}
+
+	subscription.Status = to
+	if actor != nil {
+		subscription.LastActor = actor
+	}
+	m.transitioned(ctx, subscription, subscription.newEvent(eventType, from, actor))
+	return nil
+}
+
+// RenewDue returns how many subscriptions it tried, so the sweeper drains the
+// queue. Failed renewals are marked and left to the expiry sweep.
+func (m *SubscriptionManager) RenewDue(ctx context.Context, now time.Time, limit int) (int, error) {
+	due := bson.M{
+		"status":     bson.M{"$in": periodStatuses},
+		"auto_renew": true,
+		"cancel_at":  bson.M{"$exists": false},
+		"expires_at": bson.M{"$lt": now},
+		"$or": bson.A{
+			bson.M{"renewal_failed_at": bson.M{"$exists": false}},
+			bson.M{"renewal_failed_at": bson.M{"$lt": now}},
+		},
+	}
+	cursor, err := m.collection.Find(ctx, due, options.Find().SetLimit(int64(limit)))
+	if err != nil {
+		return 0, err
+	}
+
+	var subscriptions []Subscription
+	if err := cursor.All(ctx, &subscriptions); err != nil {
+		return 0, err
+	}
+
+	for i := range subscriptions {
+		subscription := &subscriptions[i]
+		if _, err := m.renew(ctx, subscription, now); err != nil {
+			log.Printf("Failed to renew subscription for user %s: %v", subscription.UserID, err)
+			m.markRenewalFailed(ctx, subscription, now)
+		}
+	}
+	return len(subscriptions), nil
+}
+
+func (m *SubscriptionManager) markRenewalFailed(ctx context.Context, subscription *Subscription, now time.Time) {
+	_, err := m.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": subscription.ID, "expires_at": subscription.ExpiresAt},
+		bson.M{"$set": bson.M{"renewal_failed_at": now}},
+	)
+	if err != nil {
+		log.Printf("Failed to mark renewal of subscription %s failed: %v", subscription.ID.Hex(), err)
+	}
+}
+
+// renew catches up one period at a time, applying pending changes, migrations and
+// discounts as it goes. It returns false if another writer changed it first.
+func (m *SubscriptionManager) renew(ctx context.Context, subscription *Subscription, now time.Time) (bool, error) {
+	from := subscription.Status
+	if err := checkTransition(from, StatusActive); err != nil {
+		return false, err
+	}
+
+	plan, err := m.planOf(ctx, subscription)
+	if err != nil {
+		return false, errors.New("plan not found")
+	}
+
+	subscription.Plan = plan
+	quantity, addOns, total := subscription.Quantity, subscription.AddOns, subscription.amount()
+
+	var pending *Plan
+	var pendingTotal Money
+	var pendingAddOns []AddOnItem
+	if subscription.PendingPlanID != nil {
+		if pending, err = m.planManager.GetVersion(ctx, *subscription.PendingPlanID, subscription.PendingPlanVersion); err != nil {
+			return false, errors.New("pending plan not found")
+		}
+		if pendingTotal, pendingAddOns, err = subscription.pendingTotal(pending); err != nil {
+			return false, err
+		}
+	}
+
+	migrated, migratedTotal, migratedAddOns := m.migration(ctx, subscription)
+	repriced := false
+	discount := subscription.Discount
+
+	var events []*SubscriptionEvent
+	status := from
+	start, end := subscription.StartDate, subscription.ExpiresAt
+	for !end.After(now) {
+		previous, previousTotal := plan, total
+		eventType := EventRenewed
+		if pending != nil && !end.Before(*subscription.ChangeEffectiveAt) {
+			plan, pending, migrated = pending, nil, nil
+			quantity, addOns, total = max(subscription.PendingQuantity, 1), pendingAddOns, pendingTotal
+			eventType = planChangeType(previous.ID, previousTotal, plan.ID, total)
+			repriced = true
+		} else if migrated != nil {
+			plan, migrated = migrated, nil
+			addOns, total = migratedAddOns, migratedTotal
+			eventType = planChangeType(previous.ID, previousTotal, plan.ID, total)
+			repriced = true
+		}
+		if status == StatusTrialing {
+			eventType = EventTrialConverted
+		} else {
+			discount = discount.next()
+		}
+		if repriced {
+			discount = discount.carriedTo(plan, total)
+		}
+
+		next, err := plan.PeriodEnd(end)
+		if err != nil {
+			return false, err
+		}
+		events = append(events, &SubscriptionEvent{
+			ID:             primitive.NewObjectID(),
+			SubscriptionID: subscription.ID,
+			UserID:         subscription.UserID,
+			Type:           eventType,
+			PreviousPlanID: &previous.ID,
+			PreviousPrice:  &previousTotal,
+			PreviousStatus: status,
+			PlanID:         plan.ID,
+			PlanVersion:    plan.Version,
+			Price:          total,
+			Discount:       discount.amount(),
+			Status:         StatusActive,
+			PeriodStart:    end,
+			PeriodEnd:      next,
+			OccurredAt:     now,
+			Renewal:        true,
+		})
+		start, end, status = end, next, StatusActive
+	}
+	// Trials are free, their usage included
+	if from != StatusTrialing && len(events) > 0 {
+		overage, err := m.overage(ctx, subscription)
+		if err != nil {
+			return false, err
+		}
+		events[0].Overage = overage
+	}
+
+	payment, err := m.payments.Collect(ctx, subscription.UserID, subscription.ID, renewalPurpose(subscription), events, "")
+	if err != nil {
+		return false, err
+	}
+	if payment != nil && !payment.Paid() {
+		return false, &PaymentError{Payment: payment}
+	}
+	if err := m.payments.SpendCredit(ctx, subscription.UserID, events); err != nil {
+		return false, err
+	}
+
+	set := bson.M{"status": status, "plan_id": plan.ID, "plan_version": plan.Version, "start_date": start, "expires_at": end}
+	unset := bson.M{"dunning": ""}
+	if repriced {
+		set["quantity"], set["add_ons"], set["total"] = max(quantity, 1), addOns, total
+	}
+	if discount != nil {
+		set["discount"] = discount
+	} else {
+		unset["discount"] = ""
+	}
+	if pending == nil && subscription.PendingPlanID != nil {
+		for field := range pendingChangeFields() {
+			unset[field] = ""
+		}
+	}
+	result, err := m.collection.UpdateOne(
+		ctx,
+		bson.M{
+			"_id":             subscription.ID,
+			"status":          from,
+			"expires_at":      subscription.ExpiresAt,
+			"plan_version":    subscription.PlanVersion,
+			"pending_plan_id": subscription.PendingPlanID,
+		},
+		bson.M{
+			"$set":   set,
+			"$unset": unset,
+		},
+	)
+	if err != nil || result.ModifiedCount == 0 {
+		m.payments.ReturnCredit(ctx, subscription.UserID, events)
+		if err == nil && payment != nil {
+			m.releaseRenewal(ctx, subscription, payment)
+		}
+		return false, err
+	}
+
+	subscription.Status, subscription.StartDate, subscription.ExpiresAt = status, start, end
+	subscription.Dunning, subscription.Discount = nil, discount
+	subscription.PlanID, subscription.PlanVersion, subscription.Plan = plan.ID, plan.Version, plan
+	if repriced {
+		subscription.Quantity, subscription.AddOns, subscription.Total = max(quantity, 1), addOns, total
+	}
+	if pending == nil && subscription.PendingPlanID != nil {
+		subscription.clearPendingChange()
+	}
+	for _, event := range events {
+		m.transitioned(ctx, subscription, event)
+	}
+	if payment != nil {
+		subscription.Payment = m.applyPayment(ctx, payment, events)
+	}
+	return true, nil
+}
+
+// releaseRenewal keeps the charge for a retry, or for a writer that renewed the
+// period first, and only abandons it once the subscription stopped renewing.
+func (m *SubscriptionManager) releaseRenewal(ctx context.Context, subscription *Subscription, payment *Payment) {
+	var current Subscription
+	if err := m.collection.FindOne(ctx, bson.M{"_id": subscription.ID}).Decode(&current); err != nil {
+		log.Printf("Failed to reload subscription %s after a lost renewal: %v", subscription.ID.Hex(), err)
+		return
+	}
+	renewing := current.inPeriod() || current.Status == StatusPastDue
+	if renewing || !current.ExpiresAt.Equal(subscription.ExpiresAt) {
+		return
+	}
+	m.abandonPayment(ctx, subscription, &payment.ID)
+}
+
+// migration returns nil if the subscription keeps its version, or the new one
+// cannot price it.
+func (m *SubscriptionManager) migration(ctx context.Context, subscription *Subscription) (*Plan, Money, []AddOnItem) {
+	target, err := m.planManager.MigrationTarget(ctx, subscription.PlanID, subscription.PlanVersion)
+	if err != nil || target == subscription.PlanVersion {
+		return nil, Money{}, nil
+	}
+
+	plan, err := m.planManager.GetVersion(ctx, subscription.PlanID, target)
+	if err != nil {
+		return nil, Money{}, nil
+	}
+	total, addOns, err := plan.Total(subscription.currency(), max(subscription.Quantity, 1), subscription.AddOns)
+	if err != nil {
+		log.Printf("Keeping subscription %s on version %d of its plan: %v", subscription.ID.Hex(), subscription.PlanVersion, err)
+		return nil, Money{}, nil
+	}
+	return plan, total, addOns
+}
+
+// planOf returns the version of the plan the subscription is on.
+func (m *SubscriptionManager) planOf(ctx context.Context, subscription *Subscription) (*Plan, error) {
+	return m.planManager.GetVersion(ctx, subscription.PlanID, subscription.PlanVersion)
+}
+
+// CancelDue applies scheduled cancellations whose time has passed.
+func (m *SubscriptionManager) CancelDue(ctx context.Context, now time.Time, limit int) (int, error) {
+	due := bson.M{"cancel_at": bson.M{"$lte": now}}
+	return m.transitionAllDue(ctx, due, StatusCancelled, EventCancelled, limit)
+}
+
+// ExpireDue expires ended periods that LapseDue does not handle, and past due
+// subscriptions whose grace period is over.
+func (m *SubscriptionManager) ExpireDue(ctx context.Context, now time.Time, limit int) (int, error) {
+	gracePlans, err := m.planManager.GracePlanIDs(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	due := bson.M{
+		"expires_at":      bson.M{"$lt": now},
+		"plan_id":         bson.M{"$nin": gracePlans},
+		"pending_plan_id": bson.M{"$exists": false},
+		// Auto-renewing subscriptions only expire once this period's renewal failed
+		"$or": bson.A{
+			bson.M{"auto_renew": bson.M{"$ne": true}},
+			bson.M{"cancel_at": bson.M{"$exists": true}},
+			bson.M{"$expr": bson.M{"$gte": bson.A{"$renewal_failed_at", "$expires_at"}}},
+		},
+	}
+	for _, from := range periodStatuses {
+		changed, err := m.transitionDue(ctx, due, from, StatusExpired, EventExpired, limit)
+		total += changed
+		if err != nil {
+			return total, err
+		}
+	}
+
+	due = bson.M{"dunning.grace_end": bson.M{"$lt": now}}
+	changed, err := m.transitionDue(ctx, due, StatusPastDue, StatusExpired, EventExpired, limit)
+	return total + changed, err
+}
+
+func (m *SubscriptionManager) transitionAllDue(ctx context.Context, due bson.M, to SubscriptionStatus, eventType SubscriptionEventType, limit int) (int, error) {
+	total := 0
+	for _, from := range accessStatuses {
+		changed, err := m.transitionDue(ctx, due, from, to, eventType, limit)
+		total += changed
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// transitionDue tags its batch so only the documents it changed get an event,
+// and a crash before they do leaves the tag for RecoverSweepsDue.
+func (m *SubscriptionManager) transitionDue(ctx context.Context, due bson.M, from, to SubscriptionStatus, eventType SubscriptionEventType, limit int) (int, error) {
+	if err := checkTransition(from, to); err != nil {
+		return 0, err
+	}
+
+	filter := bson.M{"status": from}
+	for key, value := range due {
+		filter[key] = value
+	}
+
+	opts := options.Find().SetLimit(int64(limit)).SetProjection(bson.M{"_id": 1})
+	cursor, err := m.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	var candidates []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &candidates); err != nil {
+		return 0, err
+	}
+	if len(candidates) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]primitive.ObjectID, len(candidates))
+	for i, c := range candidates {
+		ids[i] = c.ID
+	}
+
+	tag := sweepTag{ID: primitive.NewObjectID(), From: from, Event: eventType}
+	_, err = m.collection.UpdateMany(
+		ctx,
+		bson.M{"_id": bson.M{"$in": ids}, "status": from},
+		bson.M{"$set": bson.M{"status": to, "sweep": tag}},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return m.emitSwept(ctx, bson.M{"_id": bson.M{"$in": ids}, "sweep.id": tag.ID})
+}
+
+// sweepTag marks a bulk transition until its events are emitted.
+type sweepTag struct {
+	ID    primitive.ObjectID    `bson:"id"`
+	From  SubscriptionStatus    `bson:"from"`
+	Event SubscriptionEventType `bson:"event"`
+}
+
+// sweepTagTimeout is how long a tag can be left before it is taken as a crashed sweep's.
+const sweepTagTimeout = 5 * time.Minute
+
+// RecoverSweepsDue emits the events of bulk transitions a crash left tagged.
+func (m *SubscriptionManager) RecoverSweepsDue(ctx context.Context, now time.Time, limit int) (int, error) {
+	stale := primitive.NewObjectIDFromTimestamp(now.Add(-sweepTagTimeout))
+	cursor, err := m.collection.Find(
+		ctx,
+		bson.M{"sweep.id": bson.M{"$lt": stale}},
+		options.Find().SetLimit(int64(limit)).SetProjection(bson.M{"_id": 1}),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	var tagged []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &tagged); err != nil {
+		return 0, err
+	}
+	if len(tagged) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]primitive.ObjectID, len(tagged))
+	for i, t := range tagged {
+		ids[i] = t.ID
+	}
+	return m.emitSwept(ctx, bson.M{"_id": bson.M{"$in": ids}, "sweep.id": bson.M{"$lt": stale}})
+}
+
+// emitSwept emits the events of the tagged subscriptions, then clears their tags.
+func (m *SubscriptionManager) emitSwept(ctx context.Context, tagged bson.M) (int, error) {
+	cursor, err := m.collection.Find(ctx, tagged)
+	if err != nil {
+		return 0, err
+	}
+	var changed []struct {
+		Subscription `bson:",inline"`
+		Sweep        sweepTag `bson:"sweep"`
+	}
+	if err := cursor.All(ctx, &changed); err != nil {
+		return 0, err
+	}
+
+	type planKey struct {
+		id      primitive.ObjectID
+		version int
+	}
+	plans := make(map[planKey]*Plan)
+	for i := range changed {
+		subscription := &changed[i].Subscription
+		key := planKey{subscription.PlanID, subscription.PlanVersion}
+		plan, cached := plans[key]
+		if !cached {
+			if plan, err = m.planOf(ctx, subscription); err != nil {
+				plan = nil
+			}
+			plans[key] = plan
+		}
+		subscription.Plan = plan
+		m.transitioned(ctx, subscription, subscription.newEvent(changed[i].Sweep.Event, changed[i].Sweep.From, nil))
+
+		done := bson.M{"_id": subscription.ID, "sweep.id": changed[i].Sweep.ID}
+		if _, err := m.collection.UpdateOne(ctx, done, bson.M{"$unset": bson.M{"sweep": ""}}); err != nil {
+			log.Printf("Failed to clear sweep tag of subscription %s: %v", subscription.ID.Hex(), err)
+		}
+	}
+
+	return len(changed), nil
+}
+
+func (m *SubscriptionManager) GetHistory(ctx context.Context, subscriptionID string) ([]SubscriptionEvent, error) {
+	objectID, err := primitive.ObjectIDFromHex(subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	return m.eventManager.ListBySubscription(ctx, objectID)
+}
+
+func (m *SubscriptionManager) GetUserHistory(ctx context.Context, userID string) ([]SubscriptionEvent, error) {
+	return m.eventManager.ListByUser(ctx, userID)
+}
+
+// recordEvent logs failures, since the subscription is already written.
+func (m *SubscriptionManager) recordEvent(ctx context.Context, subscription *Subscription, event *SubscriptionEvent) {
+	if err := m.eventManager.Record(ctx, event); err != nil {
+		log.Printf("Failed to record %s event for user %s: %v", event.Type, event.UserID, err)
+	}
+}
+
+func (s *Subscription) inPeriod() bool {
+	for _, status := range periodStatuses {
+		if s.Status == status {
+			return true
+		}
+	}
+	return false
+}
+
+// newEvent expects Plan to be populated.
+func (s *Subscription) newEvent(eventType SubscriptionEventType, previousStatus SubscriptionStatus, actor *Actor) *SubscriptionEvent {
+	event := &SubscriptionEvent{
+		SubscriptionID:    s.ID,
+		UserID:            s.UserID,
+		Type:              eventType,
+		PreviousPlanID:    &s.PlanID,
+		PreviousStatus:    previousStatus,
+		PlanID:            s.PlanID,
+		PlanVersion:       s.PlanVersion,
+		Status:            s.Status,
+		PeriodStart:       s.StartDate,
+		PeriodEnd:         s.ExpiresAt,
+		Dunning:           s.Dunning,
+		PendingPlanID:     s.PendingPlanID,
+		ChangeEffectiveAt: s.ChangeEffectiveAt,
+		Actor:             actor,
+	}
+	if s.Plan != nil || s.Quantity > 0 {
+		amount := s.amount()
+		event.PreviousPrice = &amount
+		event.Price = amount
+		event.Discount = s.Discount.amount()
+	}
+	return event
 }
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TrialUsage is unique per user and key, which allows one trial each.
+type TrialUsage struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID    string             `json:"user_id" bson:"user_id"`
+	Key       string             `json:"key" bson:"key"`
+	PlanID    primitive.ObjectID `json:"plan_id" bson:"plan_id"`
+	StartedAt time.Time          `json:"started_at" bson:"started_at"`
+}
+
+type TrialManager struct {
+	collection *mongo.Collection
+}
+
+func NewTrialManager(db *mongo.Database) *TrialManager {
+	manager := &TrialManager{
+		collection: db.Collection("trial_usages"),
+	}
+	manager.createIndexes()
+	return manager
+}
+
+func (m *TrialManager) createIndexes() {
+	ctx := context.Background()
+	indexModel := mongo.IndexModel{
+		Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "key", Value: 1}},
+		Options: &options.IndexOptions{Unique: &[]bool{true}[0]},
+	}
+	m.collection.Indexes().CreateOne(ctx, indexModel)
+}
+
+// Claim returns false if the user already had this trial.
+func (m *TrialManager) Claim(ctx context.Context, userID string, plan *Plan) (bool, error) {
+	usage := &TrialUsage{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		Key:       plan.TrialKey(),
+		PlanID:    plan.ID,
+		StartedAt: time.Now(),
+	}
+
+	_, err := m.collection.InsertOne(ctx, usage)
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (m *TrialManager) HasUsed(ctx context.Context, userID string, plan *Plan) (bool, error) {
+	count, err := m.collection.CountDocuments(ctx, bson.M{"user_id": userID, "key": plan.TrialKey()})
+	return count > 0, err
+}
+
+// Release gives a claimed trial back, for when starting it failed.
+func (m *TrialManager) Release(ctx context.Context, userID string, plan *Plan) error {
+	_, err := m.collection.DeleteOne(ctx, bson.M{"user_id": userID, "key": plan.TrialKey()})
+	return err
+}
@@ -0,0 +1,348 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// UsageEvent IDs are chosen by the reporter, which makes retries safe.
+type UsageEvent struct {
+	EventID        string             `json:"event_id" validate:"required,max=200"`
+	SubscriptionID primitive.ObjectID `json:"subscription_id" validate:"required"`
+	Key            string             `json:"key" validate:"required"`
+	Quantity       int64              `json:"quantity" validate:"min=1"`
+	OccurredAt     *time.Time         `json:"occurred_at,omitempty"`
+}
+
+type RecordUsageRequest struct {
+	Events []UsageEvent `json:"events" validate:"required,min=1,max=500,dive"`
+}
+
+// UsageRecord is a recorded UsageEvent.
+type UsageRecord struct {
+	ID             primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	EventID        string             `json:"event_id" bson:"event_id"`
+	SubscriptionID primitive.ObjectID `json:"subscription_id" bson:"subscription_id"`
+	UserID         string             `json:"user_id" bson:"user_id"`
+	Key            string             `json:"key" bson:"key"`
+	Quantity       int64              `json:"quantity" bson:"quantity"`
+	OccurredAt     time.Time          `json:"occurred_at" bson:"occurred_at"`
+	RecordedAt     time.Time          `json:"recorded_at" bson:"recorded_at"`
+}
+
+type UsageReceiptStatus string
+
+const (
+	UsageRecorded  UsageReceiptStatus = "recorded"
+	UsageDuplicate UsageReceiptStatus = "duplicate"
+	UsageRejected  UsageReceiptStatus = "rejected"
+)
+
+// UsageReceipt tells the reporter what became of one UsageEvent.
+type UsageReceipt struct {
+	EventID string             `json:"event_id"`
+	Status  UsageReceiptStatus `json:"status"`
+	Error   string             `json:"error,omitempty"`
+}
+
+type MeterUsage struct {
+	Key           string `json:"key"`
+	Unit          string `json:"unit,omitempty"`
+	Used          int64  `json:"used"`
+	Limit         *int64 `json:"limit,omitempty"`
+	Overage       int64  `json:"overage,omitempty"`
+	OverageCharge *Money `json:"overage_charge,omitempty"`
+}
+
+// UsageSummary is a subscription's metered usage over one billing period.
+type UsageSummary struct {
+	SubscriptionID primitive.ObjectID `json:"subscription_id"`
+	PeriodStart    time.Time          `json:"period_start"`
+	PeriodEnd      time.Time          `json:"period_end"`
+	Meters         []MeterUsage       `json:"meters"`
+	OverageTotal   Money              `json:"overage_total"`
+}
+
+var (
+	ErrNotMetered     = errors.New("the subscription's plan does not meter this key")
+	ErrQuotaExhausted = errors.New("usage would exceed the quota of this key for the period")
+)
+
+// usageClockSkew allows for reporters whose clocks run slightly ahead.
+const usageClockSkew = 5 * time.Minute
+
+func (m *SubscriptionManager) createUsageIndexes() {
+	ctx := context.Background()
+	m.usage.Indexes().DropOne(ctx, "event_id_1")
+	indexModels := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "subscription_id", Value: 1}, {Key: "event_id", Value: 1}},
+			Options: &options.IndexOptions{Unique: &[]bool{true}[0]},
+		},
+		{Keys: bson.D{{Key: "subscription_id", Value: 1}, {Key: "occurred_at", Value: 1}}},
+	}
+	m.usage.Indexes().CreateMany(ctx, indexModels)
+
+	counterIndex := mongo.IndexModel{
+		Keys:    bson.D{{Key: "subscription_id", Value: 1}, {Key: "key", Value: 1}, {Key: "period_start", Value: 1}},
+		Options: &options.IndexOptions{Unique: &[]bool{true}[0]},
+	}
+	m.usageCounters.Indexes().CreateOne(ctx, counterIndex)
+}
+
+// RecordUsage reports events recorded before as duplicates, not counting them.
+func (m *SubscriptionManager) RecordUsage(ctx context.Context, events []UsageEvent) ([]UsageReceipt, error) {
+	now := time.Now()
+	subscriptions := make(map[primitive.ObjectID]*Subscription)
+	receipts := make([]UsageReceipt, 0, len(events))
+	for _, event := range events {
+		subscription, cached := subscriptions[event.SubscriptionID]
+		if !cached {
+			found, err := m.findOne(ctx, bson.M{"_id": event.SubscriptionID})
+			if err != nil && err != mongo.ErrNoDocuments {
+				return nil, err
+			}
+			subscription = found
+			subscriptions[event.SubscriptionID] = found
+		}
+
+		receipt := UsageReceipt{EventID: event.EventID, Status: UsageRecorded}
+		record, err := newUsageRecord(subscription, &event, now)
+		if err == nil {
+			var duplicate bool
+			if duplicate, err = m.recordUsage(ctx, subscription, record); duplicate {
+				receipt.Status = UsageDuplicate
+			}
+		}
+		if err != nil {
+			receipt.Status, receipt.Error = UsageRejected, err.Error()
+		}
+		receipts = append(receipts, receipt)
+	}
+	return receipts, nil
+}
+
+func newUsageRecord(subscription *Subscription, event *UsageEvent, now time.Time) (*UsageRecord, error) {
+	if subscription == nil {
+		return nil, errors.New("subscription not found")
+	}
+	if !subscription.Status.HasAccess() {
+		return nil, fmt.Errorf("subscription is %s", subscription.Status)
+	}
+	if subscription.Plan == nil || subscription.Plan.meter(event.Key) == nil {
+		return nil, ErrNotMetered
+	}
+
+	occurredAt := now
+	if event.OccurredAt != nil {
+		occurredAt = *event.OccurredAt
+	}
+	if occurredAt.After(now.Add(usageClockSkew)) {
+		return nil, errors.New("usage cannot be reported ahead of time")
+	}
+	if occurredAt.Before(subscription.StartDate) || !occurredAt.Before(subscription.ExpiresAt) {
+		return nil, errors.New("usage is outside the current billing period")
+	}
+
+	return &UsageRecord{
+		ID:             primitive.NewObjectID(),
+		EventID:        event.EventID,
+		SubscriptionID: subscription.ID,
+		UserID:         subscription.UserID,
+		Key:            event.Key,
+		Quantity:       event.Quantity,
+		OccurredAt:     occurredAt,
+		RecordedAt:     now,
+	}, nil
+}
+
+func (m *SubscriptionManager) overage(ctx context.Context, subscription *Subscription) ([]MeterUsage, error) {
+	summary, err := m.periodUsage(ctx, subscription, subscription.StartDate, subscription.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	var charged []MeterUsage
+	for _, meter := range summary.Meters {
+		if meter.OverageCharge != nil && meter.OverageCharge.Amount > 0 {
+			charged = append(charged, meter)
+		}
+	}
+	return charged, nil
+}
+
+// recordUsage reserves the record's quantity before inserting it, so concurrent
+// reports cannot go over a hard quota together.
+func (m *SubscriptionManager) recordUsage(ctx context.Context, subscription *Subscription, record *UsageRecord) (bool, error) {
+	if err := m.reserveUsage(ctx, subscription, record, record.Quantity); err != nil {
+		if err == ErrQuotaExhausted {
+			recorded := bson.M{"subscription_id": record.SubscriptionID, "event_id": record.EventID}
+			if count, countErr := m.usage.CountDocuments(ctx, recorded); countErr == nil && count > 0 {
+				return true, nil
+			}
+		}
+		return false, err
+	}
+
+	_, err := m.usage.InsertOne(ctx, record)
+	if err == nil {
+		return false, nil
+	}
+	if releaseErr := m.reserveUsage(ctx, subscription, record, -record.Quantity); releaseErr != nil {
+		log.Printf("Failed to release usage of subscription %s: %v", subscription.ID.Hex(), releaseErr)
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return true, nil
+	}
+	return false, err
+}
+
+// reserveUsage adds quantity to the period's counter unless that takes a hard
+// quota past its limit.
+func (m *SubscriptionManager) reserveUsage(ctx context.Context, subscription *Subscription, record *UsageRecord, quantity int64) error {
+	counter := bson.M{"subscription_id": subscription.ID, "key": record.Key, "period_start": subscription.StartDate}
+	filter := bson.M{}
+	for key, value := range counter {
+		filter[key] = value
+	}
+	entitlement := subscription.Plan.meter(record.Key)
+	if limit := entitlement.limitFor(subscription.Quantity); quantity > 0 && limit != nil && len(entitlement.OveragePrices) == 0 {
+		filter["used"] = bson.M{"$lte": *limit - quantity}
+	}
+
+	for seeded := false; ; seeded = true {
+		result, err := m.usageCounters.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"used": quantity}})
+		if err != nil || result.MatchedCount > 0 {
+			return err
+		}
+		if seeded {
+			return ErrQuotaExhausted
+		}
+
+		// Counters start from the usage recorded before they existed
+		used, err := m.usedBetween(ctx, subscription.ID, subscription.StartDate, subscription.ExpiresAt)
+		if err != nil {
+			return err
+		}
+		counter["used"] = used[record.Key]
+		if _, err := m.usageCounters.InsertOne(ctx, counter); err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+	}
+}
+
+// GetUsage summarises a subscription's usage in its current billing period.
+func (m *SubscriptionManager) GetUsage(ctx context.Context, subscriptionID string) (*UsageSummary, error) {
+	subscription, err := m.GetSubscription(ctx, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	return m.periodUsage(ctx, subscription, subscription.StartDate, subscription.ExpiresAt)
+}
+
+func (m *SubscriptionManager) periodUsage(ctx context.Context, subscription *Subscription, start, end time.Time) (*UsageSummary, error) {
+	if subscription.Plan == nil {
+		return nil, errors.New("plan not found")
+	}
+
+	used, err := m.usedBetween(ctx, subscription.ID, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &UsageSummary{
+		SubscriptionID: subscription.ID,
+		PeriodStart:    start,
+		PeriodEnd:      end,
+		Meters:         []MeterUsage{},
+		OverageTotal:   NewMoney(0, subscription.currency()),
+	}
+	for _, entitlement := range subscription.Plan.entitlements() {
+		if !entitlement.Metered {
+			continue
+		}
+		meter, err := entitlement.usage(used[entitlement.Key], subscription.Quantity, subscription.currency())
+		if err != nil {
+			return nil, err
+		}
+		if meter.OverageCharge != nil {
+			summary.OverageTotal.Amount += meter.OverageCharge.Amount
+		}
+		summary.Meters = append(summary.Meters, meter)
+	}
+	return summary, nil
+}
+
+// usedBetween totals a subscription's usage per key between start and end.
+func (m *SubscriptionManager) usedBetween(ctx context.Context, subscriptionID primitive.ObjectID, start, end time.Time) (map[string]int64, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"subscription_id": subscriptionID,
+			"occurred_at":     bson.M{"$gte": start, "$lt": end},
+		}}},
+		{{Key: "$group", Value: bson.M{"_id": "$key", "used": bson.M{"$sum": "$quantity"}}}},
+	}
+	cursor, err := m.usage.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var totals []struct {
+		Key  string `bson:"_id"`
+		Used int64  `bson:"used"`
+	}
+	if err := cursor.All(ctx, &totals); err != nil {
+		return nil, err
+	}
+
+	used := make(map[string]int64, len(totals))
+	for _, total := range totals {
+		used[total.Key] = total.Used
+	}
+	return used, nil
+}
+
+// meter returns the plan's metered entitlement for key, or nil.
+func (p *Plan) meter(key string) *Entitlement {
+	for _, entitlement := range p.entitlements() {
+		if entitlement.Key == key && entitlement.Metered {
+			return &entitlement
+		}
+	}
+	return nil
+}
+
+func (e *Entitlement) usage(used int64, seats int, currency Currency) (MeterUsage, error) {
+	meter := MeterUsage{Key: e.Key, Unit: e.Unit, Used: used, Limit: e.limitFor(seats)}
+	if meter.Limit == nil || used <= *meter.Limit {
+		return meter, nil
+	}
+
+	meter.Overage = used - *meter.Limit
+	if len(e.OveragePrices) > 0 {
+		price, err := e.overagePrice(currency)
+		if err != nil {
+			return meter, err
+		}
+		charge := price.Times(int(meter.Overage))
+		meter.OverageCharge = &charge
+	}
+	return meter, nil
+}
+
+func (e *Entitlement) overagePrice(currency Currency) (Money, error) {
+	for _, price := range e.OveragePrices {
+		if price.Currency == currency {
+			return price, nil
+		}
+	}
+	return Money{}, fmt.Errorf("entitlement %q has no overage price in %s", e.Key, currency)
+}
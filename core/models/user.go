@@ -3,6 +3,8 @@ package models
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log"
 	"time"
 
 	"subservice/utils"
@@ -15,10 +17,18 @@ import (
 )
 
 type User struct {
-	ID       primitive.ObjectID `json:"id" bson:"_id,omitempty"`
-	Username string             `json:"username" bson:"username" validate:"required,min=3"`
-	Name     string             `json:"name" bson:"name" validate:"required"`
-	Password string             `json:"-" bson:"password" validate:"required,min=6"`
+	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Username    string             `json:"username" bson:"username" validate:"required,min=3"`
+	Name        string             `json:"name" bson:"name" validate:"required"`
+	Password    string             `json:"-" bson:"password" validate:"required,min=6"`
+	Role        Role               `json:"role" bson:"role"`
+	Permissions []string           `json:"permissions,omitempty" bson:"permissions,omitempty"`
+}
+
+// EffectivePermissions combines the role's permissions with the extra grants
+// stored on the user.
+func (u *User) EffectivePermissions() []string {
+	return PermissionsFor(u.Role, u.Permissions)
 }
 
 type LoginRequest struct {
@@ -33,8 +43,14 @@ type RegisterRequest struct {
 }
 
 type LoginResponse struct {
-	Token string `json:"token"`
-	User  User   `json:"user"`
+	Token       string   `json:"token"`
+	User        User     `json:"user"`
+	Permissions []string `json:"permissions"`
+}
+
+type UpdateRoleRequest struct {
+	Role        Role     `json:"role" validate:"required"`
+	Permissions []string `json:"permissions"`
 }
 
 type UserManager struct {
@@ -50,6 +66,7 @@ func NewUserManager(db *mongo.Database, jwtSecret, jwtExpiry string) *UserManage
 		jwtExpiry:  jwtExpiry,
 	}
 	manager.createIndexes()
+	manager.backfillRoles()
 	return manager
 }
 
@@ -62,6 +79,21 @@ func (m *UserManager) createIndexes() {
 	m.collection.Indexes().CreateOne(ctx, indexModel)
 }
 
+// backfillRoles assigns roles to users created before roles existed. The
+// legacy "admin" account keeps its privileges by becoming an admin.
+func (m *UserManager) backfillRoles() {
+	ctx := context.Background()
+	missing := bson.M{"role": bson.M{"$exists": false}}
+
+	adminFilter := bson.M{"username": "admin", "role": bson.M{"$exists": false}}
+	if _, err := m.collection.UpdateOne(ctx, adminFilter, bson.M{"$set": bson.M{"role": RoleAdmin}}); err != nil {
+		log.Printf("Failed to backfill admin role: %v", err)
+	}
+	if _, err := m.collection.UpdateMany(ctx, missing, bson.M{"$set": bson.M{"role": RoleCustomer}}); err != nil {
+		log.Printf("Failed to backfill user roles: %v", err)
+	}
+}
+
 func (m *UserManager) Register(ctx context.Context, req *RegisterRequest) (*User, error) {
 	// Check if username exists
 	count, err := m.collection.CountDocuments(ctx, bson.M{"username": req.Username})
@@ -83,6 +115,7 @@ func (m *UserManager) Register(ctx context.Context, req *RegisterRequest) (*User
 		Username: req.Username,
 		Name:     req.Name,
 		Password: string(hashedPassword),
+		Role:     RoleCustomer,
 	}
 
 	_, err = m.collection.InsertOne(ctx, user)
@@ -107,12 +140,13 @@ func (m *UserManager) Login(ctx context.Context, req *LoginRequest) (*LoginRespo
 		expiry = 24 * time.Hour
 	}
 
-	token, err := utils.GenerateJWT(user.ID.Hex(), user.Username, m.jwtSecret, expiry)
+	permissions := user.EffectivePermissions()
+	token, err := utils.GenerateJWT(user.ID.Hex(), user.Username, string(user.Role), permissions, m.jwtSecret, expiry)
 	if err != nil {
 		return nil, err
 	}
 
-	return &LoginResponse{Token: token, User: user}, nil
+	return &LoginResponse{Token: token, User: user, Permissions: permissions}, nil
 }
 
 func (m *UserManager) GetByID(ctx context.Context, userID string) (*User, error) {
@@ -125,3 +159,44 @@ func (m *UserManager) GetByID(ctx context.Context, userID string) (*User, error)
 	err = m.collection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&user)
 	return &user, err
 }
+
+// Grants returns the user's current role and effective permissions.
+func (m *UserManager) Grants(ctx context.Context, userID string) (Role, []string, error) {
+	user, err := m.GetByID(ctx, userID)
+	if err != nil {
+		return "", nil, err
+	}
+	return user.Role, user.EffectivePermissions(), nil
+}
+
+// UpdateRole changes a user's role and extra permission grants, including for
+// tokens already issued.
+func (m *UserManager) UpdateRole(ctx context.Context, userID string, req *UpdateRoleRequest) (*User, error) {
+	if !req.Role.IsValid() {
+		return nil, errors.New("invalid role")
+	}
+	for _, p := range req.Permissions {
+		if !IsValidPermission(p) {
+			return nil, fmt.Errorf("unknown permission %q", p)
+		}
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := m.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": objectID},
+		bson.M{"$set": bson.M{"role": req.Role, "permissions": req.Permissions}},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if result.MatchedCount == 0 {
+		return nil, errors.New("user not found")
+	}
+
+	return m.GetByID(ctx, userID)
+}
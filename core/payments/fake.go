@@ -0,0 +1,303 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Any other payment method fails with "invalid_payment_method".
+const (
+	FakeCardVisa              = "pm_card_visa"
+	FakeCardDeclined          = "pm_card_declined"
+	FakeCardInsufficientFunds = "pm_card_insufficient_funds"
+	// FakeCard3DS charges require the customer to confirm them first
+	FakeCard3DS = "pm_card_3ds"
+	// Delayed charges settle after the settle delay, DelayedFail ones then fail
+	FakeCardDelayed     = "pm_card_delayed"
+	FakeCardDelayedFail = "pm_card_delayed_fail"
+)
+
+// SignatureTolerance is how old a webhook signature may be.
+const SignatureTolerance = 5 * time.Minute
+
+const webhookAttempts = 3
+
+var ErrChargeNotFound = errors.New("charge not found")
+
+// FakeProvider is an in-process Provider, its outcomes set by the payment method.
+type FakeProvider struct {
+	secret      string
+	settleDelay time.Duration
+
+	mu      sync.Mutex
+	charges map[string]*fakeCharge
+	refunds map[string]*Refund
+	notify  func(ctx context.Context, event *Event)
+}
+
+type fakeCharge struct {
+	Charge
+	// settles is what a pending charge becomes when it settles
+	settles  ChargeStatus
+	refunded int64
+	disputed bool
+}
+
+func NewFakeProvider(secret string, settleDelay time.Duration) *FakeProvider {
+	return &FakeProvider{
+		secret:      secret,
+		settleDelay: settleDelay,
+		charges:     make(map[string]*fakeCharge),
+		refunds:     make(map[string]*Refund),
+	}
+}
+
+// OnEvent should be called at startup, before any charge is made.
+func (p *FakeProvider) OnEvent(notify func(ctx context.Context, event *Event)) {
+	p.notify = notify
+}
+
+// SendWebhooks posts events to url in the background, like a real gateway.
+func (p *FakeProvider) SendWebhooks(url string) {
+	p.OnEvent(func(ctx context.Context, event *Event) {
+		go func() {
+			var err error
+			for attempt := 1; attempt <= webhookAttempts; attempt++ {
+				if err = p.Deliver(context.Background(), url, event); err == nil {
+					return
+				}
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+			log.Printf("Failed to deliver payment webhook %s: %v", event.ID, err)
+		}()
+	})
+}
+
+// Deliver posts event to url as a signed webhook, once.
+func (p *FakeProvider) Deliver(ctx context.Context, url string, event *Event) error {
+	payload, signature, err := p.SignEvent(event, time.Now())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, signature)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook endpoint responded %s", resp.Status)
+	}
+	return nil
+}
+
+// SignEvent is for sending an event to a webhook endpoint by hand.
+func (p *FakeProvider) SignEvent(event *Event, t time.Time) ([]byte, string, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, "", err
+	}
+	return payload, Sign(p.secret, payload, t), nil
+}
+
+func (p *FakeProvider) CreateCustomer(ctx context.Context, req CustomerRequest) (*Customer, error) {
+	if req.Reference == "" {
+		return nil, errors.New("customer reference is required")
+	}
+	return &Customer{ID: "cus_fake_" + digest(req.Reference), Reference: req.Reference}, nil
+}
+
+func (p *FakeProvider) Charge(ctx context.Context, req ChargeRequest) (*Charge, error) {
+	if req.Amount <= 0 {
+		return nil, errors.New("charge amount must be positive")
+	}
+	if req.IdempotencyKey == "" {
+		return nil, errors.New("idempotency key is required")
+	}
+
+	id := "ch_fake_" + digest(req.IdempotencyKey)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if existing, ok := p.charges[id]; ok {
+		charge := existing.Charge
+		return &charge, nil
+	}
+
+	charge := &fakeCharge{Charge: Charge{ID: id, Amount: req.Amount, Currency: req.Currency}}
+	switch req.PaymentMethod {
+	case FakeCardVisa:
+		charge.Status = ChargeSucceeded
+	case FakeCardDeclined:
+		charge.Status, charge.FailureReason = ChargeFailed, "card_declined"
+	case FakeCardInsufficientFunds:
+		charge.Status, charge.FailureReason = ChargeFailed, "insufficient_funds"
+	case FakeCard3DS:
+		charge.Status = ChargeRequiresAction
+		charge.NextActionURL = "/api/payments/fake/" + id + "/confirm"
+	case FakeCardDelayed, FakeCardDelayedFail:
+		charge.Status, charge.settles = ChargePending, ChargeSucceeded
+		if req.PaymentMethod == FakeCardDelayedFail {
+			charge.settles = ChargeFailed
+		}
+		time.AfterFunc(p.settleDelay, func() { p.Settle(context.Background(), id) })
+	default:
+		charge.Status, charge.FailureReason = ChargeFailed, "invalid_payment_method"
+	}
+	p.charges[id] = charge
+
+	result := charge.Charge
+	return &result, nil
+}
+
+func (p *FakeProvider) Confirm(ctx context.Context, chargeID string) error {
+	return p.resolve(ctx, chargeID, ChargeRequiresAction, ChargeSucceeded)
+}
+
+// Settle settles a pending charge now. Other charges are left alone.
+func (p *FakeProvider) Settle(ctx context.Context, chargeID string) error {
+	p.mu.Lock()
+	charge, ok := p.charges[chargeID]
+	p.mu.Unlock()
+	if !ok {
+		return ErrChargeNotFound
+	}
+	return p.resolve(ctx, chargeID, ChargePending, charge.settles)
+}
+
+// resolve moves a charge from status from to status to and reports it.
+func (p *FakeProvider) resolve(ctx context.Context, chargeID string, from, to ChargeStatus) error {
+	p.mu.Lock()
+	charge, ok := p.charges[chargeID]
+	if !ok {
+		p.mu.Unlock()
+		return ErrChargeNotFound
+	}
+	if charge.Status != from {
+		p.mu.Unlock()
+		return fmt.Errorf("charge is %s, not %s", charge.Status, from)
+	}
+	charge.Status, charge.NextActionURL = to, ""
+	eventType := EventChargeSucceeded
+	if to == ChargeFailed {
+		charge.FailureReason = "card_declined"
+		eventType = EventChargeFailed
+	}
+	event := charge.event(eventType, chargeID+string(eventType), charge.Amount)
+	p.mu.Unlock()
+
+	p.emit(ctx, event)
+	return nil
+}
+
+// Dispute covers what was not refunded yet.
+func (p *FakeProvider) Dispute(ctx context.Context, chargeID string) error {
+	p.mu.Lock()
+	charge, ok := p.charges[chargeID]
+	if !ok {
+		p.mu.Unlock()
+		return ErrChargeNotFound
+	}
+	if charge.Status != ChargeSucceeded || charge.disputed || charge.refunded == charge.Amount {
+		p.mu.Unlock()
+		return errors.New("only charges that succeeded and were not refunded or disputed can be disputed")
+	}
+	charge.disputed = true
+	event := charge.event(EventChargeDisputed, chargeID+string(EventChargeDisputed), charge.Amount-charge.refunded)
+	p.mu.Unlock()
+
+	p.emit(ctx, event)
+	return nil
+}
+
+func (c *fakeCharge) event(eventType EventType, key string, amount int64) *Event {
+	return &Event{
+		ID:            "evt_fake_" + digest(key),
+		Type:          eventType,
+		ChargeID:      c.ID,
+		Amount:        amount,
+		Currency:      c.Currency,
+		FailureReason: c.FailureReason,
+		CreatedAt:     time.Now(),
+	}
+}
+
+func (p *FakeProvider) emit(ctx context.Context, event *Event) {
+	if p.notify != nil {
+		p.notify(ctx, event)
+	}
+}
+
+func (p *FakeProvider) Refund(ctx context.Context, req RefundRequest) (*Refund, error) {
+	if req.IdempotencyKey == "" {
+		return nil, errors.New("idempotency key is required")
+	}
+
+	p.mu.Lock()
+	if existing, ok := p.refunds[req.IdempotencyKey]; ok {
+		p.mu.Unlock()
+		refund := *existing
+		return &refund, nil
+	}
+
+	charge, ok := p.charges[req.ChargeID]
+	if !ok {
+		p.mu.Unlock()
+		return nil, ErrChargeNotFound
+	}
+	if charge.Status != ChargeSucceeded {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("cannot refund a %s charge", charge.Status)
+	}
+	if req.Amount <= 0 || req.Amount > charge.Amount-charge.refunded {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("refund must be between 1 and %d", charge.Amount-charge.refunded)
+	}
+
+	charge.refunded += req.Amount
+	refund := &Refund{
+		ID:       "re_fake_" + digest(req.IdempotencyKey),
+		ChargeID: charge.ID,
+		Amount:   req.Amount,
+		Currency: charge.Currency,
+	}
+	p.refunds[req.IdempotencyKey] = refund
+	event := charge.event(EventChargeRefunded, refund.ID, refund.Amount)
+	event.RefundID = refund.ID
+	p.mu.Unlock()
+
+	p.emit(ctx, event)
+	result := *refund
+	return &result, nil
+}
+
+func (p *FakeProvider) VerifyWebhook(payload []byte, signature string) (*Event, error) {
+	signedAt, err := VerifySignature(p.secret, payload, signature)
+	if err != nil {
+		return nil, err
+	}
+	if age := time.Since(signedAt); age > SignatureTolerance || age < -SignatureTolerance {
+		return nil, errors.New("webhook signature has expired")
+	}
+	return decodeEvent(payload)
+}
+
+// digest derives a stable ID from s.
+func digest(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:12])
+}
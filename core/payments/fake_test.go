@@ -0,0 +1,54 @@
+package payments
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeProviderVerifyWebhook(t *testing.T) {
+	provider := NewFakeProvider("whsec_test", 0)
+	event := &Event{ID: "evt_1", Type: EventChargeSucceeded, ChargeID: "ch_1", Amount: 1000, Currency: "INR"}
+	now := time.Now()
+
+	payload, signature, err := provider.SignEvent(event, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherSignature, _ := NewFakeProvider("whsec_other", 0).SignEvent(event, now)
+	_, staleSignature, _ := provider.SignEvent(event, now.Add(-SignatureTolerance-time.Minute))
+	_, futureSignature, _ := provider.SignEvent(event, now.Add(SignatureTolerance+time.Minute))
+
+	tests := []struct {
+		name      string
+		payload   []byte
+		signature string
+		valid     bool
+	}{
+		{name: "signed now", payload: payload, signature: signature, valid: true},
+		{name: "signed within the tolerance", payload: payload, signature: Sign("whsec_test", payload, now.Add(-SignatureTolerance+time.Minute)), valid: true},
+		{name: "missing signature", payload: payload},
+		{name: "malformed signature", payload: payload, signature: "v1=abc"},
+		{name: "other secret", payload: payload, signature: otherSignature},
+		{name: "payload changed", payload: append([]byte(" "), payload...), signature: signature},
+		{name: "stale", payload: payload, signature: staleSignature},
+		{name: "from the future", payload: payload, signature: futureSignature},
+		{name: "no event", payload: []byte(`{}`), signature: Sign("whsec_test", []byte(`{}`), now)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := provider.VerifyWebhook(tt.payload, tt.signature)
+			if !tt.valid {
+				if err == nil {
+					t.Fatalf("VerifyWebhook accepted %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != event.ID || got.Type != event.Type || got.ChargeID != event.ChargeID || got.Amount != event.Amount {
+				t.Errorf("event = %+v, want %+v", got, event)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package payments
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Provider is a payment gateway. Amounts are in minor units, and repeating a
+// charge or refund with the same idempotency key returns the original result.
+type Provider interface {
+	// Creating the same Reference again returns the existing customer
+	CreateCustomer(ctx context.Context, req CustomerRequest) (*Customer, error)
+	Charge(ctx context.Context, req ChargeRequest) (*Charge, error)
+	Refund(ctx context.Context, req RefundRequest) (*Refund, error)
+	VerifyWebhook(payload []byte, signature string) (*Event, error)
+}
+
+type CustomerRequest struct {
+	Reference string
+	Name      string
+}
+
+type Customer struct {
+	ID        string
+	Reference string
+}
+
+type ChargeRequest struct {
+	CustomerID     string
+	PaymentMethod  string
+	Amount         int64
+	Currency       string
+	Description    string
+	IdempotencyKey string
+}
+
+type ChargeStatus string
+
+const (
+	ChargeSucceeded ChargeStatus = "succeeded"
+	// ChargePending charges were accepted but settle later
+	ChargePending ChargeStatus = "pending"
+	// ChargeRequiresAction charges wait for the customer at NextActionURL
+	ChargeRequiresAction ChargeStatus = "requires_action"
+	ChargeFailed         ChargeStatus = "failed"
+)
+
+type Charge struct {
+	ID            string
+	Status        ChargeStatus
+	Amount        int64
+	Currency      string
+	FailureReason string
+	NextActionURL string
+}
+
+type RefundRequest struct {
+	ChargeID       string
+	Amount         int64
+	Reason         string
+	IdempotencyKey string
+}
+
+type Refund struct {
+	ID       string
+	ChargeID string
+	Amount   int64
+	Currency string
+}
+
+type EventType string
+
+const (
+	EventChargeSucceeded EventType = "charge.succeeded"
+	EventChargeFailed    EventType = "charge.failed"
+	EventChargeRefunded  EventType = "charge.refunded"
+	EventChargeDisputed  EventType = "charge.disputed"
+)
+
+// Event.Amount is the charge, or the amount refunded or disputed.
+type Event struct {
+	ID            string    `json:"id" bson:"id"`
+	Type          EventType `json:"type" bson:"type"`
+	ChargeID      string    `json:"charge_id" bson:"charge_id"`
+	RefundID      string    `json:"refund_id,omitempty" bson:"refund_id,omitempty"`
+	Amount        int64     `json:"amount" bson:"amount"`
+	Currency      string    `json:"currency" bson:"currency"`
+	FailureReason string    `json:"failure_reason,omitempty" bson:"failure_reason,omitempty"`
+	CreatedAt     time.Time `json:"created_at" bson:"created_at"`
+}
+
+// SignatureHeader is the HTTP header webhooks carry their signature in.
+const SignatureHeader = "Payment-Signature"
+
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// Sign produces "t=<unix time>,v1=<hex HMAC-SHA256 of timestamp.payload>".
+func Sign(secret string, payload []byte, t time.Time) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + timestamp + ",v1=" + signature(secret, timestamp, payload)
+}
+
+func VerifySignature(secret string, payload []byte, header string) (time.Time, error) {
+	var timestamp, signed string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signed = value
+		}
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || signed == "" {
+		return time.Time{}, ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(signed), []byte(signature(secret, timestamp, payload))) {
+		return time.Time{}, ErrInvalidSignature
+	}
+	return time.Unix(unix, 0), nil
+}
+
+func signature(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func decodeEvent(payload []byte) (*Event, error) {
+	var event Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("invalid webhook payload: %w", err)
+	}
+	if event.ID == "" || event.Type == "" {
+		return nil, errors.New("invalid webhook payload: missing event id or type")
+	}
+	return &event, nil
+}
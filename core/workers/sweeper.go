@@ -0,0 +1,132 @@
+package workers
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"subservice/core/database"
+)
+
+// BatchJob processes up to limit due records and returns how many it handled.
+type BatchJob struct {
+	Name string
+	Run  func(ctx context.Context, now time.Time, limit int) (int, error)
+}
+
+// Sweeper runs the subscription lifecycle jobs in order while it holds the lock.
+type Sweeper struct {
+	jobs      []BatchJob
+	lock      *database.Lock
+	interval  time.Duration
+	batchSize int
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+func NewSweeper(lock *database.Lock, interval time.Duration, batchSize int, jobs ...BatchJob) *Sweeper {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Sweeper{
+		jobs:      jobs,
+		lock:      lock,
+		interval:  interval,
+		batchSize: batchSize,
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+}
+
+// Run sweeps on every tick until Stop is called.
+func (s *Sweeper) Run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.sweep()
+		}
+	}
+}
+
+// Stop waits for an in-flight batch to finish, then releases the lock.
+func (s *Sweeper) Stop() {
+	s.cancel()
+	<-s.done
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.lock.Release(ctx); err != nil {
+		log.Printf("Sweeper failed to release lock: %v", err)
+	}
+}
+
+func (s *Sweeper) sweep() {
+	leader, err := s.lock.Acquire(s.ctx)
+	if err != nil {
+		log.Printf("Sweeper failed to acquire lock: %v", err)
+		return
+	}
+	if !leader {
+		return
+	}
+
+	now := time.Now()
+	for _, job := range s.jobs {
+		if s.ctx.Err() != nil {
+			return
+		}
+		total, leader := s.runJob(job, now)
+		if total > 0 {
+			log.Printf("Sweeper %s %d subscriptions", job.Name, total)
+		}
+		if !leader {
+			return
+		}
+	}
+}
+
+// runJob reports false once the lease is lost, so the sweep stops.
+func (s *Sweeper) runJob(job BatchJob, now time.Time) (int, bool) {
+	total := 0
+	for s.ctx.Err() == nil {
+		if !s.extendLease() {
+			return total, false
+		}
+
+		// Batches use a fresh context so shutdown never interrupts one halfway
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		processed, err := job.Run(ctx, now, s.batchSize)
+		cancel()
+		if err != nil {
+			log.Printf("Sweeper %s job failed: %v", job.Name, err)
+			break
+		}
+
+		total += processed
+		if processed < s.batchSize {
+			break
+		}
+	}
+	return total, true
+}
+
+func (s *Sweeper) extendLease() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	leader, err := s.lock.Acquire(ctx)
+	if err != nil {
+		log.Printf("Sweeper failed to extend lock: %v", err)
+		return false
+	}
+	if !leader {
+		log.Printf("Sweeper lost the lock, stopping this sweep")
+	}
+	return leader
+}
@@ -13,8 +13,8 @@ document.addEventListener("DOMContentLoaded", function () {
 
   currentUser = JSON.parse(user);
 
-  // Check if user is admin
-  if (currentUser.username !== "admin") {
+  // Check if user may manage plans
+  if (!currentUser.permissions?.includes("plans:write")) {
     alert("Access denied. Admin privileges required.");
     window.location.href = "/dashboard";
     return;
@@ -34,11 +34,18 @@ document.addEventListener("DOMContentLoaded", function () {
   document
     .getElementById("updatePlanForm")
     .addEventListener("submit", handleUpdatePlan);
+  document
+    .getElementById("createCouponForm")
+    .addEventListener("submit", handleCreateCoupon);
 });
 
 async function loadAdminDashboard() {
   try {
     await loadAllPlans();
+    if (currentUser.permissions.includes("coupons:write")) {
+      document.getElementById("couponsSection").classList.remove("hidden");
+      await loadCoupons();
+    }
     // updateStatistics();
   } catch (error) {
     console.error("Error loading admin dashboard:", error);
@@ -47,7 +54,7 @@ async function loadAdminDashboard() {
 
 async function loadAllPlans() {
   try {
-    const response = await API.getPlans();
+    const response = await API.getPlans(true);
     if (response.success) {
       allPlans = response.data;
       renderPlansTable();
@@ -66,8 +73,14 @@ function renderPlansTable() {
     row.className = "table-row";
 
     row.innerHTML = `
-            <div class="table-cell" data-label="Plan Name">${plan.name}</div>
-            <div class="table-cell" data-label="Price">₹${plan.price}</div>
+            <div class="table-cell" data-label="Plan Name">${plan.name} (v${
+              plan.version || 1
+            })${plan.archived_at ? " [archived]" : ""}</div>
+            <div class="table-cell" data-label="Price">${plan.prices
+              .map((point) => formatMoney(point))
+              .join(" / ")}${
+              plan.pricing_mode && plan.pricing_mode !== "flat" ? "/seat" : ""
+            }</div>
             <div class="table-cell" data-label="Duration">${plan.duration}</div>
             <div class="table-cell" data-label="Features">
                 <div class="plan-features-list">
@@ -86,6 +99,11 @@ function renderPlansTable() {
                     }')">
                         Edit
                     </button>
+                    <button class="btn btn-secondary btn-small" onclick="setPlanArchived('${
+                      plan.id
+                    }', ${!plan.archived_at})">
+                        ${plan.archived_at ? "Unarchive" : "Archive"}
+                    </button>
                     <button class="btn btn-danger btn-small" onclick="deletePlan('${
                       plan.id
                     }', '${plan.name}')">
@@ -113,8 +131,26 @@ async function handleCreatePlan(e) {
   e.preventDefault();
 
   const name = document.getElementById("planName").value;
-  const price = parseFloat(document.getElementById("planPrice").value);
   const duration = document.getElementById("planDuration").value;
+  const trialDays =
+    parseInt(document.getElementById("planTrialDays").value, 10) || 0;
+  const maxPauseDays =
+    parseInt(document.getElementById("planMaxPauseDays").value, 10) || 0;
+  const graceDays =
+    parseInt(document.getElementById("planGraceDays").value, 10) || 0;
+  const productLine = document.getElementById("planProductLine").value.trim();
+  const pricingMode = document.getElementById("planPricingMode").value;
+  const prices = parsePrices(
+    document.getElementById("planPrices").value,
+    document.getElementById("planTiers").value
+  );
+  const minQuantity =
+    parseInt(document.getElementById("planMinQuantity").value, 10) || 0;
+  const maxQuantity =
+    parseInt(document.getElementById("planMaxQuantity").value, 10) || 0;
+  const entitlements = parseEntitlements(
+    document.getElementById("planEntitlements").value
+  );
   const featuresText = document.getElementById("planFeatures").value;
 
   // Parse features from textarea (one per line)
@@ -130,9 +166,17 @@ async function handleCreatePlan(e) {
 
   const planData = {
     name,
-    price,
+    prices,
     duration,
     features,
+    trial_days: trialDays,
+    max_pause_days: maxPauseDays,
+    grace_days: graceDays,
+    product_line: productLine,
+    pricing_mode: pricingMode,
+    min_quantity: minQuantity,
+    max_quantity: maxQuantity,
+    entitlements,
   };
 
   try {
@@ -158,8 +202,51 @@ function showUpdatePlanModal(planId) {
   // Populate the update form with current plan data
   document.getElementById("updatePlanId").value = plan.id;
   document.getElementById("updatePlanName").value = plan.name;
-  document.getElementById("updatePlanPrice").value = plan.price;
+  document.getElementById("updatePlanPrices").value = plan.prices
+    .map((point) =>
+      [point.currency, fromMinorUnits(point.amount, point.currency)].join(", ")
+    )
+    .join("\n");
   document.getElementById("updatePlanDuration").value = plan.duration;
+  document.getElementById("updatePlanTrialDays").value = plan.trial_days || 0;
+  document.getElementById("updatePlanMaxPauseDays").value =
+    plan.max_pause_days || 0;
+  document.getElementById("updatePlanGraceDays").value = plan.grace_days || 0;
+  document.getElementById("updatePlanProductLine").value =
+    plan.product_line || "";
+  document.getElementById("updatePlanPricingMode").value =
+    plan.pricing_mode || "flat";
+  document.getElementById("updatePlanTiers").value = plan.prices
+    .flatMap((point) =>
+      (point.tiers || []).map((tier) =>
+        [
+          point.currency,
+          tier.up_to,
+          fromMinorUnits(tier.unit_price, point.currency),
+          fromMinorUnits(tier.flat_fee || 0, point.currency),
+        ].join(", ")
+      )
+    )
+    .join("\n");
+  document.getElementById("updatePlanMinQuantity").value =
+    plan.min_quantity || 0;
+  document.getElementById("updatePlanMaxQuantity").value =
+    plan.max_quantity || 0;
+  document.getElementById("updatePlanEntitlements").value = (
+    plan.entitlements || []
+  )
+    .map((entitlement) =>
+      [
+        entitlement.key,
+        entitlement.limit ?? "",
+        entitlement.unit || "",
+        entitlement.per_seat ? "seat" : "",
+        entitlement.metered ? "metered" : "",
+      ]
+        .join(", ")
+        .replace(/(, )+$/, "")
+    )
+    .join("\n");
   document.getElementById("updatePlanFeatures").value =
     plan.features.join("\n");
 
@@ -176,8 +263,35 @@ async function handleUpdatePlan(e) {
 
   const planId = document.getElementById("updatePlanId").value;
   const name = document.getElementById("updatePlanName").value;
-  const price = parseFloat(document.getElementById("updatePlanPrice").value);
   const duration = document.getElementById("updatePlanDuration").value;
+  const trialDays =
+    parseInt(document.getElementById("updatePlanTrialDays").value, 10) || 0;
+  const maxPauseDays =
+    parseInt(document.getElementById("updatePlanMaxPauseDays").value, 10) || 0;
+  const graceDays =
+    parseInt(document.getElementById("updatePlanGraceDays").value, 10) || 0;
+  const productLine = document
+    .getElementById("updatePlanProductLine")
+    .value.trim();
+  const pricingMode = document.getElementById("updatePlanPricingMode").value;
+  const prices = parsePrices(
+    document.getElementById("updatePlanPrices").value,
+    document.getElementById("updatePlanTiers").value
+  );
+  const minQuantity =
+    parseInt(document.getElementById("updatePlanMinQuantity").value, 10) || 0;
+  const maxQuantity =
+    parseInt(document.getElementById("updatePlanMaxQuantity").value, 10) || 0;
+  // Overage prices have no form input, so keep those of the stored plan
+  const stored = allPlans.find((p) => p.id === planId);
+  const entitlements = parseEntitlements(
+    document.getElementById("updatePlanEntitlements").value
+  ).map((entitlement) => ({
+    ...entitlement,
+    overage_prices: (stored?.entitlements || []).find(
+      (e) => e.key === entitlement.key
+    )?.overage_prices,
+  }));
   const featuresText = document.getElementById("updatePlanFeatures").value;
 
   // Parse features from textarea (one per line)
@@ -191,17 +305,28 @@ async function handleUpdatePlan(e) {
     return;
   }
 
+  // Start from the stored plan so fields without a form input are kept
   const planData = {
+    ...stored,
     name,
-    price,
+    prices,
     duration,
     features,
+    trial_days: trialDays,
+    max_pause_days: maxPauseDays,
+    grace_days: graceDays,
+    product_line: productLine,
+    pricing_mode: pricingMode,
+    min_quantity: minQuantity,
+    max_quantity: maxQuantity,
+    entitlements,
+    migrate_subscribers: document.getElementById("updatePlanMigrate").checked,
   };
 
   try {
     const response = await API.updatePlan(planId, planData);
     if (response.success) {
-      alert("Plan updated successfully!");
+      alert(`Version ${response.data.version} of the plan published!`);
       closeUpdatePlanModal();
       await loadAllPlans();
     }
@@ -227,7 +352,143 @@ async function deletePlan(planId, planName) {
       await loadAllPlans();
     }
   } catch (error) {
-    alert("Error deleting plan: " + error.message);
+    // Deletion is refused while subscriptions depend on the plan
+    const affected = (error.data || [])
+      .map((subscriber) => `${subscriber.user_id} (${subscriber.status})`)
+      .join("\n");
+    alert(
+      "Error deleting plan: " +
+        error.message +
+        (affected ? "\n\nAffected users:\n" + affected : "")
+    );
+  }
+}
+
+// Archive Plan Function
+async function setPlanArchived(planId, archived) {
+  try {
+    const response = archived
+      ? await API.archivePlan(planId)
+      : await API.unarchivePlan(planId);
+    if (response.success) {
+      await loadAllPlans();
+    }
+  } catch (error) {
+    alert("Error archiving plan: " + error.message);
+  }
+}
+
+// Coupon Functions
+async function loadCoupons() {
+  try {
+    const response = await API.getCoupons();
+    if (response.success) {
+      renderCouponsTable(response.data);
+    }
+  } catch (error) {
+    console.error("Error loading coupons:", error);
+  }
+}
+
+function renderCouponsTable(coupons) {
+  const tableBody = document.getElementById("couponsTableBody");
+  tableBody.innerHTML = "";
+
+  coupons.forEach((coupon) => {
+    const row = document.createElement("div");
+    row.className = "table-row";
+
+    const discount = coupon.percent_off
+      ? `${coupon.percent_off}%`
+      : (coupon.amount_off || []).map((amount) => formatMoney(amount)).join(" / ");
+    const duration =
+      coupon.duration === "repeating"
+        ? `${coupon.duration_periods} periods`
+        : coupon.duration;
+
+    row.innerHTML = `
+            <div class="table-cell" data-label="Code">${coupon.code}</div>
+            <div class="table-cell" data-label="Discount">${discount}</div>
+            <div class="table-cell" data-label="Duration">${duration}</div>
+            <div class="table-cell" data-label="Redemptions">${
+              coupon.redemptions
+            }${coupon.max_redemptions ? ` / ${coupon.max_redemptions}` : ""}</div>
+            <div class="table-cell" data-label="Actions">
+                <button class="btn btn-danger btn-small" onclick="deleteCoupon('${
+                  coupon.id
+                }', '${coupon.code}')">
+                    Delete
+                </button>
+            </div>
+        `;
+
+    tableBody.appendChild(row);
+  });
+}
+
+function showCreateCouponModal() {
+  document.getElementById("couponPlans").innerHTML = allPlans
+    .map((plan) => `<option value="${plan.id}">${plan.name}</option>`)
+    .join("");
+  document.getElementById("createCouponModal").classList.remove("hidden");
+}
+
+function closeCreateCouponModal() {
+  document.getElementById("createCouponModal").classList.add("hidden");
+  document.getElementById("createCouponForm").reset();
+}
+
+async function handleCreateCoupon(e) {
+  e.preventDefault();
+
+  const percentOff =
+    parseFloat(document.getElementById("couponPercentOff").value) || 0;
+  const amountOff = parsePrices(
+    document.getElementById("couponAmountOff").value,
+    ""
+  ).map(({ currency, amount }) => ({ currency, amount }));
+  const expiresAt = document.getElementById("couponExpiresAt").value;
+  const planIds = Array.from(
+    document.getElementById("couponPlans").selectedOptions
+  ).map((option) => option.value);
+
+  const couponData = {
+    code: document.getElementById("couponCode").value.trim(),
+    percent_off: percentOff,
+    amount_off: percentOff ? [] : amountOff,
+    duration: document.getElementById("couponDuration").value,
+    duration_periods:
+      parseInt(document.getElementById("couponDurationPeriods").value, 10) || 0,
+    max_redemptions:
+      parseInt(document.getElementById("couponMaxRedemptions").value, 10) || 0,
+    ...(expiresAt && { expires_at: new Date(expiresAt).toISOString() }),
+    plan_ids: planIds,
+  };
+
+  try {
+    const response = await API.createCoupon(couponData);
+    if (response.success) {
+      alert("Coupon created successfully!");
+      closeCreateCouponModal();
+      await loadCoupons();
+    }
+  } catch (error) {
+    alert("Error creating coupon: " + error.message);
+  }
+}
+
+async function deleteCoupon(couponId, code) {
+  if (!confirm(`Delete the coupon "${code}"? Existing discounts are kept.`)) {
+    return;
+  }
+
+  try {
+    const response = await API.deleteCoupon(couponId);
+    if (response.success) {
+      await loadCoupons();
+    }
+  } catch (error) {
+    alert("Error deleting coupon: " + error.message);
   }
 }
 
@@ -236,3 +497,49 @@ function logout() {
   localStorage.removeItem("user");
   window.location.href = "/";
 }
+
+// parsePrices reads "currency, amount" lines and "currency, up to, unit
+// price, flat fee" tier lines into price points in minor units
+function parsePrices(pricesText, tiersText) {
+  const lines = (text) =>
+    text
+      .split("\n")
+      .map((line) => line.split(",").map((value) => value.trim()))
+      .filter((values) => values.length >= 2 && values[0]);
+
+  const prices = lines(pricesText).map(([currency, amount]) => {
+    currency = currency.toUpperCase();
+    return {
+      currency,
+      amount: toMinorUnits(parseFloat(amount) || 0, currency),
+      tiers: [],
+    };
+  });
+
+  lines(tiersText).forEach(([currency, upTo, unitPrice, flatFee]) => {
+    const point = prices.find((p) => p.currency === currency.toUpperCase());
+    if (!point) return;
+    point.tiers.push({
+      up_to: parseInt(upTo, 10) || 0,
+      unit_price: toMinorUnits(parseFloat(unitPrice) || 0, point.currency),
+      flat_fee: toMinorUnits(parseFloat(flatFee) || 0, point.currency),
+    });
+  });
+  return prices;
+}
+
+// parseEntitlements reads "key, limit, unit, flags..." lines, where the flags
+// are "seat" and "metered". Lines with only a key are on/off features.
+function parseEntitlements(text) {
+  return text
+    .split("\n")
+    .map((line) => line.split(",").map((value) => value.trim()))
+    .filter((values) => values[0])
+    .map(([key, limit, unit, ...flags]) => ({
+      key,
+      ...(limit !== undefined && limit !== "" && { limit: parseInt(limit, 10) }),
+      ...(unit && { unit }),
+      per_seat: flags.includes("seat"),
+      metered: flags.includes("metered"),
+    }));
+}
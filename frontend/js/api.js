@@ -19,7 +19,9 @@ class API {
       const data = await response.json();
 
       if (!response.ok) {
-        throw new Error(data.error || data.message || "Request failed");
+        const error = new Error(data.error || data.message || "Request failed");
+        error.data = data.data;
+        throw error;
       }
 
       return data;
@@ -50,6 +52,18 @@ class API {
     });
   }
 
+  static async archivePlan(planId) {
+    return this.request(`/plans/${planId}/archive`, {
+      method: "POST",
+    });
+  }
+
+  static async unarchivePlan(planId) {
+    return this.request(`/plans/${planId}/unarchive`, {
+      method: "POST",
+    });
+  }
+
   // Auth endpoints
   static async login(username, password) {
     return this.request("/auth/login", {
@@ -66,24 +80,143 @@ class API {
   }
 
   // Plans endpoints
-  static async getPlans() {
-    return this.request("/plans");
+  static async getPlans(includeArchived = false) {
+    return this.request(
+      includeArchived ? "/plans?include_archived=true" : "/plans"
+    );
   }
 
   // Subscription endpoints
-  static async upsertSubscription(userId, planId) {
+  static async getQuote(planId, quantity, currency) {
+    return this.request(
+      `/plans/${planId}/quote?quantity=${quantity}&currency=${currency}`
+    );
+  }
+
+  static async upsertSubscription(userId, planId, quantity, currency, promoCode, paymentMethod) {
     return this.request("/subscriptions", {
       method: "POST",
-      body: JSON.stringify({ user_id: userId, plan_id: planId }),
+      body: JSON.stringify({
+        user_id: userId,
+        plan_id: planId,
+        quantity,
+        currency,
+        promo_code: promoCode,
+        payment_method: paymentMethod,
+      }),
+    });
+  }
+  // confirmPayment follows a payment's next action URL, which the fake
+  // provider serves under the API
+  static async confirmPayment(nextActionUrl) {
+    return this.request(nextActionUrl.replace(/^\/api/, ""), {
+      method: "POST",
     });
   }
-  static async getSubscription(userId) {
-    return this.request(`/subscriptions/${userId}`);
+  static async previewSubscription(userId, planId, quantity, currency, promoCode) {
+    return this.request("/subscriptions/preview", {
+      method: "POST",
+      body: JSON.stringify({
+        user_id: userId,
+        plan_id: planId,
+        quantity,
+        currency,
+        promo_code: promoCode,
+      }),
+    });
   }
 
-  static async cancelSubscription(userId) {
-    return this.request(`/subscriptions/${userId}`, {
+  // Coupon endpoints
+  static async getCoupons() {
+    return this.request("/coupons");
+  }
+
+  static async createCoupon(couponData) {
+    return this.request("/coupons", {
+      method: "POST",
+      body: JSON.stringify(couponData),
+    });
+  }
+
+  static async deleteCoupon(couponId) {
+    return this.request(`/coupons/${couponId}`, {
       method: "DELETE",
     });
   }
+
+  static async getSubscriptions(userId) {
+    return this.request(`/users/${userId}/subscriptions`);
+  }
+
+  static async getSubscription(subscriptionId) {
+    return this.request(`/subscriptions/${subscriptionId}`);
+  }
+
+  static async getInvoices() {
+    return this.request("/invoices");
+  }
+
+  static async getUsage(subscriptionId) {
+    return this.request(`/subscriptions/${subscriptionId}/usage`);
+  }
+
+  static async setAutoRenew(subscriptionId, autoRenew) {
+    return this.request(`/subscriptions/${subscriptionId}/auto-renew`, {
+      method: "PUT",
+      body: JSON.stringify({ auto_renew: autoRenew }),
+    });
+  }
+
+  static async cancelSubscription(subscriptionId, mode = "period_end") {
+    return this.request(`/subscriptions/${subscriptionId}?mode=${mode}`, {
+      method: "DELETE",
+    });
+  }
+
+  static async undoCancellation(subscriptionId) {
+    return this.request(`/subscriptions/${subscriptionId}/undo-cancellation`, {
+      method: "POST",
+    });
+  }
+
+  static async pauseSubscription(subscriptionId, days) {
+    return this.request(`/subscriptions/${subscriptionId}/pause`, {
+      method: "POST",
+      body: JSON.stringify(days ? { days } : {}),
+    });
+  }
+
+  static async resumeSubscription(subscriptionId) {
+    return this.request(`/subscriptions/${subscriptionId}/resume`, {
+      method: "POST",
+    });
+  }
+
+  static async cancelPendingChange(subscriptionId) {
+    return this.request(`/subscriptions/${subscriptionId}/pending-change`, {
+      method: "DELETE",
+    });
+  }
+}
+
+// Money amounts from the API are integer minor units, such as paise or cents
+function currencyDigits(currency) {
+  return new Intl.NumberFormat("en-IN", { style: "currency", currency })
+    .resolvedOptions().maximumFractionDigits;
+}
+
+function toMinorUnits(amount, currency) {
+  return Math.round(amount * 10 ** currencyDigits(currency));
+}
+
+function fromMinorUnits(amount, currency) {
+  return amount / 10 ** currencyDigits(currency);
+}
+
+function formatMoney(money) {
+  if (!money?.currency) return "N/A";
+  return new Intl.NumberFormat("en-IN", {
+    style: "currency",
+    currency: money.currency,
+  }).format(fromMinorUnits(money.amount, money.currency));
 }
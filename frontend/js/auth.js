@@ -39,7 +39,13 @@ async function handleLogin(e) {
 
     if (response.success) {
       localStorage.setItem("token", response.data.token);
-      localStorage.setItem("user", JSON.stringify(response.data.user));
+      localStorage.setItem(
+        "user",
+        JSON.stringify({
+          ...response.data.user,
+          permissions: response.data.permissions || [],
+        })
+      );
       window.location.href = "/dashboard";
     }
   } catch (error) {
@@ -1,7 +1,10 @@
 // Global state
 let currentUser = null;
 let currentSubscription = null;
+let subscriptions = [];
 let availablePlans = [];
+let selectedCurrency = null;
+let currentUsage = null;
 
 // Initialization
 document.addEventListener("DOMContentLoaded", function () {
@@ -30,6 +33,7 @@ async function loadDashboard() {
     await loadUserSubscription();
     await loadPlans();
     await renderSubscriptionCard();
+    await loadInvoices();
     checkAdminAccess();
   } catch (error) {
     console.error("Error loading dashboard:", error);
@@ -37,7 +41,7 @@ async function loadDashboard() {
 }
 
 function checkAdminAccess() {
-  if (currentUser?.username === "admin") {
+  if (currentUser?.permissions?.includes("plans:write")) {
     const headerContent = document.querySelector(".header-content");
     const userMenu = headerContent.querySelector(".user-menu");
 
@@ -59,20 +63,89 @@ async function loadPlans() {
   const response = await API.getPlans();
   if (response.success) {
     availablePlans = response.data;
+    renderCurrencySelect();
     renderPlans();
   }
 }
 
 async function loadUserSubscription() {
   try {
-    const response = await API.getSubscription(currentUser.id);
-    currentSubscription = response.success ? response.data : null;
+    const response = await API.getSubscriptions(currentUser.id);
+    subscriptions = response.success ? response.data : [];
   } catch (error) {
-    currentSubscription = null;
+    subscriptions = [];
+  }
+  // The card shows the main product line; add-ons appear on their plans
+  currentSubscription =
+    subscriptions.find((s) => s.product_line === "core") ||
+    subscriptions[0] ||
+    null;
+  currentUsage = null;
+  if (hasAccess(currentSubscription)) {
+    try {
+      const response = await API.getUsage(currentSubscription.id);
+      currentUsage = response.success ? response.data : null;
+    } catch (error) {
+      currentUsage = null;
+    }
   }
   renderSubscriptionCard();
 }
 
+async function loadInvoices() {
+  try {
+    const response = await API.getInvoices();
+    renderInvoices(response.success ? response.data : []);
+  } catch (error) {
+    renderInvoices([]);
+  }
+}
+
+function renderInvoices(invoices) {
+  const tableBody = document.getElementById("invoicesTableBody");
+  if (invoices.length === 0) {
+    tableBody.innerHTML = `<div class="table-row"><div class="table-cell">No invoices yet</div></div>`;
+    return;
+  }
+
+  tableBody.innerHTML = invoices
+    .map(
+      (invoice) => `
+        <div class="table-row">
+            <div class="table-cell" data-label="Number">${
+              invoice.number || "Draft"
+            }</div>
+            <div class="table-cell" data-label="Date">${new Date(
+              invoice.created_at
+            ).toLocaleDateString()}</div>
+            <div class="table-cell" data-label="Status">${invoice.status}</div>
+            <div class="table-cell plan-features-list" data-label="Items">${invoice.lines
+              .map((line) => `${line.description}: ${formatMoney(line.amount)}`)
+              .join("<br>")}</div>
+            <div class="table-cell" data-label="Total">${formatMoney(
+              invoice.total
+            )}</div>
+        </div>
+      `
+    )
+    .join("");
+}
+
+function subscriptionForPlan(plan) {
+  return subscriptions.find(
+    (s) => s.product_line === (plan.product_line || "core")
+  );
+}
+
+// currentPlan returns the plan version the current subscription bought,
+// which archived plans keep even though they are no longer listed.
+function currentPlan() {
+  return (
+    currentSubscription.plan ||
+    availablePlans.find((p) => p.id === currentSubscription.plan_id)
+  );
+}
+
 // Rendering functions
 function renderSubscriptionCard() {
   const subscriptionContent = document.getElementById("subscriptionContent");
@@ -89,7 +162,7 @@ function renderSubscriptionCard() {
   }
 
   console.log(currentSubscription);
-  const plan = availablePlans.find((p) => p.id === currentSubscription.plan_id);
+  const plan = currentPlan();
   const formatDate = (date) => new Date(date).toLocaleDateString("en-IN");
 
   statusBadge.innerHTML = `
@@ -105,10 +178,34 @@ function renderSubscriptionCard() {
             </div>
             <div class="detail-item">
                 <div class="detail-label">Price</div>
-                <div class="detail-value price-value">₹${
-                  plan?.price || "N/A"
-                }</div>
+                <div class="detail-value price-value">${formatMoney(
+                  currentSubscription.total
+                )}</div>
             </div>
+            ${
+              currentSubscription.discount
+                ? `<div class="detail-item">
+                <div class="detail-label">Discount (${
+                  currentSubscription.discount.code
+                })</div>
+                <div class="detail-value">-${formatMoney(
+                  currentSubscription.discount.amount
+                )}${
+                  currentSubscription.discount.duration === "forever"
+                    ? ""
+                    : `, ${currentSubscription.discount.periods_left} period(s) left`
+                }</div>
+            </div>`
+                : ""
+            }
+            ${
+              hasSeats(plan)
+                ? `<div class="detail-item">
+                <div class="detail-label">Seats</div>
+                <div class="detail-value">${currentSubscription.quantity}</div>
+            </div>`
+                : ""
+            }
             <div class="detail-item">
                 <div class="detail-label">Duration</div>
                 <div class="detail-value">${plan?.duration || "N/A"}</div>
@@ -125,12 +222,32 @@ function renderSubscriptionCard() {
                   currentSubscription.expires_at
                 )}</div>
             </div>
+            <div class="detail-item">
+                <div class="detail-label">Auto-Renew</div>
+                <div class="detail-value">${
+                  currentSubscription.auto_renew ? "On" : "Off"
+                }</div>
+            </div>
             <div class="detail-item">
                 <div class="detail-label">Features</div>
                 <div class="detail-value">${
                   plan?.features.length || 0
                 } features included</div>
             </div>
+            ${(currentUsage?.meters || [])
+              .map(
+                (meter) => `<div class="detail-item">
+                <div class="detail-label">${meter.key} this period</div>
+                <div class="detail-value">${meter.used}${
+                  meter.limit !== undefined ? ` / ${meter.limit}` : ""
+                } ${meter.unit || ""}${
+                  meter.overage_charge
+                    ? ` (+${formatMoney(meter.overage_charge)} overage)`
+                    : ""
+                }</div>
+            </div>`
+              )
+              .join("")}
         </div>
         ${renderSubscriptionActions()}`;
 }
@@ -138,12 +255,74 @@ function renderSubscriptionCard() {
 function renderSubscriptionActions() {
   if (!currentSubscription) return "";
 
-  const plan = availablePlans.find((p) => p.id === currentSubscription.plan_id);
+  const plan = currentPlan();
   const planName = plan?.name || "Current Plan";
 
-  if (currentSubscription.status === "ACTIVE") {
+  if (currentSubscription.status === "PAUSED") {
+    const resumeDate = new Date(currentSubscription.resume_at).toLocaleDateString("en-IN");
+    return `
+            <div class="subscription-actions">
+                <p>Your subscription is paused until ${resumeDate}.</p>
+                <button class="btn btn-success-glass" onclick="resumeSubscription()">Resume Now</button>
+            </div>`;
+  }
+
+  if (currentSubscription.status === "INCOMPLETE") {
     return `
             <div class="subscription-actions">
+                <p>Your subscription starts once its payment goes through.</p>
+                <button class="btn btn-success-glass" onclick="renewCurrentPlan()">Check Payment (${planName})</button>
+                <button class="btn btn-danger-glass" onclick="cancelSubscription()">Cancel Subscription</button>
+            </div>`;
+  }
+
+  if (currentSubscription.status === "PAST_DUE") {
+    const graceEnd = new Date(currentSubscription.dunning.grace_end).toLocaleDateString("en-IN");
+    return `
+            <div class="subscription-actions">
+                <p>Your renewal is overdue. You keep access until ${graceEnd}.</p>
+                <button class="btn btn-success-glass" onclick="renewCurrentPlan()">Renew Now (${planName})</button>
+                <button class="btn btn-danger-glass" onclick="cancelSubscription()">Cancel Subscription</button>
+            </div>`;
+  }
+
+  if (hasAccess(currentSubscription) && currentSubscription.cancel_at) {
+    const cancelDate = new Date(currentSubscription.cancel_at).toLocaleDateString("en-IN");
+    return `
+            <div class="subscription-actions">
+                <p>Your subscription will end on ${cancelDate}.</p>
+                <button class="btn btn-success-glass" onclick="undoCancellation()">Keep Subscription</button>
+            </div>`;
+  }
+
+  if (hasAccess(currentSubscription) && currentSubscription.pending_plan_id) {
+    const pendingPlan = availablePlans.find(
+      (p) => p.id === currentSubscription.pending_plan_id
+    );
+    const changeDate = new Date(
+      currentSubscription.change_effective_at
+    ).toLocaleDateString("en-IN");
+    return `
+            <div class="subscription-actions">
+                <p>You will switch to ${
+                  pendingPlan?.name || "a new plan"
+                } on ${changeDate}.</p>
+                <button class="btn btn-glass" onclick="cancelPendingChange()">Keep ${planName}</button>
+                <button class="btn btn-danger-glass" onclick="cancelSubscription()">Cancel Subscription</button>
+            </div>`;
+  }
+
+  if (hasAccess(currentSubscription)) {
+    return `
+            <div class="subscription-actions">
+                <button class="btn btn-glass" onclick="toggleAutoRenew()">Turn ${
+                  currentSubscription.auto_renew ? "Off" : "On"
+                } Auto-Renew</button>
+                ${
+                  currentSubscription.status === "ACTIVE" && plan?.max_pause_days > 0
+                    ? `<button class="btn btn-glass" onclick="pauseSubscription()">Pause Subscription</button>`
+                    : ""
+                }
                 <button class="btn btn-danger-glass" onclick="cancelSubscription()">Cancel Subscription</button>
             </div>`;
   }
@@ -159,17 +338,25 @@ function renderPlans() {
   plansGrid.innerHTML = "";
 
   availablePlans.forEach((plan) => {
+    const lineSubscription = subscriptionForPlan(plan);
+    const point = pricePoint(plan);
+    const fromPrice = point.tiers?.length
+      ? Math.min(...point.tiers.map((tier) => tier.unit_price))
+      : point.amount;
     const isCurrentActivePlan =
-      currentSubscription?.plan_id === plan.id &&
-      currentSubscription?.status === "ACTIVE";
+      lineSubscription?.plan_id === plan.id && hasAccess(lineSubscription);
 
-    let buttonText = "Subscribe";
+    let buttonText =
+      plan.trial_days > 0 ? `Start ${plan.trial_days}-Day Free Trial` : "Subscribe";
     let buttonClass = "btn-primary";
     let isDisabled = false;
 
-    if (currentSubscription) {
-      if (currentSubscription.status === "ACTIVE") {
-        if (isCurrentActivePlan) {
+    if (lineSubscription) {
+      if (hasAccess(lineSubscription)) {
+        if (isCurrentActivePlan && hasSeats(plan)) {
+          buttonText = "Change Seats";
+          buttonClass = "btn-secondary";
+        } else if (isCurrentActivePlan) {
           buttonText = "Current Plan";
           buttonClass = "btn-secondary";
           isDisabled = true;
@@ -185,8 +372,13 @@ function renderPlans() {
     planCard.innerHTML = `
             <div class="plan-name">${plan.name}</div>
             <div class="plan-price">
-                <span class="currency">₹</span>${plan.price}
-                <span class="period">/${plan.duration}</span>
+                ${point.tiers?.length ? "from " : ""}${formatMoney({
+                  amount: fromPrice,
+                  currency: point.currency,
+                })}
+                <span class="period">${
+                  hasSeats(plan) ? "/seat" : ""
+                }/${plan.duration}</span>
             </div>
             <ul class="plan-features">
                 ${plan.features
@@ -205,8 +397,83 @@ function renderPlans() {
 
 // Action handlers
 async function handleSubscriptionAction(planId) {
+  const plan = availablePlans.find((p) => p.id === planId);
+  const lineSubscription = subscriptionForPlan(plan);
+  const currency = pricePoint(plan).currency;
+  const promoCode = document.getElementById("promoCode").value.trim();
+  const paymentMethod = document.getElementById("paymentMethod").value;
+
+  let quantity;
+  if (hasSeats(plan)) {
+    const current =
+      lineSubscription?.plan_id === planId ? lineSubscription.quantity : null;
+    const input = prompt(
+      "How many seats?",
+      current || Math.max(plan.min_quantity || 0, 1)
+    );
+    if (input === null) return;
+    quantity = parseInt(input, 10);
+    if (!quantity || quantity < 1) {
+      alert("Please enter a number of seats");
+      return;
+    }
+  }
+
+  if (hasSeats(plan) && !hasAccess(lineSubscription)) {
+    try {
+      const quote = (await API.getQuote(planId, quantity, currency)).data;
+      if (
+        !confirm(
+          `${quantity} seats cost ${formatMoney(quote.total)} ${
+            plan.duration
+          }.\n\nSubscribe?`
+        )
+      )
+        return;
+    } catch (error) {
+      alert("Error: " + error.message);
+      return;
+    }
+  }
+
+  if (hasAccess(lineSubscription)) {
+    try {
+      const preview = (
+        await API.previewSubscription(
+          currentUser.id,
+          planId,
+          quantity,
+          currency,
+          promoCode
+        )
+      ).data;
+      const message = preview.scheduled
+        ? `Your current plan continues until ${new Date(
+            preview.change_at
+          ).toLocaleDateString("en-IN")}.\n` +
+          `The new plan starts then at ${formatMoney(
+            preview.charge
+          )}.\n\nSchedule this change?`
+        : `Credit for unused time: ${formatMoney(preview.credit)}\n` +
+          `New plan charge: ${formatMoney(preview.charge)}\n` +
+          `Amount due now: ${formatMoney(preview.amount_due)}\n\nSwitch plans?`;
+      if (!confirm(message)) return;
+    } catch (error) {
+      alert("Error: " + error.message);
+      return;
+    }
+  }
+
   await executeAction(
-    () => API.upsertSubscription(currentUser.id, planId),
+    () =>
+      API.upsertSubscription(
+        currentUser.id,
+        planId,
+        quantity,
+        currency,
+        promoCode,
+        paymentMethod
+      ),
     "Subscription updated successfully!"
   );
 }
@@ -217,7 +484,7 @@ async function renewCurrentPlan() {
     return;
   }
 
-  const plan = availablePlans.find((p) => p.id === currentSubscription.plan_id);
+  const plan = currentPlan();
   const planName = plan?.name || "your current plan";
 
   if (!confirm(`Are you sure you want to renew ${planName}?`)) return;
@@ -228,12 +495,67 @@ async function renewCurrentPlan() {
   );
 }
 
+async function toggleAutoRenew() {
+  const autoRenew = !currentSubscription.auto_renew;
+
+  await executeAction(
+    () => API.setAutoRenew(currentSubscription.id, autoRenew),
+    `Auto-renew turned ${autoRenew ? "on" : "off"}.`
+  );
+}
+
 async function cancelSubscription() {
-  if (!confirm("Are you sure you want to cancel your subscription?")) return;
+  if (
+    !confirm(
+      "Are you sure you want to cancel your subscription? You will keep access until the end of the current period."
+    )
+  )
+    return;
+
+  await executeAction(
+    () => API.cancelSubscription(currentSubscription.id),
+    "Subscription will end at the end of the current period."
+  );
+}
+
+async function undoCancellation() {
+  await executeAction(
+    () => API.undoCancellation(currentSubscription.id),
+    "Cancellation undone. Your subscription will continue."
+  );
+}
+
+async function pauseSubscription() {
+  const plan = currentPlan();
+  const input = prompt(
+    `Pause for how many days? (up to ${plan.max_pause_days})`,
+    plan.max_pause_days
+  );
+  if (input === null) return;
+
+  const days = parseInt(input, 10);
+  if (!days || days < 1 || days > plan.max_pause_days) {
+    alert(`Please enter a number of days between 1 and ${plan.max_pause_days}`);
+    return;
+  }
+
+  await executeAction(
+    () => API.pauseSubscription(currentSubscription.id, days),
+    `Subscription paused for ${days} days.`
+  );
+}
+
+async function resumeSubscription() {
+  await executeAction(
+    () => API.resumeSubscription(currentSubscription.id),
+    "Subscription resumed. Your expiry date moved forward by the paused time."
+  );
+}
 
+async function cancelPendingChange() {
   await executeAction(
-    () => API.cancelSubscription(currentUser.id),
-    "Subscription cancelled successfully!"
+    () => API.cancelPendingChange(currentSubscription.id),
+    "Scheduled plan change cancelled."
   );
 }
 
@@ -245,15 +567,93 @@ async function upgradeToPlan(planId) {
 }
 
 // Utility functions
+function renderCurrencySelect() {
+  const currencies = [
+    ...new Set(
+      availablePlans.flatMap((plan) => plan.prices.map((p) => p.currency))
+    ),
+  ];
+  selectedCurrency =
+    selectedCurrency || currentSubscription?.currency || currencies[0];
+
+  const select = document.getElementById("currencySelect");
+  select.innerHTML = currencies
+    .map(
+      (currency) =>
+        `<option value="${currency}" ${
+          currency === selectedCurrency ? "selected" : ""
+        }>${currency}</option>`
+    )
+    .join("");
+  select.classList.toggle("hidden", currencies.length < 2);
+}
+
+function changeCurrency(currency) {
+  selectedCurrency = currency;
+  renderPlans();
+}
+
+// pricePoint returns the plan's price in the currency the user pays it in:
+// that of their running subscription, or the one they picked
+function pricePoint(plan) {
+  const lineSubscription = subscriptionForPlan(plan);
+  const currency = hasAccess(lineSubscription)
+    ? lineSubscription.currency
+    : selectedCurrency;
+  return plan.prices.find((p) => p.currency === currency) || plan.prices[0];
+}
+
+function hasSeats(plan) {
+  return Boolean(plan?.pricing_mode) && plan.pricing_mode !== "flat";
+}
+
+function hasAccess(subscription) {
+  return ["ACTIVE", "TRIALING", "PAST_DUE"].includes(subscription?.status);
+}
+
 async function executeAction(apiCall, successMessage) {
   try {
     const response = await apiCall();
     if (response.success) {
-      alert(successMessage);
+      if (response.data?.status === "INCOMPLETE") {
+        await completePayment(response.data.payment);
+      } else {
+        alert(successMessage);
+      }
       await loadDashboard();
     }
+  } catch (error) {
+    // A change to a running subscription is refused until its payment is
+    // confirmed, and then submitted again
+    if (error.data?.next_action_url && (await completePayment(error.data))) {
+      return executeAction(apiCall, successMessage);
+    }
+    alert("Error: " + error.message);
+  }
+}
+
+// completePayment asks the user to authenticate a payment that needs it and
+// reports whether they did.
+async function completePayment(payment) {
+  if (!payment?.next_action_url) {
+    alert("Your subscription starts once its payment goes through.");
+    return false;
+  }
+  if (
+    !confirm(
+      `Your bank asks you to confirm the payment of ${formatMoney(
+        payment.amount
+      )}.\n\nConfirm it now?`
+    )
+  )
+    return false;
+
+  try {
+    await API.confirmPayment(payment.next_action_url);
+    return true;
   } catch (error) {
     alert("Error: " + error.message);
+    return false;
   }
 }
 
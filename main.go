@@ -14,6 +14,8 @@ import (
 	"subservice/core/database"
 	"subservice/core/middleware"
 	"subservice/core/models"
+	"subservice/core/payments"
+	"subservice/core/workers"
 
 	"github.com/gin-gonic/gin"
 )
@@ -34,12 +36,85 @@ func main() {
 	// Initialize managers
 	userManager := models.NewUserManager(mongoDB.Database, cfg.JWTSecret, cfg.JWTExpiry)
 	planManager := models.NewPlanManager(mongoDB.Database)
-	subscriptionManager := models.NewSubscriptionManager(mongoDB.Database, planManager)
+	subscriptionEventManager := models.NewSubscriptionEventManager(mongoDB.Database)
+	trialManager := models.NewTrialManager(mongoDB.Database)
+	couponManager := models.NewCouponManager(mongoDB.Database)
+	creditManager := models.NewCreditManager(mongoDB.Database, userManager)
+	invoiceManager := models.NewInvoiceManager(mongoDB.Database, planManager, creditManager)
+	if rates, err := models.ParseTaxRates(cfg.TaxRates); err == nil {
+		invoiceManager.SetTaxRates(rates)
+	} else {
+		log.Printf("Invalid TAX_RATES, invoicing without tax: %v", err)
+	}
+
+	// Payment provider
+	var provider payments.Provider
+	var fakeProvider *payments.FakeProvider
+	switch cfg.PaymentProvider {
+	case "fake":
+		settleDelay, err := time.ParseDuration(cfg.FakeSettleDelay)
+		if err != nil || settleDelay < 0 {
+			log.Printf("Invalid FAKE_SETTLE_DELAY, using 30s")
+			settleDelay = 30 * time.Second
+		}
+		fakeProvider = payments.NewFakeProvider(cfg.PaymentWebhookSecret, settleDelay)
+		provider = fakeProvider
+	default:
+		log.Fatalf("Unknown PAYMENT_PROVIDER %q", cfg.PaymentProvider)
+	}
+	paymentManager := models.NewPaymentManager(mongoDB.Database, provider, invoiceManager, creditManager)
+
+	subscriptionManager := models.NewSubscriptionManager(mongoDB.Database, planManager, subscriptionEventManager, trialManager, couponManager, paymentManager)
+	if schedule, err := models.ParseDunningSchedule(cfg.DunningSchedule); err == nil {
+		subscriptionManager.SetDunningSchedule(schedule)
+	} else {
+		log.Printf("Invalid DUNNING_SCHEDULE, using the default: %v", err)
+	}
+	subscriptionManager.OnTransition(invoiceManager.Bill)
+	subscriptionManager.OnTransition(creditManager.CreditProration)
+	webhookManager := models.NewWebhookManager(mongoDB.Database, provider, subscriptionManager.HandlePaymentEvent)
+	if fakeProvider != nil {
+		webhookURL := cfg.FakeWebhookURL
+		if webhookURL == "" {
+			webhookURL = "http://localhost:" + cfg.Port + "/api/webhooks/payments"
+		}
+		fakeProvider.SendWebhooks(webhookURL)
+	}
+
+	// Start background lifecycle sweeper. Expiry runs last so renewals win
+	sweepInterval, _ := time.ParseDuration(cfg.SweepInterval)
+	if sweepInterval <= 0 {
+		sweepInterval = time.Minute
+	}
+	sweeperLock := database.NewLock(mongoDB.Database, "subscription-sweeper", 2*sweepInterval)
+	sweeper := workers.NewSweeper(sweeperLock, sweepInterval, 500,
+		workers.BatchJob{Name: "recovered swept events of", Run: subscriptionManager.RecoverSweepsDue},
+		workers.BatchJob{Name: "resumed", Run: subscriptionManager.ResumeDue},
+		workers.BatchJob{Name: "cancelled", Run: subscriptionManager.CancelDue},
+		workers.BatchJob{Name: "renewed", Run: subscriptionManager.RenewDue},
+		workers.BatchJob{Name: "lapsed", Run: subscriptionManager.LapseDue},
+		workers.BatchJob{Name: "dunning", Run: subscriptionManager.DunningDue},
+		workers.BatchJob{Name: "expired", Run: subscriptionManager.ExpireDue},
+		workers.BatchJob{Name: "expired incomplete", Run: subscriptionManager.ExpireIncompleteDue},
+		workers.BatchJob{Name: "abandoned unused payments of", Run: paymentManager.AbandonStaleDue},
+		workers.BatchJob{Name: "retried payment webhooks for", Run: webhookManager.RetryDue},
+	)
+	go sweeper.Run()
 
 	// Initialize controllers
 	userController := controllers.NewUserController(userManager)
-	planController := controllers.NewPlanController(planManager)
+	planController := controllers.NewPlanController(planManager, subscriptionManager)
 	subscriptionController := controllers.NewSubscriptionController(subscriptionManager)
+	entitlementController := controllers.NewEntitlementController(subscriptionManager)
+	usageController := controllers.NewUsageController(subscriptionManager)
+	couponController := controllers.NewCouponController(couponManager)
+	invoiceController := controllers.NewInvoiceController(invoiceManager, paymentManager)
+	creditController := controllers.NewCreditController(creditManager)
+	webhookController := controllers.NewWebhookController(webhookManager)
+	var fakePaymentController *controllers.FakePaymentController
+	if fakeProvider != nil {
+		fakePaymentController = controllers.NewFakePaymentController(fakeProvider, paymentManager)
+	}
 
 	// Setup router
 	if os.Getenv("GIN_MODE") == "release" {
@@ -92,22 +167,120 @@ func main() {
 			auth.POST("/login", userController.Login)
 		}
 
-		api.GET("/plans", planController.GetAllPlans)
+		api.GET("/plans", middleware.OptionalAuth(cfg.JWTSecret, userManager.Grants), planController.GetAllPlans)
+		api.GET("/plans/:id/quote", planController.QuotePlan)
+		api.GET("/plans/:id/versions", planController.ListPlanVersions)
+
+		// Authenticated by the provider's signature rather than a token
+		api.POST("/webhooks/payments", webhookController.HandlePaymentWebhook)
 
 		protected := api.Group("/")
-		protected.Use(middleware.AuthMiddleware(cfg.JWTSecret))
+		protected.Use(middleware.AuthMiddleware(cfg.JWTSecret, userManager.Grants))
 		{
-			protected.POST("/subscriptions", subscriptionController.UpsertSubscription)
-			protected.PUT("/subscriptions", subscriptionController.UpsertSubscription)
-			protected.GET("/subscriptions/:userId", subscriptionController.GetSubscription)
-			protected.DELETE("/subscriptions/:userId", subscriptionController.CancelSubscription)
+			subscriptionReaders := protected.Group("/subscriptions")
+			subscriptionReaders.Use(middleware.RequirePermission(models.PermSubscriptionsRead))
+			{
+				readAny := middleware.RequireSubscriptionOwnership(subscriptionManager.OwnerOf, models.PermSubscriptionsReadAny)
+				subscriptionReaders.POST("/preview", subscriptionController.PreviewSubscription)
+				subscriptionReaders.GET("/:id", readAny, subscriptionController.GetSubscription)
+				subscriptionReaders.GET("/:id/history", readAny, subscriptionController.GetHistory)
+				subscriptionReaders.GET("/:id/pending-change", readAny, subscriptionController.GetPendingChange)
+				subscriptionReaders.GET("/:id/usage", readAny, usageController.GetUsage)
+			}
+
+			subscriptionWriters := protected.Group("/subscriptions")
+			subscriptionWriters.Use(middleware.RequirePermission(models.PermSubscriptionsWrite))
+			{
+				writeAny := middleware.RequireSubscriptionOwnership(subscriptionManager.OwnerOf, models.PermSubscriptionsWriteAny)
+				subscriptionWriters.POST("", subscriptionController.UpsertSubscription)
+				subscriptionWriters.PUT("", subscriptionController.UpsertSubscription)
+				subscriptionWriters.DELETE("/:id", writeAny, subscriptionController.CancelSubscription)
+				subscriptionWriters.POST("/:id/undo-cancellation", writeAny, subscriptionController.UndoCancellation)
+				subscriptionWriters.PUT("/:id/auto-renew", writeAny, subscriptionController.SetAutoRenew)
+				subscriptionWriters.POST("/:id/pause", writeAny, subscriptionController.PauseSubscription)
+				subscriptionWriters.POST("/:id/resume", writeAny, subscriptionController.ResumeSubscription)
+				subscriptionWriters.DELETE("/:id/pending-change", writeAny, subscriptionController.CancelPendingChange)
+			}
+
+			userSubscriptions := protected.Group("/users/:userId/subscriptions")
+			userSubscriptions.Use(middleware.RequirePermission(models.PermSubscriptionsRead), middleware.RequireOwnership(models.PermSubscriptionsReadAny))
+			{
+				userSubscriptions.GET("", subscriptionController.ListSubscriptions)
+				userSubscriptions.GET("/history", subscriptionController.GetUserHistory)
+			}
+
+			credits := protected.Group("/users/:userId/credits")
+			{
+				credits.GET("", middleware.RequirePermission(models.PermSubscriptionsRead), middleware.RequireOwnership(models.PermSubscriptionsReadAny), creditController.GetCredits)
+				credits.POST("", middleware.RequirePermission(models.PermCreditsWrite), middleware.RequireOwnership(models.PermCreditsWrite), creditController.IssueCredit)
+			}
+
+			entitlements := protected.Group("/entitlements")
+			entitlements.Use(middleware.RequirePermission(models.PermSubscriptionsRead))
+			{
+				entitlements.GET("/:userId", middleware.RequireOwnership(models.PermSubscriptionsReadAny), entitlementController.GetEntitlements)
+				entitlements.POST("/check", entitlementController.CheckEntitlements)
+			}
+
+			invoiceReaders := protected.Group("/invoices")
+			invoiceReaders.Use(middleware.RequirePermission(models.PermSubscriptionsRead))
+			{
+				invoiceReaders.GET("", invoiceController.ListInvoices)
+				invoiceReaders.GET("/:id", invoiceController.GetInvoice)
+			}
+
+			invoiceWriters := protected.Group("/invoices")
+			invoiceWriters.Use(middleware.RequirePermission(models.PermInvoicesWrite))
+			{
+				invoiceWriters.POST("/:id/finalize", invoiceController.FinalizeInvoice)
+				invoiceWriters.POST("/:id/pay", invoiceController.PayInvoice)
+				invoiceWriters.POST("/:id/void", invoiceController.VoidInvoice)
+				invoiceWriters.POST("/:id/refund", invoiceController.RefundInvoice)
+			}
+
+			protected.GET("/webhooks/payments/failed", middleware.RequirePermission(models.PermInvoicesWrite), webhookController.ListFailedWebhooks)
+
+			// Stand-ins for a hosted 3-D Secure page and the gateway's dashboard
+			if fakePaymentController != nil {
+				protected.POST("/payments/fake/:chargeId/confirm", middleware.RequirePermission(models.PermSubscriptionsWrite), fakePaymentController.ConfirmCharge)
+				fakeDashboard := protected.Group("/payments/fake/:chargeId")
+				fakeDashboard.Use(middleware.RequirePermission(models.PermInvoicesWrite))
+				{
+					fakeDashboard.POST("/refund", fakePaymentController.RefundCharge)
+					fakeDashboard.POST("/dispute", fakePaymentController.DisputeCharge)
+				}
+			}
+
+			usageWriters := protected.Group("/usage")
+			usageWriters.Use(middleware.RequirePermission(models.PermUsageWrite))
+			{
+				usageWriters.POST("", usageController.RecordUsage)
+			}
+
+			planWriters := protected.Group("/plans")
+			planWriters.Use(middleware.RequirePermission(models.PermPlansWrite))
+			{
+				planWriters.POST("", planController.CreatePlan)
+				planWriters.PUT("/:id", planController.UpdatePlan)
+				planWriters.DELETE("/:id", planController.DeletePlan)
+				planWriters.POST("/:id/archive", planController.ArchivePlan)
+				planWriters.POST("/:id/unarchive", planController.UnarchivePlan)
+			}
+
+			couponManagers := protected.Group("/coupons")
+			couponManagers.Use(middleware.RequirePermission(models.PermCouponsWrite))
+			{
+				couponManagers.POST("", couponController.CreateCoupon)
+				couponManagers.GET("", couponController.GetAllCoupons)
+				couponManagers.GET("/:id", couponController.GetCoupon)
+				couponManagers.PUT("/:id", couponController.UpdateCoupon)
+				couponManagers.DELETE("/:id", couponController.DeleteCoupon)
+			}
 
-			adminOnly := protected.Group("/")
-			adminOnly.Use(middleware.AdminMiddleware())
+			userManagers := protected.Group("/users")
+			userManagers.Use(middleware.RequirePermission(models.PermUsersManage))
 			{
-				adminOnly.POST("/plans", planController.CreatePlan)
-				adminOnly.PUT("/plans/:id", planController.UpdatePlan)
-				adminOnly.DELETE("/plans/:id", planController.DeletePlan)
+				userManagers.PUT("/:userId/role", userController.UpdateRole)
 			}
 		}
 	}
@@ -125,6 +298,7 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 	log.Println("Shutting down server...")
+	sweeper.Stop()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -34,6 +34,22 @@ func ErrorResponse(c *gin.Context, statusCode int, message string, err error) {
 	c.JSON(statusCode, response)
 }
 
+func ConflictResponse(c *gin.Context, message string, data interface{}) {
+	c.JSON(http.StatusConflict, Response{
+		Success: false,
+		Message: message,
+		Data:    data,
+	})
+}
+
+func PaymentRequiredResponse(c *gin.Context, message string, data interface{}) {
+	c.JSON(http.StatusPaymentRequired, Response{
+		Success: false,
+		Message: message,
+		Data:    data,
+	})
+}
+
 func ValidationErrorResponse(c *gin.Context, err error) {
 	ErrorResponse(c, http.StatusBadRequest, "Validation failed", err)
 }
@@ -49,3 +65,7 @@ func NotFoundResponse(c *gin.Context, message string) {
 func UnauthorizedResponse(c *gin.Context, message string) {
 	ErrorResponse(c, http.StatusUnauthorized, message, nil)
 }
+
+func ForbiddenResponse(c *gin.Context, message string) {
+	ErrorResponse(c, http.StatusForbidden, message, nil)
+}